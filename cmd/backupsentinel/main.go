@@ -10,23 +10,48 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == app.SandboxExecArg {
+		// helper process of the command sandbox, never returns
+		app.RunSandboxExec(os.Args[2:])
+	}
+
 	consumerMode := flag.Bool("consumer", false, "run in consumer mode to process pending file events")
 	checkMode := flag.Bool("check", false, "when in consumer mode, only print pending events instead of processing them")
 	logLevel := flag.String("log-level", "debug", "set the logging level (debug|info|warn|error)")
 	isLogConsole := flag.Bool("l", false, "log to console instead of file")
 	dbPath := flag.String("db", "./backupSentinel.db", "path to sqlite database file")
-	cmdTemplate := flag.String("cmd", "", "command template to execute for each event; use %fullfile% placeholder")
-	cmdFile := flag.String("f", "", "path to JSON file containing per-event commands")
+	cmdTemplate := flag.String("cmd", "", "command template to execute for each event; use %file_path%, %old_file_path%, %event_type% ... placeholders (%file_path|quote% to quote)")
+	cmdFile := flag.String("f", "", "path to cmd file (JSON, YAML or TOML) with per-path command rules")
+	configPath := flag.String("config", "", "path to optional JSON config file")
+	rulesFile := flag.String("rules", "", "path to gitignore style include/exclude rule file")
+	catchUp := flag.Bool("catchup", false, "when in consumer mode, process pending windows back to back until the queue is empty")
 	flag.Parse()
 
-	if *checkMode {
+	args := flag.Args()
+	adminMode := app.ModeProducer
+	if len(args) > 0 {
+		switch args[0] {
+		case "rules":
+			adminMode = app.ModeRules
+		case "cmdfile":
+			adminMode = app.ModeCmdFile
+		}
+	}
+	if adminMode != app.ModeProducer {
+		args = args[1:]
+	}
+
+	if *checkMode || adminMode != app.ModeProducer {
 		*isLogConsole = true
 	}
 
 	lv := plogger.StrToLoggerLevel(*logLevel)
 
 	mode := app.ModeProducer
-	if *consumerMode {
+	if adminMode != app.ModeProducer {
+		mode = adminMode
+		plogger.InitLogger(*isLogConsole, lv, "./logs/")
+	} else if *consumerMode {
 		mode = app.ModeConsumer
 		plogger.InitLogger(*isLogConsole, lv, "./logs/consumer/")
 		plogger.Debugf("cmd[%v]", *cmdTemplate)
@@ -34,8 +59,18 @@ func main() {
 		plogger.InitLogger(*isLogConsole, lv, "./logs/producer/")
 	}
 
-	application := app.New(app.Options{Mode: mode, Check: *checkMode, DBPath: *dbPath, Cmd: *cmdTemplate, CmdFile: *cmdFile})
-	if err := application.Run(flag.Args()); err != nil {
+	options := app.Options{Mode: mode, Check: *checkMode, DBPath: *dbPath, Cmd: *cmdTemplate, CmdFile: *cmdFile, RulesFile: *rulesFile, CatchUp: *catchUp}
+	if *configPath != "" {
+		cfg, err := app.LoadConfig(*configPath)
+		if err != nil {
+			plogger.Errorf("load config: %v", err)
+			os.Exit(1)
+		}
+		cfg.Apply(&options)
+	}
+
+	application := app.New(options)
+	if err := application.Run(args); err != nil {
 		plogger.Errorf("backup sentinel stopped: %v", err)
 		os.Exit(1)
 	}
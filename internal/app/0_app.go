@@ -1,6 +1,10 @@
 package app
 
 import (
+	"io"
+	"os"
+	"time"
+
 	"github.com/pancake-lee/pgo/pkg/plogger"
 )
 
@@ -12,6 +16,10 @@ const (
 	ModeProducer Mode = iota
 	// ModeConsumer represents the long running consumer mode.
 	ModeConsumer
+	// ModeRules runs the "rules" admin subcommand.
+	ModeRules
+	// ModeCmdFile runs the "cmdfile" admin subcommand.
+	ModeCmdFile
 )
 
 // String returns a human readable label.
@@ -19,6 +27,10 @@ func (m Mode) String() string {
 	switch m {
 	case ModeConsumer:
 		return "consumer"
+	case ModeRules:
+		return "rules"
+	case ModeCmdFile:
+		return "cmdfile"
 	default:
 		return "producer"
 	}
@@ -39,23 +51,132 @@ type Options struct {
 	// When set, the file is parsed and commands loaded into Cmds.
 	CmdFile string
 	// per-event commands are loaded via CmdFileManager; no in-memory map here.
+
+	// EventTypeLocales selects the built-in Directory Monitor label tables.
+	// Empty means all built-in locales.
+	EventTypeLocales []string
+	// EventTypeAliases adds custom raw label -> EventType mappings.
+	EventTypeAliases map[string]string
+	// TimestampLayouts are Go time layouts tried in order for the %date% %time%
+	// value. RFC3339 and Unix epoch (s or ms) are always accepted.
+	TimestampLayouts []string
+	// TimestampZone is the IANA zone of the source timestamps; empty means Local.
+	TimestampZone string
+	// RulesFile is an optional gitignore style include/exclude rule file
+	// applied to every event by the producer.
+	RulesFile string
+	// RuleRoots lists watched roots; paths are matched relative to the
+	// longest matching root, which may carry its own rule file.
+	RuleRoots []RuleRoot
+	// StabilityPeriod defers CREATE/MODIFY until the file's size and mtime
+	// have been unchanged this long. 0 disables the check.
+	StabilityPeriod time.Duration
+	// StabilityCheckOpen also defers files still held open by another process.
+	StabilityCheckOpen bool
+	// CoalesceRules overlay the default coalescing rules by name or append
+	// new ones.
+	CoalesceRules []CoalesceRule
+	// TempPatterns are basename globs of temporary files; nil keeps the
+	// built-in list.
+	TempPatterns []string
+	// ModifyQuietPeriod collapses MODIFYs of one path that are at most this
+	// far apart into the latest one. 0 means the default, negative disables.
+	ModifyQuietPeriod time.Duration
+	// HashMoveLookback enables content-hash move detection: a CREATE whose
+	// content matches a file deleted within this long becomes a MOVE.
+	// 0 disables hashing.
+	HashMoveLookback time.Duration
+
+	// Consumer timing, see Windows; 0 keeps the default.
+	SettleDelay  time.Duration
+	FetchWindow  time.Duration
+	MatchWindow  time.Duration
+	PollInterval time.Duration
+	// PriorityMaxWait bounds how long low priority events can starve.
+	PriorityMaxWait time.Duration
+	// PriorityRules assign the producer's event priorities, see PriorityRules.
+	PriorityRules []PriorityRule
+
+	// CatchUp makes the consumer process pending windows back to back while
+	// eligible events remain, sleeping only once the queue is empty.
+	CatchUp bool
+	// CatchUpMaxEvents caps the events handled per cycle in catch-up mode;
+	// 0 means defaultCatchUpMaxEvents.
+	CatchUpMaxEvents int
+
+	// ExecMode selects how commands are run; empty means ExecModeSplit.
+	ExecMode ExecMode
+	// ExitCodes overlay defaultExitCodes, see CmdStatus.
+	ExitCodes map[int]CmdStatus
+	// AllowedCmdFileDirs restricts the cmd files events may reference to
+	// these directories; empty allows any.
+	AllowedCmdFileDirs []string
+	// AllowedExecutables restricts the programs commands may start, by name
+	// (looked up in PATH) or path; empty allows any.
+	AllowedExecutables []string
+	// Sandbox confines command processes on Linux; nil runs them as is.
+	Sandbox *SandboxConfig
+	// NoCmdPolicy maps event types ("*" for any) to what happens when no
+	// command resolves for an event; unset types use defaultNoCmdPolicy.
+	NoCmdPolicy map[string]NoCmdPolicy
+
+	// Wakeup makes the consumer watch the database for writes and wake when
+	// the settle delay of the next event expires; PollInterval remains as a
+	// fallback and can then be set much longer.
+	Wakeup bool
+}
+
+const defaultCatchUpMaxEvents = 1000
+
+func (o Options) catchUpMaxEvents() int {
+	if o.CatchUpMaxEvents > 0 {
+		return o.CatchUpMaxEvents
+	}
+	return defaultCatchUpMaxEvents
+}
+
+// windows returns the consumer windows with defaults applied.
+func (o Options) windows() Windows {
+	return Windows{
+		SettleDelay:     o.SettleDelay,
+		FetchWindow:     o.FetchWindow,
+		MatchWindow:     o.MatchWindow,
+		PollInterval:    o.PollInterval,
+		PriorityMaxWait: o.PriorityMaxWait,
+	}.withDefaults()
 }
 
 // App coordinates the executable lifecycle.
 type App struct {
 	options Options
+	// stdout receives output of admin subcommands.
+	stdout io.Writer
+	// stability is created by the consumer and keeps file observations
+	// across cycles.
+	stability *StabilityChecker
+	// hashIndex is created by the consumer; nil when disabled.
+	hashIndex *HashIndex
+	// allow is created by the consumer; nil allows every cmd file and program.
+	allow *Allowlist
+	// batches holds the batches being collected by the consumer.
+	batches map[batchKey]*pendingBatch
 }
 
 // New constructs an App instance with defaults.
 func New(options Options) *App {
-	return &App{options: options}
+	return &App{options: options, stdout: os.Stdout}
 }
 
 // Run executes the requested workflow. For now it only parses Directory Monitor payloads.
 func (a *App) Run(args []string) error {
 	plogger.Debugf("starting in %s mode", a.options.Mode)
-	if a.options.Mode == ModeConsumer {
+	switch a.options.Mode {
+	case ModeConsumer:
 		return a.runConsumer()
+	case ModeRules:
+		return a.runRules(args)
+	case ModeCmdFile:
+		return a.runCmdFile(args)
 	}
 	return a.runProducer(args)
 }
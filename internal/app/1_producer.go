@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"os"
 	"strings"
 
 	"github.com/pancake-lee/pgo/pkg/plogger"
@@ -24,16 +25,40 @@ func (a *App) runProducer(args []string) error {
 	}
 	plogger.Debugf("raw payload: %s", rawPayload)
 
-	if shouldSkipPath(rawPayload) {
-		plogger.Debugf("skipping event for path matching skip patterns")
+	// --------------------------------------------------
+	types, err := NewEventTypeMapper(a.options.EventTypeLocales, a.options.EventTypeAliases)
+	if err != nil {
+		return fmt.Errorf("event type mapping: %w", err)
+	}
+	times, err := NewTimestampParser(a.options.TimestampLayouts, a.options.TimestampZone)
+	if err != nil {
+		return fmt.Errorf("timestamp parsing: %w", err)
+	}
+	event, err := NewPayloadParser(types, times).Parse(rawPayload)
+	if err != nil {
+		return fmt.Errorf("parse Directory Monitor payload: %w", err)
+	}
+
+	// 删除后无法再判断，只能依赖 payload 的 isdir 或消费者推断
+	if !event.IsDir && event.EventType != EventType_DELETE {
+		if fi, err := os.Stat(event.FilePath); err == nil && fi.IsDir() {
+			event.IsDir = true
+		}
+	}
+
+	filter := NewPathFilter(a.options.RulesFile, a.options.RuleRoots)
+	if skip, err := filter.ShouldSkip(event); err != nil {
+		return fmt.Errorf("evaluate path rules: %w", err)
+	} else if skip {
+		plogger.Debugf("skipping event for excluded path %s", event.FilePath)
 		return nil
 	}
 
-	// --------------------------------------------------
-	event, err := ParseDirectoryMonitorPayload(rawPayload)
+	priorities, err := NewPriorityRules(a.options.PriorityRules)
 	if err != nil {
-		return fmt.Errorf("parse Directory Monitor payload: %w", err)
+		return fmt.Errorf("priority rules: %w", err)
 	}
+	event.Priority = priorities.Priority(event)
 
 	// log event as JSON at info level
 	if b, err := json.Marshal(event); err != nil {
@@ -65,21 +90,3 @@ func (a *App) runProducer(args []string) error {
 
 	return nil
 }
-
-// 跳过，已知的一些特殊文件
-var skipPatterns = []string{
-	"@eaDir",
-	"@SynoEAStream",
-	"._",
-	".DS_Store",
-	"Thumbs.db",
-}
-
-func shouldSkipPath(filePath string) bool {
-	for _, pattern := range skipPatterns {
-		if strings.Contains(filePath, pattern) {
-			return true
-		}
-	}
-	return false
-}
@@ -1,13 +1,11 @@
 package app
 
 import (
+	"errors"
 	"fmt"
-	"path/filepath"
-	"strconv"
 	"time"
 
 	"github.com/pancake-lee/pgo/pkg/plogger"
-	"github.com/pancake-lee/pgo/pkg/putil"
 )
 
 func (a *App) runConsumer() error {
@@ -24,6 +22,10 @@ func (a *App) runConsumer() error {
 
 	// Command file manager for per-event cmd files referenced in events.
 	cmdMgr := NewCmdFileManager(0)
+	if err := cmdMgr.Watch(); err != nil {
+		plogger.Errorf("cmd file hot reload disabled, falling back to ttl: %v", err)
+	}
+	defer cmdMgr.Close()
 
 	// If a command file is provided via CLI, preload it into cmd manager.
 	if a.options.CmdFile != "" {
@@ -33,109 +35,358 @@ func (a *App) runConsumer() error {
 		}
 	}
 
+	win := a.options.windows()
+	if err := win.Validate(); err != nil {
+		plogger.Errorf("invalid consumer windows: %v", err)
+		return fmt.Errorf("consumer windows: %w", err)
+	}
+	plogger.Infof("consumer windows: %s", win)
+	if a.options.CatchUp {
+		plogger.Infof("catch-up mode: at most %d events per cycle", a.options.catchUpMaxEvents())
+	}
+
+	if err := validateExitCodes(a.options.ExitCodes); err != nil {
+		plogger.Errorf("invalid exit codes: %v", err)
+		return err
+	}
+	allow, err := NewAllowlist(a.options.AllowedCmdFileDirs, a.options.AllowedExecutables)
+	if err != nil {
+		plogger.Errorf("invalid allowlist: %v", err)
+		return fmt.Errorf("allowlist: %w", err)
+	}
+	a.allow = allow
+	if err := a.options.Sandbox.validate(); err != nil {
+		plogger.Errorf("invalid sandbox: %v", err)
+		return err
+	}
+	if err := validateNoCmdPolicies(a.options.NoCmdPolicy); err != nil {
+		plogger.Errorf("invalid no command policy: %v", err)
+		return err
+	}
+	if err := a.options.ExecMode.validate(); err != nil {
+		plogger.Errorf("invalid exec mode: %v", err)
+		return err
+	}
+	if a.options.Cmd != "" {
+		if _, err := ParseCmdTemplate(a.options.Cmd); err != nil {
+			plogger.Errorf("invalid -cmd: %v", err)
+			return fmt.Errorf("cmd template: %w", err)
+		}
+		if a.options.ExecMode == ExecModeArgv {
+			if _, err := splitArgs(a.options.Cmd); err != nil {
+				plogger.Errorf("invalid -cmd: %v", err)
+				return fmt.Errorf("cmd template: %w", err)
+			}
+		}
+	}
+
 	// If Check flag is set, just list once and exit.
 	if a.options.Check {
-		pending, err := st.GetPendingEvents()
+		pending, err := st.GetPendingEventsWindow(win)
 		if err != nil {
 			plogger.Errorf("get pending: %v", err)
 			return fmt.Errorf("get pending: %w", err)
 		}
 		for _, pe := range pending {
-			plogger.Infof("pending id=%d type=%s file=%s at=%s", pe.ID, pe.EventType, pe.FilePath, pe.EventTime.Format(time.RFC3339))
+			plogger.Infof("pending id=%d type=%s file=%s at=%s priority=%d", pe.ID, pe.EventType, pe.FilePath, pe.EventTime.Format(time.RFC3339), pe.Priority)
+		}
+		held, err := st.GetHeldEvents()
+		if err != nil {
+			plogger.Errorf("get held: %v", err)
+			return fmt.Errorf("get held: %w", err)
+		}
+		for _, pe := range held {
+			plogger.Infof("held (no command) id=%d type=%s file=%s at=%s cmd_file=%s", pe.ID, pe.EventType, pe.FilePath, pe.EventTime.Format(time.RFC3339), pe.CmdFile)
 		}
 		return nil
 	}
 
+	// the configuration may have changed since events were held
+	if n, err := st.ReleaseHeldEvents(nil); err != nil {
+		plogger.Errorf("release held events: %v", err)
+	} else if n > 0 {
+		plogger.Infof("released %d held events for re-evaluation", n)
+	}
+	cmdMgr.OnReload(a.releaseHeldOnReload(st))
+
+	// batches collected before a restart are lost with the process
+	if n, err := st.ReleaseBatched(nil); err != nil {
+		plogger.Errorf("release batched events: %v", err)
+	} else if n > 0 {
+		plogger.Infof("released %d events of unfinished batches", n)
+	}
+
+	a.stability = NewStabilityChecker(a.options.StabilityPeriod, a.options.StabilityCheckOpen)
+	a.hashIndex = NewHashIndex(st, a.options.HashMoveLookback)
+
+	coalescer, err := NewCoalescer(CoalesceConfig{
+		Rules:             a.options.CoalesceRules,
+		TempPatterns:      a.options.TempPatterns,
+		ModifyQuietPeriod: a.options.ModifyQuietPeriod,
+		Windows:           win,
+	})
+	if err != nil {
+		plogger.Errorf("invalid coalesce config: %v", err)
+		return fmt.Errorf("coalesce config: %w", err)
+	}
+
 	// Continuous processing loop: check DB every 1X, but ensure that if processing
 	// of messages takes longer than the interval we don't run overlapping cycles.
-	ticker := time.NewTicker(rangeInterval)
+	ticker := time.NewTicker(win.PollInterval)
 	defer ticker.Stop()
 
-	// Run an initial immediate check
-	runOnce := func() {
+	// optional event-driven wakeup; polling stays as the fallback
+	var wake *Wakeup
+	if a.options.Wakeup {
+		wake, err = NewWakeup(dbPath)
+		if err != nil {
+			plogger.Errorf("wakeup disabled, polling only: %v", err)
+			wake = nil
+		} else {
+			defer wake.Close()
+			plogger.Infof("wakeup: watching %s", dbPath)
+		}
+	}
+
+	// Start background loop; block until context cancellation not provided here so run until program exit.
+	for {
+		a.runCycle(st, coalescer, cmdMgr)
+		// wait for next tick or the next event to settle
+		a.waitForWork(st, ticker, wake)
+	}
+}
+
+// runCycle processes one pending window. In catch-up mode it keeps
+// fetching and processing windows back to back until the queue is empty,
+// a window could not be drained, or CatchUpMaxEvents events were handled.
+func (a *App) runCycle(st *Storage, coalescer *Coalescer, cmdMgr *CmdFileManager) {
+	win := a.options.windows()
+	handled := 0
+	// batches due by max_wait run after the window
+	defer a.flushBatches(st, false)
+	for {
 		plogger.Debug("--------------------------------------------------")
-		pending, err := GetAndFixedPendingEvents(st)
+		pending, err := coalescer.GetAndFixedPendingEvents(st)
 		if err != nil {
 			plogger.Errorf("get pending: %v", err)
 			return
 		}
+		drained := a.processWindow(st, pending, cmdMgr)
+		handled += len(pending)
 
-		for _, pe := range pending {
-			if err := a.processPendingEvent(st, pe, cmdMgr); err != nil {
-				// log and continue with next pending event
-				plogger.Errorf("processing id=%d failed: %v", pe.ID, err)
-			}
+		if !a.options.CatchUp {
+			return
+		}
+		if !drained {
+			// the same earliest event would be fetched again; wait for the next tick
+			return
+		}
+		if handled >= a.options.catchUpMaxEvents() {
+			plogger.Infof("catch-up cap reached: handled %d events this cycle", handled)
+			return
+		}
+		more, err := st.HasPendingEvents(win.SettleDelay)
+		if err != nil {
+			plogger.Errorf("check pending: %v", err)
+			return
+		}
+		if !more {
+			return
 		}
 	}
+}
 
-	// Start background loop; block until context cancellation not provided here so run until program exit.
-	for {
-		runOnce()
-		// wait for next tick
-		<-ticker.C
+// processWindow runs the commands of one coalesced window and reports
+// whether every event in it was processed. Events collected into a batch or
+// parked until their file is stable are not fetched again, so they do not
+// keep the window from draining.
+func (a *App) processWindow(st *Storage, pending []PendingEvent, cmdMgr *CmdFileManager) bool {
+	drained := true
+	// paths with a deferred event keep their later events pending too,
+	// so per-path ordering is preserved; the value reports whether the
+	// deferred event is fetched again right away
+	deferred := make(map[string]bool)
+	for _, pe := range pending {
+		again, ok := deferred[pe.FilePath]
+		if !ok && pe.OldFilePath != "" {
+			again, ok = deferred[pe.OldFilePath]
+		}
+		if ok {
+			plogger.Debugf("defer id=%d behind earlier event of %s", pe.ID, pe.FilePath)
+			if again {
+				drained = false
+			}
+			continue
+		}
+		if err := a.processPendingEvent(st, pe, cmdMgr); err != nil {
+			if errors.Is(err, errBatched) {
+				deferred[pe.FilePath] = false
+				continue
+			}
+			if errors.Is(err, errFileUnstable) {
+				deferred[pe.FilePath] = false
+				plogger.Debugf("defer id=%d: %v", pe.ID, err)
+				continue
+			}
+			// later events of the path wait for this one
+			deferred[pe.FilePath] = true
+			drained = false
+			// log and continue with next pending event
+			plogger.Errorf("processing id=%d failed: %v", pe.ID, err)
+		}
 	}
+	return drained
 }
 
 // processPendingEvent handles a single PendingEvent
 func (a *App) processPendingEvent(st *Storage, pe PendingEvent, cmdMgr *CmdFileManager) error {
 	plogger.Debug("--------------------------------------------------")
 	plogger.Infof("process id=%d type=%s file=%s at=%s", pe.ID, pe.EventType, pe.FilePath, pe.EventTime.Format(time.RFC3339))
+
+	// no command runs for a type nobody could map, see defaultUnknownPolicy
+	if pe.EventType == EventType_UNKNOWN {
+		return a.applyNoCommand(st, pe)
+	}
+
+	// still being written: leave pending without counting as a failure,
+	// parked for a settle delay so it does not pin the window anchor
+	if err := a.stability.Check(pe); err != nil {
+		if errors.Is(err, errFileUnstable) {
+			at := time.Now().Add(a.options.windows().SettleDelay)
+			if derr := st.DeferEvent(pe.ID, at); derr != nil {
+				plogger.Errorf("defer id=%d: %v", pe.ID, derr)
+			}
+		}
+		return err
+	}
+
+	// a CREATE whose content matches a recent delete becomes a MOVE
+	hash := a.hashIndex.BeforeProcess(&pe)
+
 	// choose command: prefer per-event mapping if present
-	cmdStr := ""
+	var spec *CmdSpec
 	logCmdEventType := "default"
 
 	// 1) global CLI override
 	if a.options.Cmd != "" {
-		cmdStr = a.options.Cmd
+		spec = &CmdSpec{Command: a.options.Cmd}
 		logCmdEventType = "cli"
 	}
 
 	// next steps: consult CLI cmd-file via cmdMgr or event-level cmd_file as fallback
 
 	// 2) if CLI provided a cmd-file, consult it via manager
-	if cmdStr == "" && a.options.CmdFile != "" {
-		if evCmd, err := cmdMgr.GetCmd(a.options.CmdFile, pe.EventType); err == nil && evCmd != "" {
-			cmdStr = evCmd
-			logCmdEventType = string(pe.EventType)
+	var resolveErr error
+	if spec == nil && a.options.CmdFile != "" {
+		if evSpec, err := cmdMgr.GetSpec(a.options.CmdFile, pe); err == nil && evSpec != nil {
+			spec = evSpec
+			logCmdEventType = specLabel(evSpec, pe)
 		} else if err != nil {
 			plogger.Errorf("failed to get cmd from CLI cmd_file %s: %v", a.options.CmdFile, err)
+			resolveErr = err
 		}
 	}
 
-	// 3) fallback: event-level cmd_file referenced in the event record
-	if cmdStr == "" && pe.CmdFile != "" {
-		evCmd, err := cmdMgr.GetCmd(pe.CmdFile, pe.EventType)
+	// 3) fallback: event-level cmd_file referenced in the event record,
+	// only from allowed directories
+	if spec == nil && pe.CmdFile != "" {
+		if err := a.allow.CheckCmdFile(pe.CmdFile); err != nil {
+			plogger.Errorf("refused event cmd_file id=%d: %v", pe.ID, err)
+			return a.applyResult(st, pe, CmdResult{Status: StatusFailed, Message: err.Error()}, RetryPolicy{}, hash)
+		}
+		evSpec, err := cmdMgr.GetSpec(pe.CmdFile, pe)
 		if err != nil {
 			plogger.Errorf("failed to get cmd from event cmd_file %s: %v", pe.CmdFile, err)
-		} else if evCmd != "" {
-			cmdStr = evCmd
-			logCmdEventType = string(pe.EventType)
+			resolveErr = err
+		} else if evSpec != nil {
+			spec = evSpec
+			logCmdEventType = specLabel(evSpec, pe)
 		}
 	}
 
-	// If no template at all, error
-	if cmdStr == "" {
-		plogger.Errorf("no command configured to process events")
-		//TODO 可以写一个失败到数据库的标记，然后重启时重试这种情况
-		return fmt.Errorf("no command configured")
+	// no command at all: skip, fail or hold per event type. An unreadable
+	// cmd file is not a missing command, the event is retried.
+	if spec == nil {
+		if resolveErr != nil {
+			return resolveErr
+		}
+		return a.applyNoCommand(st, pe)
 	}
 
-	cmdStr += " fullfile " + strconv.Quote(pe.FilePath)
-	cmdStr += " oldfullfile " + strconv.Quote(pe.OldFilePath)
+	// batch rules run later, once for many events
+	if spec.Batch != nil {
+		return a.addToBatch(st, spec, logCmdEventType, pe, hash)
+	}
 
-	out, err := putil.ExecSplit(cmdStr)
-	plogger.Debugf("exec cmd[%v][%s] err[%v] out[\n-----\n%v\n-----]",
-		logCmdEventType, cmdStr, err, out)
-	if err != nil {
-		return plogger.LogErr(err)
+	x := execEnv{mode: a.options.ExecMode, allow: a.allow, sandbox: a.options.Sandbox}
+	var res CmdResult
+	if len(spec.Steps) > 0 {
+		res = a.runSteps(st, x, spec, pe)
+	} else {
+		res = a.runCmd(x, spec, pe, logCmdEventType)
+	}
+	return a.applyResult(st, pe, res, spec.Retry, hash)
+}
+
+// specLabel names the cmd file rule used for pe in logs.
+func specLabel(spec *CmdSpec, pe PendingEvent) string {
+	if spec.Name != "" {
+		return spec.Name
 	}
+	return string(pe.EventType)
+}
 
-	err = st.MarkProcessed(pe.ID)
-	if err != nil {
-		plogger.Errorf("mark processed id=%d: %v", pe.ID, err)
+// applyResult moves pe to the state the command result asks for, applying
+// the retry policy. A retry is returned as an error so the rest of the path
+// waits.
+func (a *App) applyResult(st *Storage, pe PendingEvent, res CmdResult, retry RetryPolicy, hash string) error {
+	// a MOVE rewritten by content hash whose source is already gone at the
+	// destination: upload the file after all
+	if res.Status != StatusSuccess && res.Status != StatusSkip && a.hashIndex.RevertMove(pe, hash, res.Message) {
+		return fmt.Errorf("hash move id=%d from %s failed, retrying as CREATE: %s", pe.ID, pe.OldFilePath, res.Message)
+	}
+
+	if res.Status == StatusRetry && retry.MaxAttempts > 0 && pe.Attempts+1 >= retry.MaxAttempts {
+		res.Status = StatusFailed
+		res.Message = fmt.Sprintf("gave up after %d attempts: %s", pe.Attempts+1, res.Message)
+	}
+	if res.Status == StatusRetry && res.RetryAfter == 0 {
+		res.RetryAfter = retryAfter(retry.delay(pe.Attempts + 1))
+	}
+
+	var processed int
+	switch res.Status {
+	case StatusSuccess:
+		processed = 1
+	case StatusSkip:
+		processed = 2
+	case StatusFailed:
+		processed = 3
+	default:
+		var at time.Time
+		if res.RetryAfter > 0 {
+			at = time.Now().Add(time.Duration(res.RetryAfter))
+		}
+		if err := st.ScheduleRetry(pe.ID, at, res.Message); err != nil {
+			plogger.Errorf("schedule retry id=%d: %v", pe.ID, err)
+		}
+		return fmt.Errorf("command asked to retry id=%d after %v: %s",
+			pe.ID, time.Duration(res.RetryAfter), res.Message)
+	}
+
+	if err := st.RecordResult(pe.ID, processed, res); err != nil {
+		plogger.Errorf("record result id=%d: %v", pe.ID, err)
 		return plogger.LogErr(err)
 	}
-	plogger.Debugf("marked processed id=%d", pe.ID)
+	switch res.Status {
+	case StatusSuccess:
+		a.hashIndex.AfterProcess(pe, hash)
+		plogger.Debugf("marked processed id=%d remote_id=%s", pe.ID, res.RemoteID)
+	case StatusSkip:
+		plogger.Debugf("marked skipped by command id=%d: %s", pe.ID, res.Message)
+	case StatusFailed:
+		plogger.Errorf("dead letter id=%d type=%s file=%s: %s", pe.ID, pe.EventType, pe.FilePath, res.Message)
+	}
 	return nil
 }
 
@@ -166,6 +417,10 @@ func (a *App) processPendingEvent(st *Storage, pe PendingEvent, cmdMgr *CmdFileM
 		丢弃新增事件，标记为跳过（processed = 2）
 	判定失败：
 		正常处理删除事件和1s后的新增事件。
+
+4：临时文件（~$x.docx、*.tmp、*.crdownload、rsync 的 .x.XXXXXX 等）先于上述规则处理，见 temp_files.go
+
+以上 2、3 以及"新增+修改"现在是 coalesce_rules.go 中的默认规则，可在配置中覆盖或追加
 */
 
 // 最早未处理|----rangeInterval---|----rangeInterval---|-else-|now
@@ -174,122 +429,26 @@ func (a *App) processPendingEvent(st *Storage, pe PendingEvent, cmdMgr *CmdFileM
 // 最早未处理|-实际处理一倍的量-----|----rangeInterval---|-else-|now
 // 最早未处理|------------|-组合事件搜索一倍的量-|--------|-else-|now
 // 最早未处理|-处理轮询一倍的时间---|-处理轮询一倍的时间---|-else-|now
+//
+// 以上倍数是默认值，分别对应 Windows 的 SettleDelay、FetchWindow、
+// MatchWindow、PollInterval，可在配置中单独调整，见 windows.go
 
 const rangeInterval = 2 * time.Second
 
-// 调用st.GetPendingEvents，并且处理一些特殊事件的转换逻辑，再返回给外层处理
+// GetAndFixedPendingEvents applies the default coalescing rules, see
+// Coalescer.GetAndFixedPendingEvents.
 func GetAndFixedPendingEvents(st *Storage) ([]PendingEvent, error) {
-	all, err := st.GetPendingEvents()
-	if err != nil {
-		return nil, err
-	}
-	if len(all) == 0 {
-		return all, nil
-	}
-
-	earliestTime := all[0].EventTime
-
-	var out []PendingEvent
-	skip := make(map[int]bool)
-	for i := 0; i < len(all); i++ {
-		if skip[i] {
-			// this index was consumed/marked skipped by an earlier merge
-			continue
-		}
-		cur := all[i]
-		if cur.EventTime.Sub(earliestTime) > rangeInterval {
-			// beyond 1s window; stop processing further events
-			break
-		}
-		plogger.Debugf("handle event[%v] type[%v] file[%v] old[%v]",
-			cur.ID, cur.EventType, cur.FilePath, cur.OldFilePath)
-
-		// Attempt to detect DELETE + CREATE -> MOVE
-		if cur.EventType == EventType_DELETE {
-			// find a CREATE event within 1s matching the path semantics
-			match := func(a, b PendingEvent) bool {
-				return b.EventType == EventType_CREATE &&
-					a.Size == b.Size &&
-					filepath.Base(a.FilePath) == filepath.Base(b.FilePath)
-			}
-			idx := findNextMatchingIndex(all, i, match, rangeInterval)
-			if idx != -1 {
-				next := all[idx]
-				err := st.ConvertDeleteToMoveAndSkipCreate(
-					cur.ID, next.ID, cur.FilePath, next.FilePath)
-				if err != nil {
-					plogger.Errorf("fix event DELETE[%v]+CREATE[%v] -> MOVE err[%v]",
-						cur.ID, next.ID, err)
-				} else {
-					plogger.Debugf("fix event DELETE[%v]+CREATE[%v] -> MOVE[%v]+SKIP[%v]",
-						cur.ID, next.ID, cur.ID, next.ID)
-					cur.EventType = EventType_MOVE
-					cur.OldFilePath = cur.FilePath
-					cur.FilePath = next.FilePath
-				}
-				// mark the create index as skipped so it's not processed later in-memory
-				skip[idx] = true
-				out = append(out, cur)
-				continue
-			}
-		}
-
-		// Attempt to detect RENAME followed by MODIFY to skip the MODIFY
-		if cur.EventType == EventType_RENAME {
-			match := func(a, b PendingEvent) bool {
-				return b.EventType == EventType_MODIFY &&
-					b.FilePath == a.FilePath
-			}
-			idx := findNextMatchingIndex(all, i, match, rangeInterval)
-			if idx != -1 {
-				next := all[idx]
-				// mark DB and mark in-memory to skip when loop reaches it
-				if err := st.MarkSkipped(next.ID); err != nil {
-					plogger.Errorf("fix event RENAME[%v]+MODIFY[%v] -> RENAME err[%v]",
-						cur.ID, next.ID, err)
-				} else {
-					plogger.Debugf("fix event RENAME[%v]+MODIFY[%v] -> RENAME[%v]+SKIP[%v]",
-						cur.ID, next.ID, cur.ID, next.ID)
-				}
-				skip[idx] = true
-				out = append(out, cur)
-				continue
-			}
-		}
-
-		// Attempt to detect MOVE followed by MODIFY to skip the MODIFY
-		if cur.EventType == EventType_CREATE {
-			match := func(a, b PendingEvent) bool {
-				return b.EventType == EventType_MODIFY &&
-					b.FilePath == a.FilePath
-			}
-			idx := findNextMatchingIndex(all, i, match, rangeInterval)
-			if idx != -1 {
-				next := all[idx]
-				// mark DB and mark in-memory to skip when loop reaches it
-				if err := st.MarkSkipped(next.ID); err != nil {
-					plogger.Errorf("fix event CREATE[%v]+MODIFY[%v] -> CREATE err[%v]",
-						cur.ID, next.ID, err)
-				} else {
-					plogger.Debugf("fix event CREATE[%v]+MODIFY[%v] -> CREATE[%v]+SKIP[%v]",
-						cur.ID, next.ID, cur.ID, next.ID)
-				}
-				skip[idx] = true
-				out = append(out, cur)
-				continue
-			}
-		}
-
-		// otherwise, normal event => process
-		out = append(out, cur)
-	}
-
-	return out, nil
+	return defaultCoalescer.GetAndFixedPendingEvents(st)
 }
 
-func findNextMatchingIndex(all []PendingEvent, start int, match func(a, b PendingEvent) bool, maxDelta time.Duration) int {
+// findNextMatchingIndex returns the first index after start, not in skip,
+// whose event matches within maxDelta, or -1.
+func findNextMatchingIndex(all []PendingEvent, start int, skip map[int]bool, match func(a, b PendingEvent) bool, maxDelta time.Duration) int {
 	base := all[start]
 	for j := start + 1; j < len(all); j++ {
+		if skip[j] {
+			continue
+		}
 		dt := all[j].EventTime.Sub(base.EventTime).Abs()
 		if dt > maxDelta {
 			// beyond search window
@@ -0,0 +1,281 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+// runRules implements "rules test <path>...": it prints which rule decides
+// each path and whether the producer would record or skip it.
+func (a *App) runRules(args []string) error {
+	if len(args) < 2 || args[0] != "test" {
+		return errors.New("usage: rules test <path>...")
+	}
+	filter := NewPathFilter(a.options.RulesFile, a.options.RuleRoots)
+	for _, path := range args[1:] {
+		m, err := filter.Explain(path, "")
+		if err != nil {
+			return fmt.Errorf("explain %s: %w", path, err)
+		}
+		verdict := "include"
+		if m.Excluded {
+			verdict = "exclude"
+		}
+		rule := "no rule matched"
+		if m.Rule != nil {
+			rule = fmt.Sprintf("%s %q", m.Rule.Source, ruleText(m.Rule))
+		}
+		fmt.Fprintf(a.stdout, "%s\t%s\troot=%q rel=%q\t%s\n", verdict, path, m.Root, m.Rel, rule)
+	}
+	return nil
+}
+
+func ruleText(r *PathRule) string {
+	if r.Include {
+		return "!" + r.Pattern
+	}
+	return r.Pattern
+}
+
+// runCmdFile implements the "cmdfile" admin subcommand:
+//
+//	cmdfile validate <file>
+//	cmdfile dry-run <file> --event-id N
+func (a *App) runCmdFile(args []string) error {
+	const usage = "usage: cmdfile validate <file> | cmdfile dry-run <file> --event-id N"
+	if len(args) < 2 {
+		return errors.New(usage)
+	}
+	switch args[0] {
+	case "validate":
+		return a.validateCmdFile(args[1])
+	case "dry-run":
+		fs := flag.NewFlagSet("cmdfile dry-run", flag.ContinueOnError)
+		fs.SetOutput(a.stdout)
+		eventID := fs.Int64("event-id", 0, "id of the stored event")
+		if err := fs.Parse(args[2:]); err != nil {
+			return err
+		}
+		if *eventID <= 0 || fs.NArg() > 0 {
+			return errors.New(usage)
+		}
+		return a.dryRunCmdFile(args[1], *eventID)
+	}
+	return errors.New(usage)
+}
+
+// validateCmdFile parses path, renders every command against a sample event
+// and checks that the programs they start can be found. Each command gets
+// one line; an error is returned when any of them has a problem.
+func (a *App) validateCmdFile(path string) error {
+	parsed, err := loadCmdFile(path, true)
+	if err != nil {
+		return err
+	}
+
+	type entry struct {
+		label string
+		spec  *CmdSpec
+		pe    PendingEvent
+	}
+	var entries []entry
+	add := func(label string, spec *CmdSpec, pe PendingEvent) {
+		if spec.Batch != nil {
+			pe = sampleBatch(spec, pe)
+		}
+		if len(spec.Steps) == 0 {
+			entries = append(entries, entry{label, spec, pe})
+			return
+		}
+		for i := range spec.Steps {
+			step := &spec.Steps[i]
+			stepLabel := label + "/" + step.label(i)
+			entries = append(entries, entry{stepLabel, spec.inherit(&step.CmdSpec), pe})
+			if step.Compensate != nil {
+				entries = append(entries, entry{stepLabel + "/compensate", spec.inherit(step.Compensate), pe})
+			}
+		}
+	}
+	for i := range parsed.rules {
+		r := &parsed.rules[i]
+		label := r.Name
+		if label == "" {
+			label = fmt.Sprintf("#%d", i+1)
+		}
+		t := EventType_CREATE
+		if len(r.Types) > 0 {
+			t = r.Types[0]
+		}
+		add(label, &r.CmdSpec, sampleEvent(t))
+	}
+	if parsed.def != nil {
+		add("default", parsed.def, sampleEvent(EventType_CREATE))
+	}
+
+	allow, err := NewAllowlist(nil, a.options.AllowedExecutables)
+	if err != nil {
+		return err
+	}
+	problems := 0
+	for _, e := range entries {
+		cmdLine, err := a.checkSpec(allow, e.spec, e.pe)
+		if err != nil {
+			problems++
+			fmt.Fprintf(a.stdout, "error\t%s\t%v\n", e.label, err)
+			continue
+		}
+		fmt.Fprintf(a.stdout, "ok\t%s\t%s\n", e.label, cmdLine)
+	}
+	if len(entries) == 0 {
+		fmt.Fprintf(a.stdout, "warn\t%s\tno commands defined\n", path)
+	}
+	if problems > 0 {
+		return fmt.Errorf("cmd file %s: %d of %d commands have problems", path, problems, len(entries))
+	}
+	return nil
+}
+
+// checkSpec renders spec for pe and checks its program, against allow too,
+// and working dir.
+func (a *App) checkSpec(allow *Allowlist, spec *CmdSpec, pe PendingEvent) (string, error) {
+	argv, cmdLine, _, err := renderCommand(a.options.ExecMode, spec, pe)
+	if err != nil {
+		return "", err
+	}
+	if _, err := renderEnv(spec, pe); err != nil {
+		return "", err
+	}
+	if len(argv) == 0 {
+		return "", errors.New("empty command")
+	}
+	if _, err := exec.LookPath(argv[0]); err != nil {
+		return "", fmt.Errorf("program %q: %w", argv[0], err)
+	}
+	if err := allow.CheckProgram(argv[0]); err != nil {
+		return "", err
+	}
+	if spec.Dir != "" {
+		if fi, err := os.Stat(spec.Dir); err != nil {
+			return "", fmt.Errorf("dir: %w", err)
+		} else if !fi.IsDir() {
+			return "", fmt.Errorf("dir %s is not a directory", spec.Dir)
+		}
+	}
+	return cmdLine, nil
+}
+
+// sampleEvent is the event commands are rendered against by validate.
+func sampleEvent(t EventType) PendingEvent {
+	dir := filepath.Join(os.TempDir(), "backupsentinel-sample")
+	ev := Event{
+		EventTime: time.Now(),
+		EventType: t,
+		DirPath:   dir,
+		FilePath:  filepath.Join(dir, "sub dir", "sample file.txt"),
+		Size:      1024,
+	}
+	if t == EventType_MOVE || t == EventType_RENAME {
+		ev.OldFilePath = filepath.Join(dir, "sub dir", "old name.txt")
+	}
+	return PendingEvent{ID: 1, Event: ev}
+}
+
+// dryRunCmdFile prints the command path would run for the stored event id,
+// without running it.
+func (a *App) dryRunCmdFile(path string, id int64) error {
+	parsed, err := loadAndParse(path)
+	if err != nil {
+		return err
+	}
+	dbPath := a.options.DBPath
+	if dbPath == "" {
+		dbPath = "./backupSentinel.db"
+	}
+	if _, err := os.Stat(dbPath); err != nil {
+		return fmt.Errorf("open db: %w", err)
+	}
+	st, err := OpenAndInit(dbPath)
+	if err != nil {
+		return fmt.Errorf("open db: %w", err)
+	}
+	defer st.Close()
+
+	pe, err := st.GetPendingEventByID(id)
+	if err != nil {
+		return fmt.Errorf("event %d: %w", id, err)
+	}
+	fmt.Fprintf(a.stdout, "event\t%d %s %s\n", pe.ID, pe.EventType, pe.FilePath)
+
+	spec := parsed.lookup(pe)
+	if spec == nil {
+		fmt.Fprintf(a.stdout, "rule\tnone, no command would run\n")
+		return nil
+	}
+	fmt.Fprintf(a.stdout, "rule\t%s\n", specLabel(spec, pe))
+	if b := spec.Batch; b != nil {
+		// the manifest would hold the events collected with this one
+		fmt.Fprintf(a.stdout, "batch\tmax_events=%d max_wait=%v format=%s\n", b.maxEvents(), b.maxWait(), b.format())
+		pe = sampleBatch(spec, pe)
+	}
+	if len(spec.Steps) == 0 {
+		return a.printCommand(spec, pe)
+	}
+
+	records, err := st.GetSteps(pe.ID)
+	if err != nil {
+		return err
+	}
+	for i := range spec.Steps {
+		step := &spec.Steps[i]
+		state := "pending"
+		for _, r := range records {
+			if r.Index == i && r.Name == step.label(i) {
+				state = r.Status
+			}
+		}
+		fmt.Fprintf(a.stdout, "step\t%d %s %s\n", i+1, step.label(i), state)
+		if err := a.printCommand(spec.inherit(&step.CmdSpec), pe); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// printCommand prints what spec would run for pe, one setting per line.
+func (a *App) printCommand(spec *CmdSpec, pe PendingEvent) error {
+	argv, cmdLine, direct, err := renderCommand(a.options.ExecMode, spec, pe)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(argv)
+	if err != nil {
+		return err
+	}
+	if !direct {
+		// split mode hands the whole line to putil.ExecSplit
+		fmt.Fprintf(a.stdout, "cmdline\t%s\n", cmdLine)
+	}
+	fmt.Fprintf(a.stdout, "argv\t%s\n", b)
+	if direct {
+		env, err := renderEnv(spec, pe)
+		if err != nil {
+			return err
+		}
+		for _, kv := range env {
+			fmt.Fprintf(a.stdout, "env\t%s\n", kv)
+		}
+		if spec.Dir != "" {
+			fmt.Fprintf(a.stdout, "dir\t%s\n", spec.Dir)
+		}
+		if spec.Timeout > 0 {
+			fmt.Fprintf(a.stdout, "timeout\t%v\n", time.Duration(spec.Timeout))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// 事件中的 cmd_file 来自生产者的参数，任何能触发生产者的人都能让消费者执行任意命令。
+// 配置白名单后，事件引用的命令文件必须位于允许的目录下，命令启动的程序（解析 PATH
+// 之后的绝对路径）必须在允许的列表中，否则事件直接进入死信。-f 指定的命令文件由
+// 运维人员提供，不受目录白名单限制，但其中的命令同样受程序白名单限制。
+
+// errNotAllowed marks commands and cmd files refused by the Allowlist.
+var errNotAllowed = errors.New("not allowed")
+
+// Allowlist restricts the cmd files events may reference and the programs
+// commands may start. A nil Allowlist, or an empty list, allows anything.
+type Allowlist struct {
+	cmdFileDirs []string
+	programs    map[string]bool
+}
+
+// NewAllowlist resolves the allowed cmd file directories and programs.
+// Programs may be given by name, resolved through PATH now. It returns nil
+// when both lists are empty.
+func NewAllowlist(cmdFileDirs, programs []string) (*Allowlist, error) {
+	if len(cmdFileDirs) == 0 && len(programs) == 0 {
+		return nil, nil
+	}
+	l := &Allowlist{programs: make(map[string]bool)}
+	for _, d := range cmdFileDirs {
+		abs, err := resolvePath(d)
+		if err != nil {
+			return nil, fmt.Errorf("allowed cmd file dir %s: %w", d, err)
+		}
+		l.cmdFileDirs = append(l.cmdFileDirs, abs)
+	}
+	for _, p := range programs {
+		abs, err := resolveProgram(p)
+		if err != nil {
+			return nil, fmt.Errorf("allowed executable %s: %w", p, err)
+		}
+		l.programs[pathKey(abs)] = true
+	}
+	return l, nil
+}
+
+// CheckCmdFile returns an error wrapping errNotAllowed unless path lies in
+// an allowed cmd file directory.
+func (l *Allowlist) CheckCmdFile(path string) error {
+	if l == nil || len(l.cmdFileDirs) == 0 {
+		return nil
+	}
+	abs, err := resolvePath(path)
+	if err != nil {
+		return fmt.Errorf("cmd file %s: %w: %v", path, errNotAllowed, err)
+	}
+	for _, d := range l.cmdFileDirs {
+		if within(d, abs) {
+			return nil
+		}
+	}
+	return fmt.Errorf("cmd file %s: %w: outside the allowed directories", path, errNotAllowed)
+}
+
+// restrictsPrograms reports whether CheckProgram refuses anything.
+func (l *Allowlist) restrictsPrograms() bool {
+	return l != nil && len(l.programs) > 0
+}
+
+// CheckProgram returns an error wrapping errNotAllowed unless name resolves
+// to an allowed program.
+func (l *Allowlist) CheckProgram(name string) error {
+	if l == nil || len(l.programs) == 0 {
+		return nil
+	}
+	abs, err := resolveProgram(name)
+	if err != nil {
+		return fmt.Errorf("program %s: %w: %v", name, errNotAllowed, err)
+	}
+	if !l.programs[pathKey(abs)] {
+		return fmt.Errorf("program %s: %w", abs, errNotAllowed)
+	}
+	return nil
+}
+
+// resolvePath returns the absolute path of p with symlinks resolved when p
+// exists.
+func resolvePath(p string) (string, error) {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return "", err
+	}
+	if real, err := filepath.EvalSymlinks(abs); err == nil {
+		return real, nil
+	}
+	return abs, nil
+}
+
+func resolveProgram(name string) (string, error) {
+	p, err := exec.LookPath(name)
+	if err != nil {
+		return "", err
+	}
+	return resolvePath(p)
+}
+
+// within reports whether p is dir or below it; both must be absolute.
+func within(dir, p string) bool {
+	rel, err := filepath.Rel(pathKey(dir), pathKey(p))
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel)
+}
+
+// pathKey normalises case on Windows, where paths are case-insensitive.
+func pathKey(p string) string {
+	p = filepath.Clean(p)
+	if runtime.GOOS == "windows" {
+		return strings.ToLower(p)
+	}
+	return p
+}
@@ -0,0 +1,100 @@
+package app
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAllowlist(t *testing.T) {
+	if l, err := NewAllowlist(nil, nil); err != nil || l != nil {
+		t.Fatalf("expected nil allowlist, got %v err %v", l, err)
+	}
+	var nilList *Allowlist
+	if err := nilList.CheckCmdFile("/anywhere/cmds.json"); err != nil {
+		t.Errorf("nil allowlist should allow cmd files: %v", err)
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		t.Skip(err)
+	}
+	dir := t.TempDir()
+	l, err := NewAllowlist([]string{dir}, []string{exe})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.CheckCmdFile(filepath.Join(dir, "sub", "cmds.yaml")); err != nil {
+		t.Errorf("expected cmd file below allowed dir, got %v", err)
+	}
+	for _, p := range []string{filepath.Join(dir+"x", "cmds.yaml"), filepath.Join(dir, "..", "cmds.yaml")} {
+		if err := l.CheckCmdFile(p); !errors.Is(err, errNotAllowed) {
+			t.Errorf("%s: expected errNotAllowed, got %v", p, err)
+		}
+	}
+	if err := l.CheckProgram(exe); err != nil {
+		t.Errorf("expected %s allowed, got %v", exe, err)
+	}
+	if err := l.CheckProgram("no-such-program-bs"); !errors.Is(err, errNotAllowed) {
+		t.Errorf("expected missing program refused, got %v", err)
+	}
+	if _, err := NewAllowlist(nil, []string{"no-such-program-bs"}); err == nil {
+		t.Error("expected unknown allowed executable to be rejected")
+	}
+}
+
+func TestConsumerRefusesDisallowed(t *testing.T) {
+	st := openTestStorage(t, "./test_allowlist.db")
+	exe, err := os.Executable()
+	if err != nil {
+		t.Skip(err)
+	}
+	allowedDir, otherDir := t.TempDir(), t.TempDir()
+	evil := filepath.Join(otherDir, "cmds.json")
+	if err := os.WriteFile(evil, []byte(`{"default": {"command": "true"}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	base := time.Now().Add(-time.Minute)
+	ids := insertAt(t, st, base,
+		Event{EventType: EventType_CREATE, FilePath: `d\a.txt`, CmdFile: evil},
+		Event{EventType: EventType_CREATE, FilePath: `d\b.txt`},
+	)
+
+	a := New(Options{Mode: ModeConsumer})
+	if a.allow, err = NewAllowlist([]string{allowedDir}, []string{exe}); err != nil {
+		t.Fatal(err)
+	}
+	// a cmd file outside the allowed dirs
+	if err := a.processPendingEvent(st, *pendingOf(t, st, ids[0]), NewCmdFileManager(0)); err != nil {
+		t.Fatalf("process: %v", err)
+	}
+	// a program not on the list
+	a.options.Cmd = "no-such-program-bs %file_path%"
+	if err := a.processPendingEvent(st, *pendingOf(t, st, ids[1]), NewCmdFileManager(0)); err != nil {
+		t.Fatalf("process: %v", err)
+	}
+	for _, id := range ids {
+		if got := processedOf(t, st, id); got != 3 {
+			t.Errorf("event %d: expected dead letter, got processed %d", id, got)
+		}
+	}
+}
+
+func TestAllowlistRunsCheckedArgv(t *testing.T) {
+	l, err := NewAllowlist(nil, []string{"printf"})
+	if err != nil {
+		t.Skip(err)
+	}
+	// the quoted program name is what was checked, so it must be what runs
+	spec := &CmdSpec{Command: `"printf" [%%s] %file_path|quote%`}
+	pe := PendingEvent{Event: Event{EventType: EventType_CREATE, FilePath: "/data/my file.txt"}}
+	_, out, stderr, err := execCommand(execEnv{mode: ExecModeSplit, allow: l}, spec, pe)
+	if err != nil {
+		t.Fatalf("exec: %v %s", err, stderr)
+	}
+	if out != "[/data/my file.txt]" {
+		t.Errorf("unexpected allowlisted split argv %q", out)
+	}
+}
@@ -0,0 +1,364 @@
+package app
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pancake-lee/pgo/pkg/plogger"
+)
+
+// 批量命令：规则设置 batch 后，命中的同类型事件先收集起来（processed = 5，同一路径后续的
+// 事件等待），达到 max_events 个或最早的事件等待了 max_wait 后，把事件写入临时清单文件，
+// 只执行一次命令。清单路径通过 %manifest% 占位符（以及 BS_MANIFEST）传给命令，清单内容
+// 同时写到 stdin。
+// stdout 中带 id、file_path 或 rel_path 的 JSON 行是单个事件的结果，例如
+// {"id": 12, "status": "failed", "message": "denied"}，没有单独结果的事件使用命令整体的
+// 结果（退出码和其余输出，见 interpretResult），所以可以部分成功。
+
+// errBatched reports that an event was collected into a batch; it runs
+// later, so events behind it on the same path wait.
+var errBatched = errors.New("collected into batch")
+
+// ManifestFormat is the content of a batch manifest.
+type ManifestFormat string
+
+const (
+	// ManifestLines has one path per line, as rsync --files-from and rclone
+	// --files-from expect.
+	ManifestLines ManifestFormat = "lines"
+	// ManifestJSON is a JSON array of event documents, as written to the
+	// stdin of argv commands.
+	ManifestJSON ManifestFormat = "json"
+)
+
+const (
+	defaultBatchMaxEvents = 100
+	defaultBatchMaxWait   = 10 * time.Second
+)
+
+// BatchConfig makes a cmd rule run once for many events of the same type.
+type BatchConfig struct {
+	// MaxEvents runs the batch once it holds this many events; 0 means
+	// defaultBatchMaxEvents.
+	MaxEvents int `json:"max_events" yaml:"max_events" toml:"max_events"`
+	// MaxWait runs the batch once its first event waited this long; 0 means
+	// defaultBatchMaxWait. It is checked every consumer cycle.
+	MaxWait Duration `json:"max_wait" yaml:"max_wait" toml:"max_wait"`
+	// Format defaults to ManifestLines.
+	Format ManifestFormat `json:"format" yaml:"format" toml:"format"`
+	// Field is the path written per line in ManifestLines: file_path
+	// (default) or rel_path.
+	Field string `json:"field" yaml:"field" toml:"field"`
+}
+
+func (b *BatchConfig) validate() error {
+	switch b.Format {
+	case "", ManifestLines, ManifestJSON:
+	default:
+		return fmt.Errorf("batch: unknown format %q", b.Format)
+	}
+	switch b.Field {
+	case "", "file_path", "rel_path":
+	default:
+		return fmt.Errorf("batch: unknown field %q", b.Field)
+	}
+	if b.MaxEvents < 0 || b.MaxWait < 0 {
+		return fmt.Errorf("batch: negative max_events or max_wait")
+	}
+	return nil
+}
+
+func (b *BatchConfig) maxEvents() int {
+	if b.MaxEvents > 0 {
+		return b.MaxEvents
+	}
+	return defaultBatchMaxEvents
+}
+
+func (b *BatchConfig) maxWait() time.Duration {
+	if b.MaxWait > 0 {
+		return time.Duration(b.MaxWait)
+	}
+	return defaultBatchMaxWait
+}
+
+// batchInfo is what the manifest and count placeholders render.
+type batchInfo struct {
+	manifest string
+	count    int
+	data     []byte
+}
+
+type batchKey struct {
+	spec *CmdSpec
+	t    EventType
+}
+
+type batchItem struct {
+	pe   PendingEvent
+	hash string
+}
+
+// pendingBatch is a batch being collected.
+type pendingBatch struct {
+	spec    *CmdSpec
+	label   string
+	items   []batchItem
+	started time.Time
+}
+
+// addToBatch collects pe into the batch of spec and runs the batch once it
+// is full. It returns errBatched.
+func (a *App) addToBatch(st *Storage, spec *CmdSpec, label string, pe PendingEvent, hash string) error {
+	if err := st.SetBatched(pe.ID); err != nil {
+		return err
+	}
+	if a.batches == nil {
+		a.batches = make(map[batchKey]*pendingBatch)
+	}
+	key := batchKey{spec: spec, t: pe.EventType}
+	b := a.batches[key]
+	if b == nil {
+		b = &pendingBatch{spec: spec, label: label, started: time.Now()}
+		a.batches[key] = b
+	}
+	b.items = append(b.items, batchItem{pe: pe, hash: hash})
+	plogger.Debugf("batch[%s] collected id=%d (%d/%d)", label, pe.ID, len(b.items), spec.Batch.maxEvents())
+	if len(b.items) >= spec.Batch.maxEvents() {
+		delete(a.batches, key)
+		a.runBatch(st, b)
+	}
+	return errBatched
+}
+
+// flushBatches runs the batches whose first event waited long enough, or
+// all of them with force.
+func (a *App) flushBatches(st *Storage, force bool) {
+	for key, b := range a.batches {
+		if force || time.Since(b.started) >= b.spec.Batch.maxWait() {
+			delete(a.batches, key)
+			a.runBatch(st, b)
+		}
+	}
+}
+
+// nextBatchDue returns when the oldest batch is due; ok is false without
+// batches.
+func (a *App) nextBatchDue() (due time.Time, ok bool) {
+	for _, b := range a.batches {
+		d := b.started.Add(b.spec.Batch.maxWait())
+		if !ok || d.Before(due) {
+			due, ok = d, true
+		}
+	}
+	return due, ok
+}
+
+// runBatch writes the manifest, runs the command once and applies the
+// per-event or overall result to every event of b.
+func (a *App) runBatch(st *Storage, b *pendingBatch) {
+	lines, overall := a.execBatch(b)
+
+	ids := make([]int64, len(b.items))
+	for i, it := range b.items {
+		ids[i] = it.pe.ID
+	}
+	// pending again, so results and retries apply as for single events
+	if _, err := st.ReleaseBatched(ids); err != nil {
+		plogger.Errorf("release batch %v: %v", ids, err)
+		return
+	}
+	counts := make(map[CmdStatus]int)
+	for _, it := range b.items {
+		res := overall
+		if r, ok := lines.find(it.pe); ok {
+			res = r
+		}
+		counts[res.Status]++
+		if err := a.applyResult(st, it.pe, res, b.spec.Retry, it.hash); err != nil {
+			plogger.Debugf("batch[%s] id=%d: %v", b.label, it.pe.ID, err)
+		}
+	}
+	plogger.Infof("batch[%s] ran for %d events: %v", b.label, len(b.items), counts)
+}
+
+// execBatch runs the command of b and returns the per-event result lines
+// and the overall result. A manifest that cannot be written is retried.
+func (a *App) execBatch(b *pendingBatch) (batchResults, CmdResult) {
+	data, err := b.manifest()
+	if err != nil {
+		return nil, CmdResult{Status: StatusRetry, Message: "manifest: " + err.Error()}
+	}
+	path, err := writeManifest(data)
+	if err != nil {
+		return nil, CmdResult{Status: StatusRetry, Message: "manifest: " + err.Error()}
+	}
+	defer os.Remove(path)
+
+	pe := b.items[0].pe
+	pe.batch = &batchInfo{manifest: path, count: len(b.items), data: data}
+	x := execEnv{mode: a.options.ExecMode, allow: a.allow, sandbox: a.options.Sandbox}
+	cmdStr, stdout, stderr, err := execCommand(x, b.spec, pe)
+	plogger.Debugf("exec batch[%v][%s] events[%d] err[%v] out[\n-----\n%v%v\n-----]",
+		b.label, cmdStr, len(b.items), err, stdout, stderr)
+	if errors.Is(err, errNotAllowed) {
+		return nil, CmdResult{Status: StatusFailed, Message: err.Error()}
+	}
+	lines, rest := splitBatchOutput(stdout)
+	return lines, interpretResult(err, rest, a.options.exitCodes())
+}
+
+// writeManifest writes data to a new temporary file and returns its path.
+func writeManifest(data []byte) (string, error) {
+	f, err := os.CreateTemp("", "backupsentinel-manifest-*")
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// manifest renders the manifest of b.
+func (b *pendingBatch) manifest() ([]byte, error) {
+	if b.spec.Batch.format() == ManifestJSON {
+		docs := make([]eventDocument, len(b.items))
+		for i, it := range b.items {
+			docs[i] = newEventDocument(it.pe)
+		}
+		return json.Marshal(docs)
+	}
+	var sb strings.Builder
+	for _, it := range b.items {
+		p := it.pe.FilePath
+		if b.spec.Batch.Field == "rel_path" {
+			p = relPath(p, it.pe.DirPath)
+		}
+		sb.WriteString(p)
+		sb.WriteByte('\n')
+	}
+	return []byte(sb.String()), nil
+}
+
+// batchLineResult is a per-event result line of a batch command.
+type batchLineResult struct {
+	ID       int64  `json:"id"`
+	FilePath string `json:"file_path"`
+	RelPath  string `json:"rel_path"`
+	CmdResult
+}
+
+type batchResults []batchLineResult
+
+// splitBatchOutput separates the per-event result lines of stdout from the
+// rest, which carries the overall result.
+func splitBatchOutput(stdout string) (batchResults, string) {
+	var (
+		lines batchResults
+		rest  strings.Builder
+	)
+	sc := bufio.NewScanner(strings.NewReader(stdout))
+	sc.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for sc.Scan() {
+		line := sc.Text()
+		if t := strings.TrimSpace(line); strings.HasPrefix(t, "{") {
+			var r batchLineResult
+			if json.Unmarshal([]byte(t), &r) == nil && r.Status.valid() &&
+				(r.ID != 0 || r.FilePath != "" || r.RelPath != "") {
+				lines = append(lines, r)
+				continue
+			}
+		}
+		rest.WriteString(line)
+		rest.WriteByte('\n')
+	}
+	return lines, rest.String()
+}
+
+// find returns the last result line naming pe.
+func (rs batchResults) find(pe PendingEvent) (CmdResult, bool) {
+	for i := len(rs) - 1; i >= 0; i-- {
+		r := rs[i]
+		if (r.ID != 0 && r.ID == pe.ID) ||
+			(r.FilePath != "" && r.FilePath == pe.FilePath) ||
+			(r.RelPath != "" && r.RelPath == relPath(pe.FilePath, pe.DirPath)) {
+			return r.CmdResult, true
+		}
+	}
+	return CmdResult{}, false
+}
+
+func (b *BatchConfig) format() ManifestFormat {
+	if b.Format != "" {
+		return b.Format
+	}
+	return ManifestLines
+}
+
+// batchPlaceholders are the only placeholders of batch commands; the
+// events themselves are in the manifest.
+var batchPlaceholders = map[string]bool{"manifest": true, "count": true}
+
+// validateBatch checks the batch settings of s and that batch commands use
+// only batchPlaceholders and other commands none of them. Commands run
+// through putil.ExecSplit get no stdin, so they must take %manifest%.
+func (s *CmdSpec) validateBatch() error {
+	templates := append([]string{s.Command}, s.Argv...)
+	for _, v := range s.Env {
+		templates = append(templates, v)
+	}
+	manifest := false
+	for _, raw := range templates {
+		t, err := ParseCmdTemplate(raw)
+		if err != nil {
+			return err
+		}
+		for _, p := range t.parts {
+			if p.name == "" {
+				continue
+			}
+			if s.Batch == nil && batchPlaceholders[p.name] {
+				return fmt.Errorf("%%%s%% needs batch", p.name)
+			}
+			if s.Batch != nil && !batchPlaceholders[p.name] {
+				return fmt.Errorf("batch: %%%s%% is per event, the events are in %%manifest%%", p.name)
+			}
+		}
+		manifest = manifest || t.uses("manifest")
+	}
+	if s.Batch == nil {
+		return nil
+	}
+	if len(s.Steps) > 0 {
+		return fmt.Errorf("batch cannot be combined with steps")
+	}
+	if !manifest && !s.direct() {
+		return fmt.Errorf("batch: command needs %%manifest%% unless it is run directly (argv, timeout, env or dir)")
+	}
+	return s.Batch.validate()
+}
+
+// sampleBatch returns pe as the only event of a batch of spec, with a
+// placeholder manifest path, for validate and dry-run.
+func sampleBatch(spec *CmdSpec, pe PendingEvent) PendingEvent {
+	b := &pendingBatch{spec: spec, items: []batchItem{{pe: pe}}}
+	data, _ := b.manifest()
+	pe.batch = &batchInfo{
+		manifest: filepath.Join(os.TempDir(), "backupsentinel-manifest-sample"),
+		count:    1,
+		data:     data,
+	}
+	return pe
+}
@@ -0,0 +1,153 @@
+package app
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBatchRunsOnceWithPerLineResults(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no sh")
+	}
+	st := openTestStorage(t, "./test_batch.db")
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "log")
+	stdinPath := filepath.Join(dir, "stdin")
+	p := writeCmdFile(t, "cmds.yaml", `
+rules:
+  - name: sync
+    types: [MODIFY]
+    env: {LOG: "`+logPath+`"}
+    argv:
+      - sh
+      - -c
+      - |
+        while read -r p; do
+          case "$p" in *bad*) echo "{\"file_path\": \"$p\", \"status\": \"failed\", \"message\": \"denied\"}";; esac
+        done < "$1"
+        echo "$BS_COUNT" >> "$LOG"
+      - sh
+      - '%manifest%'
+    batch: {max_events: 10, max_wait: 1h}
+  - name: index
+    types: [CREATE]
+    argv: [sh, -c, 'cat > "`+stdinPath+`"']
+    batch: {max_events: 2, format: json}
+`)
+	a := New(Options{Mode: ModeConsumer, CmdFile: p, CatchUp: true})
+	c, err := NewCoalescer(CoalesceConfig{})
+	if err != nil {
+		t.Fatalf("NewCoalescer: %v", err)
+	}
+	mgr := NewCmdFileManager(time.Hour)
+
+	base := time.Now().Add(-time.Minute)
+	ids := insertAt(t, st, base,
+		Event{EventType: EventType_MODIFY, FilePath: "d/a.txt"},
+		Event{EventType: EventType_MODIFY, FilePath: "d/bad.txt"},
+		Event{EventType: EventType_MODIFY, FilePath: "d/c.txt"},
+	)
+	// a later change of a.txt, in a window of its own
+	ids = append(ids, insertAt(t, st, base.Add(30*time.Second),
+		Event{EventType: EventType_MODIFY, FilePath: "d/a.txt"},
+		Event{EventType: EventType_CREATE, FilePath: "d/n1.txt"},
+		Event{EventType: EventType_CREATE, FilePath: "d/n2.txt"},
+	)...)
+	a.runCycle(st, c, mgr)
+	for i, w := range []int{processedBatched, processedBatched, processedBatched, 0, 1, 1} {
+		if got := processedOf(t, st, ids[i]); got != w {
+			t.Errorf("event %d: expected processed %d, got %d", i, w, got)
+		}
+	}
+	if more, err := st.HasPendingEvents(0); err != nil || more {
+		t.Errorf("expected the later a.txt event to wait behind the batch, got %v err %v", more, err)
+	}
+	var docs []eventDocument
+	if b, err := os.ReadFile(stdinPath); err != nil || json.Unmarshal(b, &docs) != nil || len(docs) != 2 {
+		t.Errorf("expected a JSON manifest of two events on stdin, got %s err %v", b, err)
+	}
+
+	// max_wait expired: the batch runs once, bad.txt fails alone
+	for _, b := range a.batches {
+		b.started = time.Now().Add(-2 * time.Hour)
+	}
+	a.flushBatches(st, false)
+	for i, w := range []int{1, 3, 1, 0} {
+		if got := processedOf(t, st, ids[i]); got != w {
+			t.Errorf("event %d: expected processed %d, got %d", i, w, got)
+		}
+	}
+	var msg string
+	if err := st.db.QueryRow("SELECT result_message FROM file_events WHERE id = ?", ids[1]).Scan(&msg); err != nil || msg != "denied" {
+		t.Errorf("expected the message of the bad.txt line, got %q err %v", msg, err)
+	}
+	if b, _ := os.ReadFile(logPath); strings.TrimSpace(string(b)) != "3" {
+		t.Errorf("expected one run for three events, log %q", b)
+	}
+
+	// the event that waited is collected next
+	a.runCycle(st, c, mgr)
+	if got := processedOf(t, st, ids[3]); got != processedBatched {
+		t.Errorf("expected the later event batched, got processed %d", got)
+	}
+	if n, err := st.ReleaseBatched(nil); err != nil || n != 1 {
+		t.Errorf("expected one batched event released, got %d err %v", n, err)
+	}
+}
+
+func TestBatchValidation(t *testing.T) {
+	bad := map[string]string{
+		"steps.yaml":    "default:\n  steps:\n    - command: y\n  batch: {}\n",
+		"step.yaml":     "default:\n  steps:\n    - command: y\n      batch: {}\n",
+		"format.yaml":   "default:\n  command: y %manifest%\n  batch: {format: csv}\n",
+		"field.yaml":    "default:\n  command: y\n  batch: {field: name}\n",
+		"negative.yaml": "default:\n  command: y\n  batch: {max_events: -1}\n",
+		"nobatch.yaml":  "default:\n  command: y %manifest%\n",
+		"count.json":    `{"default": {"command": "y", "env": {"N": "%count%"}}}`,
+		"split.yaml":    "default:\n  command: rsync --files-from=- src dst\n  batch: {}\n",
+		"perevent.yaml": "default:\n  command: up %manifest% %rel_path%\n  batch: {}\n",
+		"env.yaml":      "default:\n  argv: [up]\n  env: {F: \"%file_path%\"}\n  batch: {}\n",
+	}
+	for name, content := range bad {
+		if _, err := loadAndParse(writeCmdFile(t, name, content)); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+	parsed, err := loadAndParse(writeCmdFile(t, "good.toml",
+		"[default]\ncommand = \"rsync --files-from=%manifest% src dst\"\n[default.batch]\nmax_wait = \"30s\"\nfield = \"rel_path\"\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := parsed.def.Batch
+	// direct commands read the manifest from stdin
+	if _, err := loadAndParse(writeCmdFile(t, "stdin.yaml", "default:\n  argv: [up, --files-from=-]\n  batch: {}\n")); err != nil {
+		t.Errorf("expected a direct batch command without %%manifest%%, got %v", err)
+	}
+	if b.maxEvents() != defaultBatchMaxEvents || b.maxWait() != 30*time.Second || b.format() != ManifestLines {
+		t.Errorf("unexpected batch settings %+v", b)
+	}
+}
+
+func TestSplitBatchOutput(t *testing.T) {
+	out := "copied 2\n{\"id\": 7, \"status\": \"retry\", \"message\": \"busy\"}\n{\"rel_path\": \"x/y\", \"status\": \"skip\"}\n{\"status\": \"success\"}\n"
+	lines, rest := splitBatchOutput(out)
+	if len(lines) != 2 || rest != "copied 2\n{\"status\": \"success\"}\n" {
+		t.Fatalf("unexpected split %+v rest %q", lines, rest)
+	}
+	r, ok := lines.find(PendingEvent{ID: 7})
+	if !ok || r.Status != StatusRetry || r.Message != "busy" {
+		t.Errorf("expected id 7 to retry, got %+v %v", r, ok)
+	}
+	r, ok = lines.find(PendingEvent{ID: 8, Event: Event{DirPath: "/r", FilePath: "/r/x/y"}})
+	if !ok || r.Status != StatusSkip {
+		t.Errorf("expected rel_path x/y to skip, got %+v %v", r, ok)
+	}
+	if _, ok := lines.find(PendingEvent{ID: 9}); ok {
+		t.Errorf("expected no result for id 9")
+	}
+}
@@ -0,0 +1,52 @@
+package app
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRunCycleCatchUp(t *testing.T) {
+	st := openTestStorage(t, "./test_catch_up.db")
+	// ten events 10s apart: ten separate windows
+	base := time.Now().Add(-10 * time.Minute)
+	var ids []int64
+	for i := 0; i < 10; i++ {
+		ids = append(ids, insertAt(t, st, base.Add(time.Duration(i)*10*time.Second),
+			Event{EventType: EventType_MODIFY, FilePath: fmt.Sprintf(`a\%d.txt`, i)})...)
+	}
+	c, err := NewCoalescer(CoalesceConfig{})
+	if err != nil {
+		t.Fatalf("NewCoalescer: %v", err)
+	}
+	countDone := func() int {
+		n := 0
+		for _, id := range ids {
+			if processedOf(t, st, id) == 1 {
+				n++
+			}
+		}
+		return n
+	}
+
+	a := New(Options{Mode: ModeConsumer, Cmd: "true"})
+	a.runCycle(st, c, NewCmdFileManager(0))
+	if n := countDone(); n != 1 {
+		t.Fatalf("expected one window without catch-up, got %d processed", n)
+	}
+
+	a = New(Options{Mode: ModeConsumer, Cmd: "true", CatchUp: true, CatchUpMaxEvents: 4})
+	a.runCycle(st, c, NewCmdFileManager(0))
+	if n := countDone(); n != 5 {
+		t.Fatalf("expected cap of 4 more events, got %d processed", n)
+	}
+
+	a.runCycle(st, c, NewCmdFileManager(0))
+	a.runCycle(st, c, NewCmdFileManager(0))
+	if n := countDone(); n != 10 {
+		t.Fatalf("expected backlog drained, got %d processed", n)
+	}
+	if more, err := st.HasPendingEvents(0); err != nil || more {
+		t.Errorf("expected empty queue, got %v err %v", more, err)
+	}
+}
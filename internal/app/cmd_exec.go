@@ -0,0 +1,280 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pancake-lee/pgo/pkg/putil"
+)
+
+// ExecMode selects how the consumer runs commands.
+type ExecMode string
+
+const (
+	// ExecModeSplit renders the template into one string and lets
+	// putil.ExecSplit split it into arguments.
+	ExecModeSplit ExecMode = "split"
+	// ExecModeArgv splits the template into arguments first and renders each
+	// one separately, so values never change the argument boundaries. The
+	// event is also passed as BS_* environment variables and as JSON on stdin.
+	ExecModeArgv ExecMode = "argv"
+)
+
+func (m ExecMode) validate() error {
+	switch m {
+	case "", ExecModeSplit, ExecModeArgv:
+		return nil
+	}
+	return fmt.Errorf("unknown exec mode %q", m)
+}
+
+// eventDocument is the JSON written to the command's stdin in argv mode.
+type eventDocument struct {
+	ID           int64     `json:"id"`
+	EventType    EventType `json:"event_type"`
+	RawEventType string    `json:"raw_event_type"`
+	EventTime    time.Time `json:"event_time"`
+	DirPath      string    `json:"dir_path"`
+	FilePath     string    `json:"file_path"`
+	OldFilePath  string    `json:"old_file_path"`
+	RelPath      string    `json:"rel_path"`
+	OldRelPath   string    `json:"old_rel_path"`
+	CmdFile      string    `json:"cmd_file"`
+	Size         int64     `json:"size"`
+	IsDir        bool      `json:"is_dir"`
+	Priority     int       `json:"priority"`
+	Attempt      int       `json:"attempt"`
+}
+
+func newEventDocument(pe PendingEvent) eventDocument {
+	return eventDocument{
+		ID:           pe.ID,
+		EventType:    pe.EventType,
+		RawEventType: pe.RawEventType,
+		EventTime:    pe.EventTime,
+		DirPath:      pe.DirPath,
+		FilePath:     pe.FilePath,
+		OldFilePath:  pe.OldFilePath,
+		RelPath:      relPath(pe.FilePath, pe.DirPath),
+		OldRelPath:   relPath(pe.OldFilePath, pe.DirPath),
+		CmdFile:      pe.CmdFile,
+		Size:         pe.Size,
+		IsDir:        pe.IsDir,
+		Priority:     pe.Priority,
+		Attempt:      pe.Attempts + 1,
+	}
+}
+
+// eventEnv returns the BS_* variables of pe, one per template placeholder.
+// Batch commands only get the batch ones.
+func eventEnv(pe PendingEvent) []string {
+	var env []string
+	for name, value := range cmdPlaceholders {
+		if name == "fullfile" || name == "oldfullfile" {
+			continue
+		}
+		if (pe.batch != nil) != batchPlaceholders[name] {
+			continue
+		}
+		env = append(env, "BS_"+strings.ToUpper(name)+"="+value(pe))
+	}
+	return append(env, "BS_CMD_FILE="+pe.CmdFile)
+}
+
+// execEnv is how execCommand runs commands.
+type execEnv struct {
+	mode ExecMode
+	// allow refuses programs not allowlisted; nil allows all.
+	allow *Allowlist
+	// sandbox confines direct commands; nil or empty runs them as is.
+	sandbox *SandboxConfig
+}
+
+// execCommand runs spec for pe and returns the command line (for logging),
+// stdout and stderr. Specs with argv, timeout, env or dir, every spec in
+// argv mode and every spec when sandboxed or when x.allow restricts
+// programs are run directly; the rest go
+// through putil.ExecSplit, in which case stdout holds its output. Programs
+// refused by x.allow return an error wrapping errNotAllowed.
+func execCommand(x execEnv, spec *CmdSpec, pe PendingEvent) (cmdLine, stdout, stderr string, err error) {
+	argv, cmdLine, direct, err := renderCommand(x.mode, spec, pe)
+	if err != nil {
+		return cmdLine, "", "", err
+	}
+	if len(argv) == 0 {
+		return cmdLine, "", "", errors.New("empty command")
+	}
+	if err := x.allow.CheckProgram(argv[0]); err != nil {
+		return cmdLine, "", "", err
+	}
+	// ExecSplit splits the line its own way, so with a program allowlist
+	// the checked argv is what runs
+	if !direct && !x.sandbox.enabled() && !x.allow.restrictsPrograms() {
+		stdout, err = putil.ExecSplit(cmdLine)
+		return cmdLine, stdout, "", err
+	}
+
+	specEnv, err := renderEnv(spec, pe)
+	if err != nil {
+		return cmdLine, "", "", err
+	}
+	env := append(os.Environ(), eventEnv(pe)...)
+	env = append(env, specEnv...)
+
+	// a batch command reads the manifest instead of one event
+	var doc []byte
+	if pe.batch != nil {
+		doc = pe.batch.data
+	} else if doc, err = json.Marshal(newEventDocument(pe)); err != nil {
+		return cmdLine, "", "", fmt.Errorf("marshal event: %w", err)
+	}
+
+	ctx := context.Background()
+	if spec.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(spec.Timeout))
+		defer cancel()
+	}
+	var cmd *exec.Cmd
+	dir := spec.Dir
+	if x.sandbox.enabled() {
+		if dir, err = x.sandbox.workDir(dir); err != nil {
+			return cmdLine, "", "", err
+		}
+		if cmd, err = x.sandbox.command(ctx, argv); err != nil {
+			return cmdLine, "", "", err
+		}
+	} else {
+		cmd = exec.CommandContext(ctx, argv[0], argv[1:]...)
+	}
+	var outBuf, errBuf bytes.Buffer
+	cmd.Env = env
+	cmd.Dir = dir
+	cmd.Stdin = bytes.NewReader(doc)
+	cmd.Stdout = &outBuf
+	cmd.Stderr = &errBuf
+	err = cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("timed out after %v: %w", time.Duration(spec.Timeout), err)
+	}
+	return cmdLine, outBuf.String(), errBuf.String(), err
+}
+
+// renderCommand renders spec for pe. direct reports whether the command is
+// run as argv; otherwise cmdLine is handed to putil.ExecSplit and argv is
+// its splitArgs split, used to check and sandbox the program.
+func renderCommand(mode ExecMode, spec *CmdSpec, pe PendingEvent) (argv []string, cmdLine string, direct bool, err error) {
+	if len(spec.Argv) > 0 {
+		for _, a := range spec.Argv {
+			t, err := ParseCmdTemplate(a)
+			if err != nil {
+				return nil, a, true, err
+			}
+			t.legacy = false
+			argv = append(argv, t.Render(pe))
+		}
+	} else {
+		tmpl, err := ParseCmdTemplate(spec.Command)
+		if err != nil {
+			return nil, spec.Command, false, err
+		}
+		if pe.batch != nil {
+			// the paths are in the manifest
+			tmpl.legacy = false
+		}
+		if mode != ExecModeArgv && !spec.direct() {
+			cmdLine = tmpl.Render(pe)
+			// quoted values stay one argument when sandboxed
+			if argv, err = splitArgs(cmdLine); err != nil {
+				return nil, cmdLine, false, err
+			}
+			return argv, cmdLine, false, nil
+		}
+		if argv, err = tmpl.Argv(pe); err != nil {
+			return nil, spec.Command, true, err
+		}
+	}
+	if len(argv) == 0 {
+		return nil, "", true, errors.New("empty command")
+	}
+
+	quoted := make([]string, len(argv))
+	for i, a := range argv {
+		quoted[i] = windowsArgQuote(a)
+	}
+	return argv, strings.Join(quoted, " "), true, nil
+}
+
+// renderEnv returns the spec's extra environment as KEY=value, sorted.
+func renderEnv(spec *CmdSpec, pe PendingEvent) ([]string, error) {
+	var env []string
+	for k, v := range spec.Env {
+		t, err := ParseCmdTemplate(v)
+		if err != nil {
+			return nil, fmt.Errorf("env %s: %w", k, err)
+		}
+		t.legacy = false
+		env = append(env, k+"="+t.Render(pe))
+	}
+	sort.Strings(env)
+	return env, nil
+}
+
+// splitArgs splits a command template into arguments. Double quotes group
+// words and accept \" and \\ escapes, single quotes group words literally;
+// backslashes elsewhere are kept so Windows paths need no escaping.
+func splitArgs(s string) ([]string, error) {
+	var (
+		args    []string
+		cur     strings.Builder
+		inWord  bool
+		quote   byte
+		quoteAt int
+	)
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			} else {
+				cur.WriteByte(c)
+			}
+		case quote == '"':
+			if c == '"' {
+				quote = 0
+			} else if c == '\\' && i+1 < len(s) && (s[i+1] == '"' || s[i+1] == '\\') {
+				i++
+				cur.WriteByte(s[i])
+			} else {
+				cur.WriteByte(c)
+			}
+		case c == '"' || c == '\'':
+			quote, quoteAt, inWord = c, i, true
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			if inWord {
+				args = append(args, cur.String())
+				cur.Reset()
+				inWord = false
+			}
+		default:
+			cur.WriteByte(c)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("command %q: unterminated %c quote at offset %d", s, quote, quoteAt)
+	}
+	if inWord {
+		args = append(args, cur.String())
+	}
+	return args, nil
+}
@@ -0,0 +1,57 @@
+package app
+
+import (
+	"encoding/json"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestSplitArgs(t *testing.T) {
+	cases := map[string][]string{
+		`up.exe %file_path% --to "a b"`:  {"up.exe", "%file_path%", "--to", "a b"},
+		`C:\tools\up.exe 'it''s' x"y z"`: {`C:\tools\up.exe`, "its", "xy z"},
+		`a "q\"uote\\" ''`:               {"a", `q"uote\`, ""},
+		`  `:                             nil,
+	}
+	for in, want := range cases {
+		got, err := splitArgs(in)
+		if err != nil {
+			t.Fatalf("splitArgs(%q): %v", in, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("splitArgs(%q) = %q, want %q", in, got, want)
+		}
+	}
+	if _, err := splitArgs(`a "b`); err == nil {
+		t.Errorf("expected unterminated quote error")
+	}
+}
+
+func TestExecCommandArgv(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses sh")
+	}
+	pe := PendingEvent{ID: 7, Event: Event{
+		EventType: EventType_CREATE,
+		DirPath:   "/data",
+		FilePath:  `/data/it's "quoted" $HOME.txt`,
+	}}
+	spec := &CmdSpec{Command: `sh -c 'printf "%%s|%%s|" "$1" "$BS_REL_PATH"; cat' sh %file_path%`}
+	_, out, _, err := execCommand(execEnv{mode: ExecModeArgv}, spec, pe)
+	if err != nil {
+		t.Fatalf("exec: %v out=%s", err, out)
+	}
+	parts := strings.SplitN(out, "|", 3)
+	if len(parts) != 3 || parts[0] != pe.FilePath || parts[1] != `it's "quoted" $HOME.txt` {
+		t.Fatalf("unexpected argv/env output %q", out)
+	}
+	var doc eventDocument
+	if err := json.Unmarshal([]byte(parts[2]), &doc); err != nil {
+		t.Fatalf("stdin json %q: %v", parts[2], err)
+	}
+	if doc.ID != 7 || doc.FilePath != pe.FilePath || doc.Attempt != 1 || doc.EventType != EventType_CREATE {
+		t.Errorf("unexpected event document %+v", doc)
+	}
+}
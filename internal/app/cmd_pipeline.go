@@ -0,0 +1,189 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/pancake-lee/pgo/pkg/plogger"
+)
+
+// 一条规则可以用 steps 声明按顺序执行的多个命令（如上传、校验、通知），每一步有自己的
+// 命令、超时和失败策略：
+//   - abort（默认）：停止，事件按这一步的结果重试或进入死信；重试时从失败的这一步继续
+//   - continue：记录失败，继续执行后面的步骤
+//   - compensate：放弃时（死信或达到最大次数）按相反顺序执行已完成步骤的 compensate 命令，
+//     然后事件进入死信；还可以重试时与 abort 相同
+// 每一步的结果记录在 event_steps 表，已成功（success/skip）的步骤重试时不会再执行。
+
+// StepFailurePolicy is what a pipeline does when a step fails.
+type StepFailurePolicy string
+
+const (
+	StepAbort      StepFailurePolicy = "abort"
+	StepContinue   StepFailurePolicy = "continue"
+	StepCompensate StepFailurePolicy = "compensate"
+)
+
+// CmdStep is one command of a pipeline.
+type CmdStep struct {
+	CmdSpec `yaml:",inline"`
+	// OnFailure defaults to StepAbort.
+	OnFailure StepFailurePolicy `json:"on_failure" yaml:"on_failure" toml:"on_failure"`
+	// Compensate undoes this step when a later compensate step gives up.
+	Compensate *CmdSpec `json:"compensate" yaml:"compensate" toml:"compensate"`
+}
+
+// label names step i in logs and step records.
+func (s *CmdStep) label(i int) string {
+	if s.Name != "" {
+		return s.Name
+	}
+	return fmt.Sprintf("#%d", i+1)
+}
+
+func (s *CmdStep) validate() error {
+	switch s.OnFailure {
+	case "", StepAbort, StepContinue, StepCompensate:
+	default:
+		return fmt.Errorf("unknown on_failure %q", s.OnFailure)
+	}
+	if len(s.Steps) > 0 {
+		return fmt.Errorf("steps cannot be nested")
+	}
+	if s.Retry != (RetryPolicy{}) {
+		return fmt.Errorf("retry is set on the rule, not per step")
+	}
+	if s.Batch != nil {
+		return fmt.Errorf("batch cannot be combined with steps")
+	}
+	if s.Compensate != nil {
+		if len(s.Compensate.Steps) > 0 || s.Compensate.Retry != (RetryPolicy{}) || s.Compensate.Batch != nil {
+			return fmt.Errorf("compensate: only command settings are allowed")
+		}
+		if err := s.Compensate.validate(); err != nil {
+			return fmt.Errorf("compensate: %w", err)
+		}
+	}
+	return s.CmdSpec.validate()
+}
+
+// inherit returns c with Timeout, Dir and Env defaulted from the pipeline
+// spec s.
+func (s *CmdSpec) inherit(c *CmdSpec) *CmdSpec {
+	out := *c
+	if out.Timeout == 0 {
+		out.Timeout = s.Timeout
+	}
+	if out.Dir == "" {
+		out.Dir = s.Dir
+	}
+	if len(s.Env) > 0 {
+		out.Env = make(map[string]string, len(s.Env)+len(c.Env))
+		for k, v := range s.Env {
+			out.Env[k] = v
+		}
+		for k, v := range c.Env {
+			out.Env[k] = v
+		}
+	}
+	return &out
+}
+
+// runSteps runs the pipeline of spec for pe, skipping steps a previous
+// attempt completed, and returns the result of the event.
+func (a *App) runSteps(st *Storage, x execEnv, spec *CmdSpec, pe PendingEvent) CmdResult {
+	records, err := st.GetSteps(pe.ID)
+	if err != nil {
+		return CmdResult{Status: StatusRetry, Message: err.Error()}
+	}
+	done := make(map[int]bool)
+	for _, r := range records {
+		if i := r.Index; i < len(spec.Steps) && spec.Steps[i].label(i) == r.Name &&
+			(r.Status == string(StatusSuccess) || r.Status == string(StatusSkip)) {
+			done[i] = true
+		}
+	}
+
+	var (
+		remoteID string
+		failed   []string
+	)
+	for i := range spec.Steps {
+		step := &spec.Steps[i]
+		name := step.label(i)
+		if done[i] {
+			plogger.Debugf("step[%s] id=%d already done, skipped", name, pe.ID)
+			continue
+		}
+
+		res := a.runCmd(x, spec.inherit(&step.CmdSpec), pe, "step "+name)
+		if err := st.RecordStep(pe.ID, i, name, string(res.Status), res.Message); err != nil {
+			plogger.Errorf("record step %s id=%d: %v", name, pe.ID, err)
+		}
+		if res.Status == StatusSuccess || res.Status == StatusSkip {
+			done[i] = true
+			if res.RemoteID != "" {
+				remoteID = res.RemoteID
+			}
+			continue
+		}
+
+		res.Message = fmt.Sprintf("step %s: %s", name, res.Message)
+		switch step.OnFailure {
+		case StepContinue:
+			failed = append(failed, name)
+			continue
+		case StepCompensate:
+			giveUp := res.Status == StatusFailed ||
+				(spec.Retry.MaxAttempts > 0 && pe.Attempts+1 >= spec.Retry.MaxAttempts)
+			if giveUp {
+				a.compensate(st, x, spec, pe, done)
+				res.Status = StatusFailed
+				res.Message += " (compensated)"
+			}
+		}
+		return res
+	}
+
+	res := CmdResult{Status: StatusSuccess, RemoteID: remoteID}
+	if len(failed) > 0 {
+		res.Message = "continued past failed steps: " + strings.Join(failed, ", ")
+	}
+	return res
+}
+
+// compensate runs the compensate commands of the done steps, last first.
+func (a *App) compensate(st *Storage, x execEnv, spec *CmdSpec, pe PendingEvent, done map[int]bool) {
+	for i := len(spec.Steps) - 1; i >= 0; i-- {
+		step := &spec.Steps[i]
+		if !done[i] || step.Compensate == nil {
+			continue
+		}
+		name := step.label(i)
+		res := a.runCmd(x, spec.inherit(step.Compensate), pe, "compensate "+name)
+		status := stepCompensated
+		if res.Status != StatusSuccess && res.Status != StatusSkip {
+			status = "compensate_" + string(res.Status)
+			plogger.Errorf("compensate step %s id=%d: %s", name, pe.ID, res.Message)
+		}
+		if err := st.RecordStep(pe.ID, i, name, status, res.Message); err != nil {
+			plogger.Errorf("record step %s id=%d: %v", name, pe.ID, err)
+		}
+	}
+}
+
+// runCmd runs one command for pe and interprets its result.
+func (a *App) runCmd(x execEnv, spec *CmdSpec, pe PendingEvent, label string) CmdResult {
+	cmdStr, stdout, stderr, err := execCommand(x, spec, pe)
+	plogger.Debugf("exec cmd[%v][%s] attempt[%d] err[%v] out[\n-----\n%v%v\n-----]",
+		label, cmdStr, pe.Attempts+1, err, stdout, stderr)
+
+	res := interpretResult(err, stdout, a.options.exitCodes())
+	if errors.Is(err, errNotAllowed) {
+		// refused before running, retrying cannot help
+		plogger.Errorf("refused command id=%d: %v", pe.ID, err)
+		res = CmdResult{Status: StatusFailed, Message: err.Error()}
+	}
+	return res
+}
@@ -0,0 +1,127 @@
+package app
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunStepsResumeAndCompensate(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no sh")
+	}
+	st := openTestStorage(t, "./test_pipeline.db")
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "log")
+	flag := filepath.Join(dir, "verified")
+	p := writeCmdFile(t, "cmds.yaml", `
+rules:
+  - name: sync
+    types: [MODIFY]
+    env: {LOG: "`+logPath+`"}
+    steps:
+      - name: upload
+        argv: [sh, -c, 'echo upload >> "$LOG"']
+        compensate: {argv: [sh, -c, 'echo undo >> "$LOG"']}
+      - name: verify
+        argv: [sh, -c, 'test -f "`+flag+`" || exit $CODE']
+        env: {CODE: "75"}
+        on_failure: compensate
+      - name: notify
+        argv: [sh, -c, 'echo notify >> "$LOG"']
+  - name: lenient
+    types: [DELETE]
+    steps:
+      - argv: [sh, -c, 'exit 65']
+        on_failure: continue
+      - argv: [sh, -c, 'echo ok']
+`)
+	parsed, err := loadAndParse(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readLog := func() string {
+		b, _ := os.ReadFile(logPath)
+		return strings.TrimSpace(string(b))
+	}
+
+	ids := insertAt(t, st, time.Now(), Event{EventType: EventType_MODIFY, FilePath: `d\a.txt`})
+	pe := *pendingOf(t, st, ids[0])
+	spec := parsed.lookup(pe)
+	a := New(Options{Mode: ModeConsumer})
+	x := execEnv{mode: ExecModeArgv}
+
+	res := a.runSteps(st, x, spec, pe)
+	if res.Status != StatusRetry || !strings.Contains(res.Message, "step verify") {
+		t.Fatalf("expected verify to ask for a retry, got %+v", res)
+	}
+	if err := os.WriteFile(flag, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	pe.Attempts = 1
+	if res := a.runSteps(st, x, spec, pe); res.Status != StatusSuccess {
+		t.Fatalf("expected success on retry, got %+v", res)
+	}
+	if got := readLog(); got != "upload\nnotify" {
+		t.Errorf("expected upload to run once, log %q", got)
+	}
+	steps, err := st.GetSteps(pe.ID)
+	if err != nil || len(steps) != 3 || steps[1].Name != "verify" || steps[1].Status != string(StatusSuccess) {
+		t.Errorf("unexpected step records %+v err %v", steps, err)
+	}
+
+	// a permanent failure of a compensate step undoes the upload
+	os.Remove(flag)
+	os.Remove(logPath)
+	spec.Steps[1].Env = map[string]string{"CODE": "65"}
+	ids = insertAt(t, st, time.Now(), Event{EventType: EventType_MODIFY, FilePath: `d\b.txt`})
+	pe = *pendingOf(t, st, ids[0])
+	res = a.runSteps(st, x, spec, pe)
+	if res.Status != StatusFailed || !strings.Contains(res.Message, "compensated") {
+		t.Fatalf("expected compensated failure, got %+v", res)
+	}
+	if got := readLog(); got != "upload\nundo" {
+		t.Errorf("expected upload then undo, log %q", got)
+	}
+	if steps, _ := st.GetSteps(pe.ID); len(steps) != 2 || steps[0].Status != stepCompensated {
+		t.Errorf("expected upload recorded compensated, got %+v", steps)
+	}
+
+	ids = insertAt(t, st, time.Now(), Event{EventType: EventType_DELETE, FilePath: `d\c.txt`})
+	pe = *pendingOf(t, st, ids[0])
+	res = a.runSteps(st, x, parsed.lookup(pe), pe)
+	if res.Status != StatusSuccess || !strings.Contains(res.Message, "#1") {
+		t.Errorf("expected success past the failed step, got %+v", res)
+	}
+}
+
+func TestCmdStepValidation(t *testing.T) {
+	bad := map[string]string{
+		"mixed.yaml":    "default:\n  command: x\n  steps:\n    - command: y\n",
+		"nested.yaml":   "default:\n  steps:\n    - steps:\n        - command: y\n",
+		"retry.yaml":    "default:\n  steps:\n    - command: y\n      retry: {max_attempts: 2}\n",
+		"policy.yaml":   "default:\n  steps:\n    - command: y\n      on_failure: ignore\n",
+		"empty.yaml":    "default:\n  steps:\n    - name: nothing\n",
+		"comp.yaml":     "default:\n  steps:\n    - command: y\n      compensate: {command: z %nope%}\n",
+		"step_env.toml": "[[default.steps]]\ncommand = \"y\"\nenv = {A = \"%nope%\"}\n",
+	}
+	for name, content := range bad {
+		if _, err := loadAndParse(writeCmdFile(t, name, content)); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+	good := "[default]\ntimeout = \"1m\"\n[[default.steps]]\nname = \"up\"\ncommand = \"up\"\n[[default.steps]]\nargv = [\"notify\"]\non_failure = \"continue\"\n"
+	parsed, err := loadAndParse(writeCmdFile(t, "good.toml", good))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(parsed.def.Steps); n != 2 {
+		t.Fatalf("expected 2 steps, got %d", n)
+	}
+	if got := parsed.def.inherit(&parsed.def.Steps[0].CmdSpec).Timeout; time.Duration(got) != time.Minute {
+		t.Errorf("expected step to inherit the timeout, got %v", time.Duration(got))
+	}
+}
@@ -0,0 +1,141 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// 命令结果约定：退出码决定结果（可在配置中改映射），stdout 最后一行如果是 JSON 对象，
+// 其中的 status 优先于退出码，message、remote_id、retry_after 会记录到事件上。
+//   - success: 处理完成（processed = 1）
+//   - skip:    无需处理（processed = 2）
+//   - failed:  永久失败，进入死信（processed = 3），不再重试
+//   - retry:   稍后重试，retry_after 之前不会再取出；未映射的非零退出码也按 retry 处理
+
+// CmdStatus is the outcome of a command run.
+type CmdStatus string
+
+const (
+	StatusSuccess CmdStatus = "success"
+	StatusRetry   CmdStatus = "retry"
+	StatusFailed  CmdStatus = "failed"
+	StatusSkip    CmdStatus = "skip"
+)
+
+func (s CmdStatus) valid() bool {
+	switch s {
+	case StatusSuccess, StatusRetry, StatusFailed, StatusSkip:
+		return true
+	}
+	return false
+}
+
+// defaultExitCodes follow sysexits.h where one fits.
+var defaultExitCodes = map[int]CmdStatus{
+	0:  StatusSuccess,
+	65: StatusFailed, // EX_DATAERR
+	75: StatusRetry,  // EX_TEMPFAIL
+	79: StatusSkip,
+}
+
+// CmdResult is the interpreted result of a command run. It is also the
+// optional JSON object on the last stdout line.
+type CmdResult struct {
+	Status   CmdStatus `json:"status"`
+	Message  string    `json:"message"`
+	RemoteID string    `json:"remote_id"`
+	// RetryAfter is a duration string ("30s") or a number of seconds.
+	RetryAfter retryAfter `json:"retry_after"`
+}
+
+type retryAfter time.Duration
+
+func (r *retryAfter) UnmarshalJSON(b []byte) error {
+	var v any
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	switch val := v.(type) {
+	case string:
+		d, err := time.ParseDuration(val)
+		if err != nil {
+			return fmt.Errorf("parse retry_after %q: %w", val, err)
+		}
+		*r = retryAfter(d)
+	case float64:
+		*r = retryAfter(time.Duration(val * float64(time.Second)))
+	case nil:
+	default:
+		return fmt.Errorf("invalid retry_after %s", string(b))
+	}
+	return nil
+}
+
+// interpretResult maps the exit status of a run and its stdout to a result.
+// codes maps exit codes to statuses; unmapped codes and errors that are not
+// an exit status mean retry.
+func interpretResult(runErr error, stdout string, codes map[int]CmdStatus) CmdResult {
+	code := 0
+	var res CmdResult
+	if runErr != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(runErr, &exitErr) {
+			return CmdResult{Status: StatusRetry, Message: runErr.Error()}
+		}
+		code = exitErr.ExitCode()
+		res.Message = runErr.Error()
+	}
+	status, ok := codes[code]
+	if !ok {
+		status = StatusRetry
+	}
+	res.Status = status
+
+	if line := lastLine(stdout); strings.HasPrefix(line, "{") {
+		var reported CmdResult
+		if err := json.Unmarshal([]byte(line), &reported); err == nil {
+			if reported.Status.valid() {
+				res.Status = reported.Status
+			}
+			if reported.Message != "" {
+				res.Message = reported.Message
+			}
+			res.RemoteID = reported.RemoteID
+			res.RetryAfter = reported.RetryAfter
+		}
+	}
+	return res
+}
+
+func lastLine(s string) string {
+	s = strings.TrimRight(s, " \t\r\n")
+	if i := strings.LastIndexByte(s, '\n'); i >= 0 {
+		s = s[i+1:]
+	}
+	return strings.TrimSpace(s)
+}
+
+// exitCodes overlays the configured exit codes on defaultExitCodes.
+func (o Options) exitCodes() map[int]CmdStatus {
+	codes := make(map[int]CmdStatus, len(defaultExitCodes)+len(o.ExitCodes))
+	for c, s := range defaultExitCodes {
+		codes[c] = s
+	}
+	for c, s := range o.ExitCodes {
+		codes[c] = s
+	}
+	return codes
+}
+
+func validateExitCodes(codes map[int]CmdStatus) error {
+	for c, s := range codes {
+		if !s.valid() {
+			return fmt.Errorf("exit code %d: unknown status %q", c, s)
+		}
+	}
+	return nil
+}
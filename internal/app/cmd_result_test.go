@@ -0,0 +1,98 @@
+package app
+
+import (
+	"errors"
+	"os/exec"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestInterpretResult(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses sh")
+	}
+	exitErr := func(code string) error {
+		err := exec.Command("sh", "-c", "exit "+code).Run()
+		if err == nil {
+			t.Fatalf("expected exit %s to fail", code)
+		}
+		return err
+	}
+	codes := Options{ExitCodes: map[int]CmdStatus{3: StatusSkip}}.exitCodes()
+
+	cases := []struct {
+		name   string
+		err    error
+		stdout string
+		want   CmdResult
+	}{
+		{"ok", nil, "uploaded\n", CmdResult{Status: StatusSuccess}},
+		{"tempfail", exitErr("75"), "", CmdResult{Status: StatusRetry, Message: "exit status 75"}},
+		{"dataerr", exitErr("65"), "", CmdResult{Status: StatusFailed, Message: "exit status 65"}},
+		{"configured", exitErr("3"), "", CmdResult{Status: StatusSkip, Message: "exit status 3"}},
+		{"unmapped", exitErr("1"), "", CmdResult{Status: StatusRetry, Message: "exit status 1"}},
+		{"not started", errors.New("exec: not found"), "", CmdResult{Status: StatusRetry, Message: "exec: not found"}},
+		{"json", nil, "log line\n{\"status\":\"retry\",\"message\":\"busy\",\"retry_after\":30}\n",
+			CmdResult{Status: StatusRetry, Message: "busy", RetryAfter: retryAfter(30 * time.Second)}},
+		{"json remote id", exitErr("75"), `{"status":"success","remote_id":"r-1","retry_after":"1m"}`,
+			CmdResult{Status: StatusSuccess, Message: "exit status 75", RemoteID: "r-1", RetryAfter: retryAfter(time.Minute)}},
+		{"not json", nil, "{broken", CmdResult{Status: StatusSuccess}},
+	}
+	for _, c := range cases {
+		if got := interpretResult(c.err, c.stdout, codes); got != c.want {
+			t.Errorf("%s: got %+v, want %+v", c.name, got, c.want)
+		}
+	}
+
+	if err := validateExitCodes(map[int]CmdStatus{1: "maybe"}); err == nil {
+		t.Errorf("expected unknown status to be rejected")
+	}
+}
+
+func TestApplyResultStates(t *testing.T) {
+	st := openTestStorage(t, "./test_cmd_result.db")
+	ids := insertAt(t, st, time.Now().Add(-time.Minute),
+		Event{EventType: EventType_CREATE, FilePath: `a\1.jpg`},
+		Event{EventType: EventType_MODIFY, FilePath: `a\1.jpg`},
+		Event{EventType: EventType_CREATE, FilePath: `a\2.jpg`},
+		Event{EventType: EventType_CREATE, FilePath: `a\3.jpg`},
+	)
+	a := New(Options{})
+	pe := func(i int) PendingEvent { return *pendingOf(t, st, ids[i]) }
+
+	if err := a.applyResult(st, pe(0), CmdResult{Status: StatusRetry, RetryAfter: retryAfter(time.Hour)}, RetryPolicy{}, ""); err == nil {
+		t.Fatalf("expected retry to be reported as error")
+	}
+	if err := a.applyResult(st, pe(2), CmdResult{Status: StatusFailed, Message: "bad"}, RetryPolicy{}, ""); err != nil {
+		t.Fatalf("apply failed: %v", err)
+	}
+	if err := a.applyResult(st, pe(3), CmdResult{Status: StatusSkip}, RetryPolicy{}, ""); err != nil {
+		t.Fatalf("apply skip: %v", err)
+	}
+	if p := processedOf(t, st, ids[2]); p != 3 {
+		t.Errorf("expected dead letter, got processed=%d", p)
+	}
+	if p := processedOf(t, st, ids[3]); p != 2 {
+		t.Errorf("expected skipped, got processed=%d", p)
+	}
+
+	// the retry waits for an hour and holds back the later event of its path
+	res, err := st.GetPendingEvents()
+	if err != nil {
+		t.Fatalf("get pending: %v", err)
+	}
+	if len(res) != 0 {
+		t.Fatalf("expected nothing due, got %+v", res)
+	}
+	if err := st.ScheduleRetry(ids[0], time.Time{}, ""); err != nil {
+		t.Fatal(err)
+	}
+	res, err = st.GetPendingEvents()
+	if err != nil {
+		t.Fatalf("get pending: %v", err)
+	}
+	if len(res) != 2 || res[0].ID != ids[0] || res[0].Attempts != 2 {
+		t.Fatalf("expected the retried event with 2 attempts first, got %+v", res)
+	}
+}
@@ -0,0 +1,232 @@
+package app
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 命令模板使用 %name% 占位符，%name|filter% 对值做引号处理，%% 表示字面的 %。
+// 模板中没有任何占位符时保持旧行为：在命令末尾追加 fullfile "<path>" oldfullfile "<old>"。
+
+// cmdPlaceholders are the values a command template can refer to.
+var cmdPlaceholders = map[string]func(pe PendingEvent) string{
+	"id":             func(pe PendingEvent) string { return strconv.FormatInt(pe.ID, 10) },
+	"event_type":     func(pe PendingEvent) string { return string(pe.EventType) },
+	"raw_event_type": func(pe PendingEvent) string { return pe.RawEventType },
+	"dir_path":       func(pe PendingEvent) string { return pe.DirPath },
+	"file_path":      func(pe PendingEvent) string { return pe.FilePath },
+	"old_file_path":  func(pe PendingEvent) string { return pe.OldFilePath },
+	"rel_path":       func(pe PendingEvent) string { return relPath(pe.FilePath, pe.DirPath) },
+	"old_rel_path":   func(pe PendingEvent) string { return relPath(pe.OldFilePath, pe.DirPath) },
+	"basename":       func(pe PendingEvent) string { return baseName(pe.FilePath) },
+	"ext":            func(pe PendingEvent) string { return path.Ext(baseName(pe.FilePath)) },
+	"size":           func(pe PendingEvent) string { return strconv.FormatInt(pe.Size, 10) },
+	"event_time":     func(pe PendingEvent) string { return pe.EventTime.Format(time.RFC3339) },
+	"attempt":        func(pe PendingEvent) string { return strconv.Itoa(pe.Attempts + 1) },
+	"is_dir":         func(pe PendingEvent) string { return strconv.FormatBool(pe.IsDir) },
+	"priority":       func(pe PendingEvent) string { return strconv.Itoa(pe.Priority) },
+
+	// batch commands, see BatchConfig
+	"manifest": func(pe PendingEvent) string {
+		if pe.batch == nil {
+			return ""
+		}
+		return pe.batch.manifest
+	},
+	"count": func(pe PendingEvent) string {
+		if pe.batch == nil {
+			return ""
+		}
+		return strconv.Itoa(pe.batch.count)
+	},
+
+	// names of the legacy appended arguments
+	"fullfile":    func(pe PendingEvent) string { return pe.FilePath },
+	"oldfullfile": func(pe PendingEvent) string { return pe.OldFilePath },
+}
+
+// cmdFilters quote a placeholder value, e.g. %file_path|sh%.
+var cmdFilters = map[string]func(string) string{
+	// quote produces a Go double quoted string, as the command splitter expects
+	"quote": strconv.Quote,
+	// sh quotes for POSIX shells
+	"sh": shellQuote,
+	// cmd quotes one argument for Windows programs (CommandLineToArgvW rules)
+	"cmd": windowsArgQuote,
+}
+
+type cmdTemplatePart struct {
+	literal string
+	name    string
+	filter  string
+}
+
+// CmdTemplate is a parsed command template.
+type CmdTemplate struct {
+	raw   string
+	parts []cmdTemplatePart
+	// legacy templates have no placeholders and get the path arguments appended
+	legacy bool
+}
+
+// ParseCmdTemplate parses s and rejects unknown placeholders and filters.
+func ParseCmdTemplate(s string) (*CmdTemplate, error) {
+	t := &CmdTemplate{raw: s, legacy: true}
+	var lit strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' {
+			lit.WriteByte(s[i])
+			continue
+		}
+		end := strings.IndexByte(s[i+1:], '%')
+		if end < 0 {
+			return nil, fmt.Errorf("command template %q: unterminated placeholder at offset %d", s, i)
+		}
+		token := s[i+1 : i+1+end]
+		i += end + 1
+		if token == "" {
+			lit.WriteByte('%')
+			continue
+		}
+		name, filter, _ := strings.Cut(token, "|")
+		if _, ok := cmdPlaceholders[name]; !ok {
+			return nil, fmt.Errorf("command template %q: unknown placeholder %%%s%%", s, name)
+		}
+		if _, ok := cmdFilters[filter]; filter != "" && !ok {
+			return nil, fmt.Errorf("command template %q: unknown filter %q in %%%s%%", s, filter, token)
+		}
+		if lit.Len() > 0 {
+			t.parts = append(t.parts, cmdTemplatePart{literal: lit.String()})
+			lit.Reset()
+		}
+		t.parts = append(t.parts, cmdTemplatePart{name: name, filter: filter})
+		t.legacy = false
+	}
+	if lit.Len() > 0 {
+		t.parts = append(t.parts, cmdTemplatePart{literal: lit.String()})
+	}
+	return t, nil
+}
+
+// Render returns the command line for pe.
+func (t *CmdTemplate) Render(pe PendingEvent) string {
+	var b strings.Builder
+	for _, p := range t.parts {
+		if p.name == "" {
+			b.WriteString(p.literal)
+			continue
+		}
+		v := cmdPlaceholders[p.name](pe)
+		if p.filter != "" {
+			v = cmdFilters[p.filter](v)
+		}
+		b.WriteString(v)
+	}
+	if t.legacy {
+		b.WriteString(" fullfile " + strconv.Quote(pe.FilePath))
+		b.WriteString(" oldfullfile " + strconv.Quote(pe.OldFilePath))
+		if pe.IsDir {
+			// 目录事件作为一个整体交给命令处理
+			b.WriteString(" isdir 1")
+		}
+	}
+	return b.String()
+}
+
+// Argv splits the template into arguments with splitArgs and renders each
+// argument separately. Legacy templates get the path arguments appended.
+func (t *CmdTemplate) Argv(pe PendingEvent) ([]string, error) {
+	words, err := splitArgs(t.raw)
+	if err != nil {
+		return nil, err
+	}
+	if len(words) == 0 {
+		return nil, fmt.Errorf("command template %q: empty command", t.raw)
+	}
+	argv := make([]string, 0, len(words)+5)
+	for _, w := range words {
+		wt, err := ParseCmdTemplate(w)
+		if err != nil {
+			return nil, err
+		}
+		wt.legacy = false
+		argv = append(argv, wt.Render(pe))
+	}
+	if t.legacy {
+		argv = append(argv, "fullfile", pe.FilePath, "oldfullfile", pe.OldFilePath)
+		if pe.IsDir {
+			argv = append(argv, "isdir", "1")
+		}
+	}
+	return argv, nil
+}
+
+// uses reports whether the template refers to placeholder name.
+func (t *CmdTemplate) uses(name string) bool {
+	for _, p := range t.parts {
+		if p.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *CmdTemplate) String() string {
+	return t.raw
+}
+
+// relPath returns filePath relative to dirPath, or filePath when it is not
+// below dirPath.
+func relPath(filePath, dirPath string) string {
+	dir := strings.TrimRight(toSlash(dirPath), "/")
+	if filePath == "" || dir == "" || !hasPathPrefix(toSlash(filePath), dir) {
+		return filePath
+	}
+	rel := strings.TrimLeft(filePath[len(dir):], `\/`)
+	if rel == "" {
+		return filePath
+	}
+	return rel
+}
+
+// baseName handles both Windows and slash separated paths.
+func baseName(p string) string {
+	if p == "" {
+		return ""
+	}
+	return path.Base(toSlash(p))
+}
+
+// shellQuote quotes s for POSIX shells.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// windowsArgQuote quotes s so CommandLineToArgvW parses it back as one
+// argument.
+func windowsArgQuote(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	slashes := 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch c {
+		case '\\':
+			slashes++
+		case '"':
+			// backslashes before a quote are doubled, and the quote escaped
+			b.WriteString(strings.Repeat(`\`, slashes+1))
+			slashes = 0
+		default:
+			slashes = 0
+		}
+		b.WriteByte(c)
+	}
+	// trailing backslashes are doubled so they do not escape the closing quote
+	b.WriteString(strings.Repeat(`\`, slashes))
+	b.WriteByte('"')
+	return b.String()
+}
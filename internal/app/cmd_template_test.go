@@ -0,0 +1,66 @@
+package app
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCmdTemplateRender(t *testing.T) {
+	pe := PendingEvent{
+		ID: 42,
+		Event: Event{
+			EventTime:    time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC),
+			RawEventType: "重命名",
+			EventType:    EventType_RENAME,
+			DirPath:      `\\host\share`,
+			FilePath:     `\\host\share\docs\new name.docx`,
+			OldFilePath:  `\\host\share\docs\old.docx`,
+			Size:         1234,
+		},
+		Attempts: 2,
+	}
+	cases := map[string]string{
+		`sync %event_type% %file_path|quote%`:           `sync RENAME "\\\\host\\share\\docs\\new name.docx"`,
+		`up %rel_path% %old_rel_path% %basename% %ext%`: `up docs\new name.docx docs\old.docx new name.docx .docx`,
+		`x %id% %size% %attempt% %event_time% 100%%`:    `x 42 1234 3 2024-05-06T07:08:09Z 100%`,
+		`x %raw_event_type% %dir_path% %is_dir%`:        `x 重命名 \\host\share false`,
+		`sh -c "echo %basename|sh%"`:                    `sh -c "echo 'new name.docx'"`,
+		`legacy.exe`:                                    `legacy.exe fullfile "\\\\host\\share\\docs\\new name.docx" oldfullfile "\\\\host\\share\\docs\\old.docx"`,
+	}
+	for in, want := range cases {
+		tmpl, err := ParseCmdTemplate(in)
+		if err != nil {
+			t.Fatalf("ParseCmdTemplate(%q): %v", in, err)
+		}
+		if got := tmpl.Render(pe); got != want {
+			t.Errorf("Render(%q)\n got %s\nwant %s", in, got, want)
+		}
+	}
+
+	for _, in := range []string{`x %nope%`, `x %file_path|upper%`, `x %file_path`} {
+		_, err := ParseCmdTemplate(in)
+		if err == nil {
+			t.Errorf("expected error for %q", in)
+		} else if !strings.Contains(err.Error(), in) {
+			t.Errorf("expected error to name the template, got %v", err)
+		}
+	}
+}
+
+func TestQuoteHelpers(t *testing.T) {
+	if got := shellQuote(`it's`); got != `'it'\''s'` {
+		t.Errorf("shellQuote = %s", got)
+	}
+	cases := map[string]string{
+		`a b`:      `"a b"`,
+		`say "hi"`: `"say \"hi\""`,
+		`C:\dir\`:  `"C:\dir\\"`,
+		`a\"b`:     `"a\\\"b"`,
+	}
+	for in, want := range cases {
+		if got := windowsArgQuote(in); got != want {
+			t.Errorf("windowsArgQuote(%s) = %s, want %s", in, got, want)
+		}
+	}
+}
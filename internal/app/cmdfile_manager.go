@@ -1,26 +1,207 @@
 package app
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
 	"sync"
 	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/fsnotify/fsnotify"
+	"github.com/pancake-lee/pgo/pkg/plogger"
+	"gopkg.in/yaml.v3"
 )
 
-// parsedCmds stores mapping from EventType to command template for a file.
-type parsedCmds map[EventType]string
+// 命令文件支持 JSON、YAML（.yaml/.yml）、TOML（.toml），按扩展名识别。
+// rules 按顺序匹配，第一条命中的规则决定命令，都不命中时使用 default。
+// 旧的平铺格式（add_cmd、modify_cmd ...）仍然有效，相当于排在 rules 之后、按事件类型匹配的规则。
+
+// RetryPolicy bounds how often and how fast a failing command is retried.
+type RetryPolicy struct {
+	// MaxAttempts sends the event to the dead letter state after this many
+	// failed runs; 0 retries forever.
+	MaxAttempts int `json:"max_attempts" yaml:"max_attempts" toml:"max_attempts"`
+	// Backoff is the delay after the first failure, doubled for each further
+	// one up to MaxBackoff. A retry_after reported by the command wins.
+	Backoff    Duration `json:"backoff" yaml:"backoff" toml:"backoff"`
+	MaxBackoff Duration `json:"max_backoff" yaml:"max_backoff" toml:"max_backoff"`
+}
+
+// delay returns the backoff before the retry following attempt (1-based).
+func (p RetryPolicy) delay(attempt int) time.Duration {
+	d := time.Duration(p.Backoff)
+	if d <= 0 {
+		return 0
+	}
+	for i := 1; i < attempt; i++ {
+		d *= 2
+		if p.MaxBackoff > 0 && d >= time.Duration(p.MaxBackoff) {
+			return time.Duration(p.MaxBackoff)
+		}
+	}
+	if p.MaxBackoff > 0 && d > time.Duration(p.MaxBackoff) {
+		return time.Duration(p.MaxBackoff)
+	}
+	return d
+}
+
+// CmdSpec is the command run for an event and how it is run.
+type CmdSpec struct {
+	Name string `json:"name" yaml:"name" toml:"name"`
+	// Command is a command template, see CmdTemplate.
+	Command string `json:"command" yaml:"command" toml:"command"`
+	// Argv is an alternative to Command: one template per argument, run
+	// without any splitting.
+	Argv []string `json:"argv" yaml:"argv" toml:"argv"`
+	// Timeout kills the command after this long; 0 means no limit.
+	Timeout Duration `json:"timeout" yaml:"timeout" toml:"timeout"`
+	// Env adds environment variables; values are templates too.
+	Env map[string]string `json:"env" yaml:"env" toml:"env"`
+	// Dir is the working directory of the command.
+	Dir   string      `json:"dir" yaml:"dir" toml:"dir"`
+	Retry RetryPolicy `json:"retry" yaml:"retry" toml:"retry"`
+	// Steps replace Command and Argv with an ordered pipeline, see CmdStep.
+	// Timeout, Env and Dir are then defaults of the steps.
+	Steps []CmdStep `json:"steps" yaml:"steps" toml:"steps"`
+	// Batch runs the command once for many events, see BatchConfig.
+	Batch *BatchConfig `json:"batch" yaml:"batch" toml:"batch"`
+}
+
+// direct reports whether the spec needs the argv executor: putil.ExecSplit
+// supports neither timeouts, environment nor working directory.
+func (s *CmdSpec) direct() bool {
+	return len(s.Argv) > 0 || s.Timeout > 0 || len(s.Env) > 0 || s.Dir != ""
+}
+
+func (s *CmdSpec) validate() error {
+	if len(s.Steps) > 0 {
+		if s.Command != "" || len(s.Argv) > 0 {
+			return fmt.Errorf("steps cannot be combined with command or argv")
+		}
+		for i := range s.Steps {
+			if err := s.Steps[i].validate(); err != nil {
+				return fmt.Errorf("step %s: %w", s.Steps[i].label(i), err)
+			}
+		}
+	} else {
+		if (s.Command == "") == (len(s.Argv) == 0) {
+			return fmt.Errorf("exactly one of command and argv is required")
+		}
+		templates := append([]string{s.Command}, s.Argv...)
+		for _, t := range templates {
+			if _, err := ParseCmdTemplate(t); err != nil {
+				return err
+			}
+		}
+		if s.Command != "" && s.direct() {
+			if _, err := splitArgs(s.Command); err != nil {
+				return err
+			}
+		}
+	}
+	for _, v := range s.Env {
+		if _, err := ParseCmdTemplate(v); err != nil {
+			return err
+		}
+	}
+	if err := s.validateBatch(); err != nil {
+		return err
+	}
+	if s.Timeout < 0 || s.Retry.Backoff < 0 || s.Retry.MaxBackoff < 0 || s.Retry.MaxAttempts < 0 {
+		return fmt.Errorf("negative timeout or retry setting")
+	}
+	return nil
+}
+
+// CmdRule routes events whose path matches Glob and whose type is in Types
+// to its command. Empty conditions match everything.
+type CmdRule struct {
+	// Glob is a gitignore style glob over the slash separated full path, as
+	// in PriorityRule.
+	Glob    string      `json:"glob" yaml:"glob" toml:"glob"`
+	Types   []EventType `json:"types" yaml:"types" toml:"types"`
+	CmdSpec `yaml:",inline"`
+
+	re *regexp.Regexp
+}
+
+func (r *CmdRule) matches(pe PendingEvent) bool {
+	if len(r.Types) > 0 {
+		found := false
+		for _, t := range r.Types {
+			if t == pe.EventType {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return r.re == nil || r.re.MatchString(toSlash(pe.FilePath))
+}
+
+// cmdFileSchema is the content of a cmd file.
+type cmdFileSchema struct {
+	Rules   []CmdRule `json:"rules" yaml:"rules" toml:"rules"`
+	Default *CmdSpec  `json:"default" yaml:"default" toml:"default"`
+
+	// flat format of the first cmd files
+	AddCmd    string `json:"add_cmd" yaml:"add_cmd" toml:"add_cmd"`
+	ModifyCmd string `json:"modify_cmd" yaml:"modify_cmd" toml:"modify_cmd"`
+	RenameCmd string `json:"rename_cmd" yaml:"rename_cmd" toml:"rename_cmd"`
+	MoveCmd   string `json:"move_cmd" yaml:"move_cmd" toml:"move_cmd"`
+	DeleteCmd string `json:"delete_cmd" yaml:"delete_cmd" toml:"delete_cmd"`
+}
+
+// parsedCmds is a validated cmd file.
+type parsedCmds struct {
+	rules []CmdRule
+	def   *CmdSpec
+}
+
+// lookup returns the spec for pe, or nil when nothing matches.
+func (p *parsedCmds) lookup(pe PendingEvent) *CmdSpec {
+	if p == nil {
+		return nil
+	}
+	for i := range p.rules {
+		if p.rules[i].matches(pe) {
+			return &p.rules[i].CmdSpec
+		}
+	}
+	return p.def
+}
 
 type cmdFileEntry struct {
-	parsed  parsedCmds
+	parsed  *parsedCmds
 	expires time.Time
+	// watched is set once the directory of the file is watched; other
+	// entries are still reloaded after ttl
+	watched bool
 }
 
-// CmdFileManager caches parsed cmd_file mappings and provides lookup by event type.
+// CmdFileManager caches parsed cmd_file mappings and provides lookup by event.
+// Once Watch is called, cached files are reloaded when they change instead
+// of after ttl, except files whose directory could not be watched.
 type CmdFileManager struct {
 	mu    sync.Mutex
 	cache map[string]*cmdFileEntry
 	ttl   time.Duration
+
+	// onReload is called with the path of a cached file whose content was
+	// re-read successfully.
+	onReload func(path string)
+
+	// set by Watch, see cmdfile_watch.go
+	watcher *fsnotify.Watcher
+	dirs    map[string]bool
+	pending map[string]*time.Timer
 }
 
 // NewCmdFileManager constructs a manager with 5 minute TTL by default.
@@ -31,8 +212,46 @@ func NewCmdFileManager(ttl time.Duration) *CmdFileManager {
 	return &CmdFileManager{cache: make(map[string]*cmdFileEntry), ttl: ttl}
 }
 
-// loadAndParse reads file and returns parsed mapping.
-func loadAndParse(path string) (parsedCmds, error) {
+// decodeCmdFile unmarshals b according to the extension of path. With
+// strict, unknown keys are an error.
+func decodeCmdFile(path string, b []byte, strict bool) (*cmdFileSchema, error) {
+	var payload cmdFileSchema
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(b))
+		dec.KnownFields(strict)
+		if err := dec.Decode(&payload); err != nil {
+			return nil, err
+		}
+	case ".toml":
+		md, err := toml.Decode(string(b), &payload)
+		if err != nil {
+			return nil, err
+		}
+		if undecoded := md.Undecoded(); strict && len(undecoded) > 0 {
+			return nil, fmt.Errorf("unknown keys %v", undecoded)
+		}
+	default:
+		dec := json.NewDecoder(bytes.NewReader(b))
+		if strict {
+			dec.DisallowUnknownFields()
+		}
+		if err := dec.Decode(&payload); err != nil {
+			return nil, err
+		}
+	}
+	return &payload, nil
+}
+
+// loadAndParse reads file and returns the validated rules. Unknown keys
+// are logged and ignored, so older cmd files keep loading.
+func loadAndParse(path string) (*parsedCmds, error) {
+	return loadCmdFile(path, false)
+}
+
+// loadCmdFile reads file and returns the validated rules; with strict,
+// unknown keys are an error, as in "cmdfile validate".
+func loadCmdFile(path string, strict bool) (*parsedCmds, error) {
 	if path == "" {
 		return nil, nil
 	}
@@ -40,33 +259,62 @@ func loadAndParse(path string) (parsedCmds, error) {
 	if err != nil {
 		return nil, fmt.Errorf("read cmd file %s: %w", path, err)
 	}
-	var payload struct {
-		AddCmd    string `json:"add_cmd"`
-		ModifyCmd string `json:"modify_cmd"`
-		RenameCmd string `json:"rename_cmd"`
-		MoveCmd   string `json:"move_cmd"`
-		DeleteCmd string `json:"delete_cmd"`
+	payload, err := decodeCmdFile(path, b, true)
+	if err != nil && !strict {
+		if loose, lerr := decodeCmdFile(path, b, false); lerr == nil {
+			plogger.Warnf("cmd file %s: ignoring %v", path, err)
+			payload, err = loose, nil
+		}
 	}
-	if err := json.Unmarshal(b, &payload); err != nil {
+	if err != nil {
 		return nil, fmt.Errorf("unmarshal cmd file %s: %w", path, err)
 	}
-	m := make(parsedCmds)
-	if payload.AddCmd != "" {
-		m[EventType_CREATE] = payload.AddCmd
-	}
-	if payload.ModifyCmd != "" {
-		m[EventType_MODIFY] = payload.ModifyCmd
-	}
-	if payload.RenameCmd != "" {
-		m[EventType_RENAME] = payload.RenameCmd
+
+	rules := payload.Rules
+	for _, legacy := range []struct {
+		t   EventType
+		cmd string
+	}{
+		{EventType_CREATE, payload.AddCmd},
+		{EventType_MODIFY, payload.ModifyCmd},
+		{EventType_RENAME, payload.RenameCmd},
+		{EventType_MOVE, payload.MoveCmd},
+		{EventType_DELETE, payload.DeleteCmd},
+	} {
+		if legacy.cmd != "" {
+			rules = append(rules, CmdRule{Types: []EventType{legacy.t}, CmdSpec: CmdSpec{Command: legacy.cmd}})
+		}
 	}
-	if payload.MoveCmd != "" {
-		m[EventType_MOVE] = payload.MoveCmd
+
+	p := &parsedCmds{def: payload.Default}
+	for i, r := range rules {
+		name := r.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+		for _, t := range r.Types {
+			if !isKnownEventType(t) {
+				return nil, fmt.Errorf("cmd file %s: rule %s: unknown event type %q", path, name, t)
+			}
+		}
+		if r.Glob != "" {
+			re, err := compileGlob(r.Glob)
+			if err != nil {
+				return nil, fmt.Errorf("cmd file %s: rule %s: %w", path, name, err)
+			}
+			r.re = re
+		}
+		if err := r.validate(); err != nil {
+			return nil, fmt.Errorf("cmd file %s: rule %s: %w", path, name, err)
+		}
+		p.rules = append(p.rules, r)
 	}
-	if payload.DeleteCmd != "" {
-		m[EventType_DELETE] = payload.DeleteCmd
+	if p.def != nil {
+		if err := p.def.validate(); err != nil {
+			return nil, fmt.Errorf("cmd file %s: default: %w", path, err)
+		}
 	}
-	return m, nil
+	return p, nil
 }
 
 // Load loads and caches the parsed mapping for the given path.
@@ -78,44 +326,65 @@ func (m *CmdFileManager) Load(path string) error {
 	if err != nil {
 		return err
 	}
+	m.store(path, parsed)
+	return nil
+}
+
+// store caches parsed for path and watches it when watching is enabled.
+func (m *CmdFileManager) store(path string, parsed *parsedCmds) {
 	m.mu.Lock()
 	m.cache[path] = &cmdFileEntry{parsed: parsed, expires: time.Now().Add(m.ttl)}
 	m.mu.Unlock()
-	return nil
+	m.watchFile(path)
 }
 
-// GetCmd returns the command template for given file path and event type.
-// It will read and cache the file if necessary.
-func (m *CmdFileManager) GetCmd(path string, ev EventType) (string, error) {
+// GetSpec returns the command spec of the given cmd file for pe, or nil when
+// no rule matches. It will read and cache the file if necessary.
+func (m *CmdFileManager) GetSpec(path string, pe PendingEvent) (*CmdSpec, error) {
 	if path == "" {
-		return "", nil
+		return nil, nil
 	}
 	m.mu.Lock()
 	e, ok := m.cache[path]
-	if ok && time.Now().Before(e.expires) {
-		if cmd, ok := e.parsed[ev]; ok {
-			m.mu.Unlock()
-			return cmd, nil
-		}
+	if ok && (e.watched || time.Now().Before(e.expires)) {
 		m.mu.Unlock()
-		return "", nil
+		return e.parsed.lookup(pe), nil
 	}
 	m.mu.Unlock()
 
 	parsed, err := loadAndParse(path)
 	if err != nil {
-		return "", err
+		if ok {
+			// keep the last good content
+			plogger.Errorf("reload cmd file, keeping previous rules: %v", err)
+			m.mu.Lock()
+			e.expires = time.Now().Add(m.ttl)
+			m.mu.Unlock()
+			return e.parsed.lookup(pe), nil
+		}
+		return nil, err
+	}
+	m.store(path, parsed)
+	if ok && len(diffCmdFiles(e.parsed, parsed)) > 0 {
+		m.reloaded(path)
 	}
+	return parsed.lookup(pe), nil
+}
+
+// OnReload registers fn to be called after a cached cmd file was reloaded.
+func (m *CmdFileManager) OnReload(fn func(path string)) {
 	m.mu.Lock()
-	m.cache[path] = &cmdFileEntry{parsed: parsed, expires: time.Now().Add(m.ttl)}
+	m.onReload = fn
 	m.mu.Unlock()
-	if parsed == nil {
-		return "", nil
-	}
-	if cmd, ok := parsed[ev]; ok {
-		return cmd, nil
+}
+
+func (m *CmdFileManager) reloaded(path string) {
+	m.mu.Lock()
+	fn := m.onReload
+	m.mu.Unlock()
+	if fn != nil {
+		fn(path)
 	}
-	return "", nil
 }
 
 // PurgeExpired removes expired entries; called optionally by callers.
@@ -0,0 +1,415 @@
+package app
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func writeCmdFile(t *testing.T, name, content string) string {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestCmdFileFormats(t *testing.T) {
+	files := map[string]string{
+		"cmds.json": `{
+			"rules": [
+				{"name": "photos", "glob": "**/photos/**", "types": ["CREATE", "MODIFY"], "argv": ["up", "%file_path%"], "timeout": "5m",
+				 "retry": {"max_attempts": 3, "backoff": "10s"}},
+				{"name": "docs", "glob": "*.docx", "command": "docs %file_path|quote%", "env": {"TARGET": "%rel_path%"}, "dir": "/tmp"}
+			],
+			"default": {"command": "other"},
+			"delete_cmd": "legacy-delete"
+		}`,
+		"cmds.yaml": `
+rules:
+  - name: photos
+    glob: "**/photos/**"
+    types: [CREATE, MODIFY]
+    argv: [up, "%file_path%"]
+    timeout: 5m
+    retry: {max_attempts: 3, backoff: 10s}
+  - name: docs
+    glob: "*.docx"
+    command: docs %file_path|quote%
+    env: {TARGET: "%rel_path%"}
+    dir: /tmp
+default:
+  command: other
+delete_cmd: legacy-delete
+`,
+		"cmds.toml": `
+delete_cmd = "legacy-delete"
+
+[[rules]]
+name = "photos"
+glob = "**/photos/**"
+types = ["CREATE", "MODIFY"]
+argv = ["up", "%file_path%"]
+timeout = "5m"
+retry = { max_attempts = 3, backoff = "10s" }
+
+[[rules]]
+name = "docs"
+glob = "*.docx"
+command = "docs %file_path|quote%"
+env = { TARGET = "%rel_path%" }
+dir = "/tmp"
+
+[default]
+command = "other"
+`,
+	}
+	for name, content := range files {
+		m := NewCmdFileManager(0)
+		p := writeCmdFile(t, name, content)
+		if err := m.Load(p); err != nil {
+			t.Fatalf("%s: load: %v", name, err)
+		}
+		get := func(typ EventType, path string) *CmdSpec {
+			spec, err := m.GetSpec(p, PendingEvent{Event: Event{EventType: typ, FilePath: path}})
+			if err != nil {
+				t.Fatalf("%s: GetSpec: %v", name, err)
+			}
+			return spec
+		}
+		if s := get(EventType_CREATE, `d\photos\1.jpg`); s == nil || s.Name != "photos" || len(s.Argv) != 2 ||
+			time.Duration(s.Timeout) != 5*time.Minute || s.Retry.MaxAttempts != 3 || time.Duration(s.Retry.Backoff) != 10*time.Second {
+			t.Errorf("%s: photos rule: %+v", name, s)
+		}
+		if s := get(EventType_MODIFY, `d\a.docx`); s == nil || s.Name != "docs" || s.Env["TARGET"] != "%rel_path%" || s.Dir != "/tmp" {
+			t.Errorf("%s: docs rule: %+v", name, s)
+		}
+		if s := get(EventType_DELETE, `d\photos\1.jpg`); s == nil || s.Command != "legacy-delete" {
+			t.Errorf("%s: legacy delete: %+v", name, s)
+		}
+		if s := get(EventType_RENAME, `d\x.txt`); s == nil || s.Command != "other" {
+			t.Errorf("%s: default: %+v", name, s)
+		}
+	}
+}
+
+func TestCmdFileLegacyAndErrors(t *testing.T) {
+	p := writeCmdFile(t, "legacy.json", `{"add_cmd": "a.exe", "modify_cmd": "m.exe"}`)
+	m := NewCmdFileManager(0)
+	spec, err := m.GetSpec(p, PendingEvent{Event: Event{EventType: EventType_MODIFY}})
+	if err != nil || spec == nil || spec.Command != "m.exe" {
+		t.Fatalf("expected legacy modify command, got %+v err %v", spec, err)
+	}
+	if spec, _ := m.GetSpec(p, PendingEvent{Event: Event{EventType: EventType_DELETE}}); spec != nil {
+		t.Errorf("expected no command for DELETE, got %+v", spec)
+	}
+
+	// unknown keys are ignored at runtime, only validate rejects them
+	for name, content := range map[string]string{
+		"extra.json": `{"add_cmd": "a.exe", "note": "old"}`,
+		"extra.yaml": "add_cmd: a.exe\nnote: old\n",
+		"extra.toml": "add_cmd = \"a.exe\"\nnote = \"old\"\n",
+	} {
+		spec, err := m.GetSpec(writeCmdFile(t, name, content), PendingEvent{Event: Event{EventType: EventType_CREATE}})
+		if err != nil || spec == nil || spec.Command != "a.exe" {
+			t.Errorf("%s: expected the command despite unknown keys, got %+v err %v", name, spec, err)
+		}
+	}
+
+	bad := map[string]string{
+		"unknown_key.json": `{"rules": [{"comand": "x"}]}`,
+		"both.json":        `{"rules": [{"command": "x", "argv": ["y"]}]}`,
+		"placeholder.yaml": "rules:\n  - command: x %nope%\n",
+		"type.toml":        "[[rules]]\ntypes = [\"FOO\"]\ncommand = \"x\"\n",
+		"bad_default.json": `{"default": {}}`,
+		"bad_timeout.yaml": "default:\n  command: x\n  timeout: soon\n",
+	}
+	for name, content := range bad {
+		if err := m.Load(writeCmdFile(t, name, content)); err == nil {
+			t.Errorf("%s: expected error", name)
+		} else if !strings.Contains(err.Error(), name) {
+			t.Errorf("%s: expected error to name the file, got %v", name, err)
+		}
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := RetryPolicy{Backoff: Duration(10 * time.Second), MaxBackoff: Duration(time.Minute)}
+	want := []time.Duration{10 * time.Second, 20 * time.Second, 40 * time.Second, time.Minute, time.Minute}
+	for i, w := range want {
+		if got := p.delay(i + 1); got != w {
+			t.Errorf("delay(%d) = %v, want %v", i+1, got, w)
+		}
+	}
+	if d := (RetryPolicy{}).delay(3); d != 0 {
+		t.Errorf("expected no backoff, got %v", d)
+	}
+}
+
+func TestApplyResultRetryPolicy(t *testing.T) {
+	st := openTestStorage(t, "./test_retry_policy.db")
+	ids := insertAt(t, st, time.Now().Add(-time.Minute), Event{EventType: EventType_CREATE, FilePath: `a\1.jpg`})
+	a := New(Options{})
+	policy := RetryPolicy{MaxAttempts: 2, Backoff: Duration(time.Hour)}
+
+	if err := a.applyResult(st, *pendingOf(t, st, ids[0]), CmdResult{Status: StatusRetry}, policy, ""); err == nil {
+		t.Fatalf("expected first failure to retry")
+	}
+	if res, _ := st.GetPendingEvents(); len(res) != 0 {
+		t.Fatalf("expected backoff to hold the event, got %+v", res)
+	}
+	pe := *pendingOf(t, st, ids[0])
+	pe.Attempts = 1
+	if err := a.applyResult(st, pe, CmdResult{Status: StatusRetry}, policy, ""); err != nil {
+		t.Fatalf("expected give up without error, got %v", err)
+	}
+	if p := processedOf(t, st, ids[0]); p != 3 {
+		t.Errorf("expected dead letter after max attempts, got processed=%d", p)
+	}
+}
+
+func TestExecCommandSpecSettings(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses sh")
+	}
+	dir := t.TempDir()
+	pe := PendingEvent{ID: 1, Event: Event{EventType: EventType_CREATE, DirPath: "/data", FilePath: "/data/x/y.txt"}}
+	spec := &CmdSpec{
+		Argv: []string{"sh", "-c", `printf "%%s|%%s" "$TARGET" "$(pwd)"`},
+		Env:  map[string]string{"TARGET": "%rel_path%"},
+		Dir:  dir,
+	}
+	_, out, _, err := execCommand(execEnv{mode: ExecModeSplit}, spec, pe)
+	if err != nil {
+		t.Fatalf("exec: %v", err)
+	}
+	wantDir, _ := filepath.EvalSymlinks(dir)
+	if gotDir := strings.SplitN(out, "|", 2); len(gotDir) != 2 || gotDir[0] != "x/y.txt" {
+		t.Errorf("unexpected output %q", out)
+	} else if d, _ := filepath.EvalSymlinks(gotDir[1]); d != wantDir {
+		t.Errorf("expected dir %s, got %s", wantDir, gotDir[1])
+	}
+
+	spec = &CmdSpec{Argv: []string{"sleep", "5"}, Timeout: Duration(100 * time.Millisecond)}
+	start := time.Now()
+	_, _, _, err = execCommand(execEnv{mode: ExecModeSplit}, spec, pe)
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("expected timeout error, got %v", err)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Errorf("timeout did not stop the command")
+	}
+	if res := interpretResult(err, "", defaultExitCodes); res.Status != StatusRetry {
+		t.Errorf("expected timeout to retry, got %+v", res)
+	}
+}
+
+func TestCmdFileHotReload(t *testing.T) {
+	p := writeCmdFile(t, "cmds.yaml", "default:\n  command: v1\n")
+	m := NewCmdFileManager(time.Hour)
+	if err := m.Load(p); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Watch(); err != nil {
+		t.Skipf("fsnotify unavailable: %v", err)
+	}
+	defer m.Close()
+
+	pe := PendingEvent{Event: Event{EventType: EventType_CREATE}}
+	waitFor := func(want string) {
+		t.Helper()
+		deadline := time.Now().Add(3 * time.Second)
+		for {
+			spec, err := m.GetSpec(p, pe)
+			if err == nil && spec != nil && spec.Command == want {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("expected command %q, got %+v err %v", want, spec, err)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+
+	// rewrite via rename, the way most editors save
+	tmp := p + ".tmp"
+	if err := os.WriteFile(tmp, []byte("default:\n  command: v2\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, p); err != nil {
+		t.Fatal(err)
+	}
+	waitFor("v2")
+
+	// an invalid edit keeps the last good rules
+	if err := os.WriteFile(p, []byte("default:\n  command: x %nope%\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(3 * cmdFileReloadDelay)
+	waitFor("v2")
+
+	if err := os.WriteFile(p, []byte("default:\n  command: v3\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	waitFor("v3")
+}
+
+func TestCmdFileUnwatchedFallsBackToTTL(t *testing.T) {
+	p := writeCmdFile(t, "cmds.yaml", "default:\n  command: v1\n")
+	m := NewCmdFileManager(time.Hour)
+	if err := m.Watch(); err != nil {
+		t.Skipf("fsnotify unavailable: %v", err)
+	}
+	defer m.Close()
+	// a closed watcher makes adding the directory fail
+	m.watcher.Close()
+	if err := m.Load(p); err != nil {
+		t.Fatal(err)
+	}
+	if m.cache[p].watched {
+		t.Fatal("expected the file not to be watched")
+	}
+
+	if err := os.WriteFile(p, []byte("default:\n  command: v2\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	m.mu.Lock()
+	m.cache[p].expires = time.Time{}
+	m.mu.Unlock()
+	spec, err := m.GetSpec(p, PendingEvent{Event: Event{EventType: EventType_CREATE}})
+	if err != nil || spec == nil || spec.Command != "v2" {
+		t.Errorf("expected the unwatched file reloaded after ttl, got %+v err %v", spec, err)
+	}
+}
+
+func TestCmdFileReloadKeepsWatched(t *testing.T) {
+	p := writeCmdFile(t, "cmds.yaml", "default:\n  command: v1\n")
+	m := NewCmdFileManager(time.Hour)
+	if err := m.Watch(); err != nil {
+		t.Skipf("fsnotify unavailable: %v", err)
+	}
+	defer m.Close()
+	var reloads atomic.Int32
+	m.OnReload(func(string) { reloads.Add(1) })
+	if err := m.Load(p); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p, []byte("default:\n  command: v2\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	m.reload(p)
+
+	// still watched after the hot reload, so ttl expiry does not reload it
+	m.mu.Lock()
+	watched := m.cache[p].watched
+	m.cache[p].expires = time.Time{}
+	m.mu.Unlock()
+	if !watched {
+		t.Fatal("expected the reloaded file to stay watched")
+	}
+	spec, err := m.GetSpec(p, PendingEvent{Event: Event{EventType: EventType_CREATE}})
+	if err != nil || spec == nil || spec.Command != "v2" {
+		t.Fatalf("expected v2, got %+v err %v", spec, err)
+	}
+	if n := reloads.Load(); n != 1 {
+		t.Errorf("expected one reload callback, got %d", n)
+	}
+}
+
+func TestDiffCmdFiles(t *testing.T) {
+	parse := func(content string) *parsedCmds {
+		t.Helper()
+		parsed, err := loadAndParse(writeCmdFile(t, "c.json", content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed
+	}
+	old := parse(`{"add_cmd": "a", "delete_cmd": "d"}`)
+	cur := parse(`{"add_cmd": "a", "delete_cmd": "d2", "modify_cmd": "m"}`)
+	changes := diffCmdFiles(old, cur)
+	if len(changes) != 2 {
+		t.Fatalf("expected DELETE and MODIFY changes, got %q", changes)
+	}
+	for _, c := range changes {
+		if !strings.HasPrefix(c, string(EventType_MODIFY)) && !strings.HasPrefix(c, string(EventType_DELETE)) {
+			t.Errorf("unexpected change %q", c)
+		}
+	}
+	if changes := diffCmdFiles(old, old); len(changes) != 0 {
+		t.Errorf("expected no changes, got %q", changes)
+	}
+}
+
+func TestRunCmdFileValidate(t *testing.T) {
+	exe, err := os.Executable()
+	if err != nil {
+		t.Skip(err)
+	}
+	exe = filepath.ToSlash(exe)
+	good := writeCmdFile(t, "good.yaml", "rules:\n  - name: up\n    argv: [\""+exe+"\", \"%rel_path%\"]\ndefault:\n  command: "+exe+" %file_path|quote%\n")
+	var out bytes.Buffer
+	a := New(Options{Mode: ModeCmdFile})
+	a.stdout = &out
+	if err := a.Run([]string{"validate", good}); err != nil {
+		t.Fatalf("validate: %v\n%s", err, out.String())
+	}
+	if lines := strings.Split(strings.TrimSpace(out.String()), "\n"); len(lines) != 2 || !strings.HasPrefix(lines[0], "ok\tup\t") {
+		t.Errorf("unexpected output %q", out.String())
+	}
+
+	missing := writeCmdFile(t, "missing.json", `{"add_cmd": "no-such-program-bs %file_path%"}`)
+	out.Reset()
+	if err := a.Run([]string{"validate", missing}); err == nil {
+		t.Fatalf("expected missing program to fail, got %q", out.String())
+	}
+	if !strings.HasPrefix(out.String(), "error\t#1\t") || !strings.Contains(out.String(), "no-such-program-bs") {
+		t.Errorf("unexpected output %q", out.String())
+	}
+
+	unknown := writeCmdFile(t, "unknown.json", `{"add_cmd": "sh", "note": "old"}`)
+	if err := a.Run([]string{"validate", unknown}); err == nil {
+		t.Error("expected unknown key to fail")
+	}
+}
+
+func TestRunCmdFileDryRun(t *testing.T) {
+	const dbPath = "./test_cmdfile_dry_run.db"
+	st := openTestStorage(t, dbPath)
+	id, err := st.InsertEvent(&Event{
+		EventTime: time.Now(),
+		EventType: EventType_CREATE,
+		DirPath:   "/data",
+		FilePath:  "/data/photos/a b.jpg",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := writeCmdFile(t, "cmds.yaml", "rules:\n  - name: photos\n    glob: \"**/photos/**\"\n    argv: [up, \"%rel_path%\", \"--attempt=%attempt%\"]\n    env: {TARGET: \"%basename%\"}\n")
+
+	var out bytes.Buffer
+	a := New(Options{Mode: ModeCmdFile, DBPath: dbPath})
+	a.stdout = &out
+	if err := a.Run([]string{"dry-run", p, "--event-id", strconv.FormatInt(id, 10)}); err != nil {
+		t.Fatalf("dry-run: %v", err)
+	}
+	for _, want := range []string{"rule\tphotos\n", `argv	["up","photos/a b.jpg","--attempt=1"]`, "env\tTARGET=a b.jpg\n"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("expected %q in output:\n%s", want, out.String())
+		}
+	}
+
+	if err := a.Run([]string{"dry-run", p}); err == nil {
+		t.Error("expected missing --event-id to fail")
+	}
+	if err := a.Run([]string{"dry-run", p, "--event-id", "999"}); err == nil {
+		t.Error("expected unknown event to fail")
+	}
+}
@@ -0,0 +1,250 @@
+package app
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pancake-lee/pgo/pkg/plogger"
+)
+
+// 编辑器保存文件时常常先写临时文件再重命名，所以监听命令文件所在目录而不是文件本身，
+// 并在一小段时间内合并同一文件的多次变更。新内容校验失败时保留旧内容并打印错误。
+
+// cmdFileReloadDelay coalesces the burst of events of one save.
+const cmdFileReloadDelay = 100 * time.Millisecond
+
+// Watch starts reloading cached cmd files as soon as they change. Files
+// loaded later are watched too.
+func (m *CmdFileManager) Watch() error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("new watcher: %w", err)
+	}
+	m.mu.Lock()
+	m.watcher = w
+	m.dirs = make(map[string]bool)
+	m.pending = make(map[string]*time.Timer)
+	paths := make([]string, 0, len(m.cache))
+	for p := range m.cache {
+		paths = append(paths, p)
+	}
+	m.mu.Unlock()
+
+	for _, p := range paths {
+		m.watchFile(p)
+	}
+	go m.watchLoop(w)
+	return nil
+}
+
+// Close stops watching.
+func (m *CmdFileManager) Close() error {
+	m.mu.Lock()
+	w := m.watcher
+	m.watcher = nil
+	for _, t := range m.pending {
+		t.Stop()
+	}
+	for _, e := range m.cache {
+		e.watched = false
+	}
+	m.mu.Unlock()
+	if w == nil {
+		return nil
+	}
+	return w.Close()
+}
+
+// watchFile adds the directory of path to the watcher and marks the cached
+// entry as watched. When that fails the entry keeps reloading after ttl,
+// and the directory is tried again on the next reload.
+func (m *CmdFileManager) watchFile(path string) {
+	dir := filepath.Dir(absPath(path))
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.watcher == nil {
+		return
+	}
+	if !m.dirs[dir] {
+		if err := m.watcher.Add(dir); err != nil {
+			plogger.Errorf("watch cmd file dir %s, reloading after %v instead: %v", dir, m.ttl, err)
+			return
+		}
+		m.dirs[dir] = true
+	}
+	if e, ok := m.cache[path]; ok {
+		e.watched = true
+	}
+}
+
+func (m *CmdFileManager) watchLoop(w *fsnotify.Watcher) {
+	for {
+		select {
+		case ev, ok := <-w.Events:
+			if !ok {
+				return
+			}
+			if !ev.Has(fsnotify.Write) && !ev.Has(fsnotify.Create) && !ev.Has(fsnotify.Rename) {
+				continue
+			}
+			m.scheduleReload(absPath(ev.Name))
+		case err, ok := <-w.Errors:
+			if !ok {
+				return
+			}
+			plogger.Errorf("cmd file watcher: %v", err)
+		}
+	}
+}
+
+// scheduleReload reloads the cached file(s) at abs after cmdFileReloadDelay.
+func (m *CmdFileManager) scheduleReload(abs string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.watcher == nil {
+		return
+	}
+	for p := range m.cache {
+		if absPath(p) != abs {
+			continue
+		}
+		if t, ok := m.pending[p]; ok {
+			t.Reset(cmdFileReloadDelay)
+			continue
+		}
+		path := p
+		m.pending[path] = time.AfterFunc(cmdFileReloadDelay, func() { m.reload(path) })
+	}
+}
+
+// reload re-reads path and swaps it in only when it is valid.
+func (m *CmdFileManager) reload(path string) {
+	m.mu.Lock()
+	delete(m.pending, path)
+	old := m.cache[path]
+	m.mu.Unlock()
+
+	parsed, err := loadAndParse(path)
+	if err != nil {
+		plogger.Errorf("reload cmd file %s failed, keeping previous rules: %v", path, err)
+		return
+	}
+	m.mu.Lock()
+	// the directory watch outlives the entry
+	watched := m.cache[path] != nil && m.cache[path].watched
+	m.cache[path] = &cmdFileEntry{parsed: parsed, expires: time.Now().Add(m.ttl), watched: watched}
+	m.mu.Unlock()
+
+	var prev *parsedCmds
+	if old != nil {
+		prev = old.parsed
+	}
+	changes := diffCmdFiles(prev, parsed)
+	if len(changes) == 0 {
+		plogger.Infof("reloaded cmd file %s: no changes", path)
+		return
+	}
+	plogger.Infof("reloaded cmd file %s:\n  %s", path, strings.Join(changes, "\n  "))
+	m.reloaded(path)
+}
+
+// describe lists, per event type, the rules that can handle it in order.
+func (p *parsedCmds) describe() map[EventType]string {
+	out := make(map[EventType]string)
+	if p == nil {
+		return out
+	}
+	for _, t := range knownEventTypes {
+		var parts []string
+		for _, r := range p.rules {
+			if len(r.Types) > 0 && !containsEventType(r.Types, t) {
+				continue
+			}
+			parts = append(parts, r.describe())
+		}
+		if p.def != nil {
+			parts = append(parts, "default "+p.def.describe())
+		}
+		out[t] = strings.Join(parts, "; ")
+	}
+	return out
+}
+
+func (r *CmdRule) describe() string {
+	s := r.CmdSpec.describe()
+	if r.Glob != "" {
+		s = r.Glob + " " + s
+	}
+	if r.Name != "" {
+		s = r.Name + ": " + s
+	}
+	return s
+}
+
+func (s *CmdSpec) describe() string {
+	cmd := s.Command
+	if len(s.Argv) > 0 {
+		cmd = fmt.Sprintf("%q", s.Argv)
+	}
+	if len(s.Steps) > 0 {
+		steps := make([]string, len(s.Steps))
+		for i := range s.Steps {
+			st := &s.Steps[i]
+			steps[i] = st.label(i) + " " + st.CmdSpec.describe()
+			if st.OnFailure != "" {
+				steps[i] += " on_failure=" + string(st.OnFailure)
+			}
+			if st.Compensate != nil {
+				steps[i] += " compensate=" + st.Compensate.describe()
+			}
+		}
+		cmd = "steps: " + strings.Join(steps, ", ")
+	}
+	if b := s.Batch; b != nil {
+		cmd += fmt.Sprintf(" batch=%d/%v/%s", b.maxEvents(), b.maxWait(), b.format())
+	}
+	extra := ""
+	if s.Timeout > 0 || len(s.Env) > 0 || s.Dir != "" || s.Retry != (RetryPolicy{}) {
+		extra = fmt.Sprintf(" (timeout=%v env=%d dir=%q retry=%+v)", time.Duration(s.Timeout), len(s.Env), s.Dir, s.Retry)
+	}
+	return "[" + cmd + "]" + extra
+}
+
+// diffCmdFiles returns one line per event type whose handling changed.
+func diffCmdFiles(old, cur *parsedCmds) []string {
+	before, after := old.describe(), cur.describe()
+	var lines []string
+	for _, t := range knownEventTypes {
+		if before[t] == after[t] {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%s: %s -> %s", t, orNone(before[t]), orNone(after[t])))
+	}
+	return lines
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "(none)"
+	}
+	return s
+}
+
+func containsEventType(types []EventType, t EventType) bool {
+	for _, x := range types {
+		if x == t {
+			return true
+		}
+	}
+	return false
+}
+
+func absPath(p string) string {
+	if abs, err := filepath.Abs(p); err == nil {
+		return abs
+	}
+	return p
+}
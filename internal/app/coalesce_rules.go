@@ -0,0 +1,331 @@
+package app
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+
+	"github.com/pancake-lee/pgo/pkg/plogger"
+)
+
+// CoalesceAction is what a rule does when a follow-up event matches.
+type CoalesceAction string
+
+const (
+	// ActionMergeMove turns the first event into a MOVE from its path to the
+	// follow-up's path and skips the follow-up (DELETE+CREATE -> MOVE).
+	ActionMergeMove CoalesceAction = "merge_move"
+	// ActionSkipNext keeps the first event and skips the follow-up.
+	ActionSkipNext CoalesceAction = "skip_next"
+	// ActionSkipFirst skips the first event; the follow-up is processed.
+	ActionSkipFirst CoalesceAction = "skip_first"
+	// ActionSkipBoth skips both events.
+	ActionSkipBoth CoalesceAction = "skip_both"
+)
+
+// CoalesceRule pairs an event with a later event of the same window.
+type CoalesceRule struct {
+	Name string `json:"name"`
+	// First and Next are the event types of the pair, in time order.
+	First EventType `json:"first"`
+	Next  EventType `json:"next"`
+	// Match lists predicate names that must all hold, see coalescePredicates.
+	Match []string `json:"match"`
+	// Window is the maximum time between the events; 0 means the match window.
+	Window Duration       `json:"window"`
+	Action CoalesceAction `json:"action"`
+	// Disabled removes a default rule of the same name.
+	Disabled bool `json:"disabled"`
+}
+
+type coalescePredicate func(a, b PendingEvent) bool
+
+// coalescePredicates are the predicates rules can refer to by name.
+var coalescePredicates = map[string]coalescePredicate{
+	"same_path": func(a, b PendingEvent) bool { return a.FilePath == b.FilePath },
+	"same_base": func(a, b PendingEvent) bool {
+		return path.Base(toSlash(a.FilePath)) == path.Base(toSlash(b.FilePath))
+	},
+	"same_dir": func(a, b PendingEvent) bool {
+		return path.Dir(toSlash(a.FilePath)) == path.Dir(toSlash(b.FilePath))
+	},
+	"same_size": func(a, b PendingEvent) bool { return a.Size == b.Size },
+	// next_renames_first: b moves the file a points at (a.FilePath == b.OldFilePath)
+	"next_renames_first": func(a, b PendingEvent) bool {
+		return b.OldFilePath != "" && b.OldFilePath == a.FilePath
+	},
+	// same_hash compares the content of both files on disk; false when
+	// either file is missing.
+	"same_hash": func(a, b PendingEvent) bool {
+		ha, err := hashFile(a.FilePath)
+		if err != nil {
+			return false
+		}
+		hb, err := hashFile(b.FilePath)
+		if err != nil {
+			return false
+		}
+		return ha == hb
+	},
+}
+
+// defaultCoalesceRules are the merges the consumer always had.
+var defaultCoalesceRules = []CoalesceRule{
+	{
+		// 移动文件产生"删除+新增"，合并为 MOVE
+		Name:   "delete_create_move",
+		First:  EventType_DELETE,
+		Next:   EventType_CREATE,
+		Match:  []string{"same_base", "same_size"},
+		Action: ActionMergeMove,
+	},
+	{
+		// 重命名后紧跟一个修改事件，丢弃修改
+		Name:   "rename_modify",
+		First:  EventType_RENAME,
+		Next:   EventType_MODIFY,
+		Match:  []string{"same_path"},
+		Action: ActionSkipNext,
+	},
+	{
+		// 新增后紧跟一个修改事件，丢弃修改
+		Name:   "create_modify",
+		First:  EventType_CREATE,
+		Next:   EventType_MODIFY,
+		Match:  []string{"same_path"},
+		Action: ActionSkipNext,
+	},
+}
+
+// CoalesceConfig configures a Coalescer.
+type CoalesceConfig struct {
+	// Rules overlay defaultCoalesceRules: a rule replaces the default of the
+	// same name (or removes it when Disabled), others are appended in order.
+	Rules []CoalesceRule
+	// TempPatterns nil keeps defaultTempPatterns.
+	TempPatterns []string
+	// ModifyQuietPeriod is the largest gap between MODIFYs of one path that
+	// still counts as one burst. 0 means the match window, negative disables.
+	ModifyQuietPeriod time.Duration
+	// Windows sets the fetch and match windows; zero fields take defaults.
+	Windows Windows
+}
+
+// Coalescer applies directory absorption, temp file handling, short-lived
+// file cancelling, MODIFY debouncing, move chaining and pair rules to a
+// pending window.
+type Coalescer struct {
+	rules       []CoalesceRule
+	temp        *TempFileMatcher
+	modifyQuiet time.Duration
+	win         Windows
+}
+
+// NewCoalescer builds a coalescer from cfg.
+func NewCoalescer(cfg CoalesceConfig) (*Coalescer, error) {
+	rules := append([]CoalesceRule(nil), defaultCoalesceRules...)
+	for _, cr := range cfg.Rules {
+		replaced := false
+		for i := range rules {
+			if cr.Name != "" && rules[i].Name == cr.Name {
+				rules[i], replaced = cr, true
+				break
+			}
+		}
+		if !replaced {
+			rules = append(rules, cr)
+		}
+	}
+
+	c := &Coalescer{modifyQuiet: cfg.ModifyQuietPeriod, win: cfg.Windows.withDefaults()}
+	if err := c.win.Validate(); err != nil {
+		return nil, err
+	}
+	if c.modifyQuiet == 0 {
+		c.modifyQuiet = c.win.MatchWindow
+	}
+	for _, r := range rules {
+		if r.Disabled {
+			continue
+		}
+		if err := r.validate(); err != nil {
+			return nil, err
+		}
+		// pairs are only looked for among the fetched events
+		if w := time.Duration(r.Window); w > c.win.FetchWindow {
+			return nil, fmt.Errorf("coalesce rule %q: window %v exceeds fetch_window %v", r.Name, w, c.win.FetchWindow)
+		}
+		c.rules = append(c.rules, r)
+	}
+
+	temp, err := NewTempFileMatcher(cfg.TempPatterns)
+	if err != nil {
+		return nil, fmt.Errorf("temp patterns: %w", err)
+	}
+	c.temp = temp
+	return c, nil
+}
+
+func (r CoalesceRule) validate() error {
+	if !isKnownEventType(r.First) || !isKnownEventType(r.Next) {
+		return fmt.Errorf("coalesce rule %q: unknown event type %q/%q", r.Name, r.First, r.Next)
+	}
+	for _, m := range r.Match {
+		if _, ok := coalescePredicates[m]; !ok {
+			return fmt.Errorf("coalesce rule %q: unknown predicate %q", r.Name, m)
+		}
+	}
+	switch r.Action {
+	case ActionMergeMove, ActionSkipNext, ActionSkipFirst, ActionSkipBoth:
+	default:
+		return fmt.Errorf("coalesce rule %q: unknown action %q", r.Name, r.Action)
+	}
+	if r.Window < 0 {
+		return fmt.Errorf("coalesce rule %q: negative window", r.Name)
+	}
+	return nil
+}
+
+// window returns the rule window, or def when the rule has none.
+func (r CoalesceRule) window(def time.Duration) time.Duration {
+	if r.Window > 0 {
+		return time.Duration(r.Window)
+	}
+	return def
+}
+
+func (r CoalesceRule) matches(a, b PendingEvent) bool {
+	if b.EventType != r.Next {
+		return false
+	}
+	for _, m := range r.Match {
+		if !coalescePredicates[m](a, b) {
+			return false
+		}
+	}
+	return true
+}
+
+var defaultCoalescer, _ = NewCoalescer(CoalesceConfig{})
+
+// dropSkipped returns events without the ones whose id is in skipped; the
+// coalescing stages use it to pass their remaining events on.
+func dropSkipped(events []PendingEvent, skipped map[int64]bool) []PendingEvent {
+	if len(skipped) == 0 {
+		return events
+	}
+	out := make([]PendingEvent, 0, len(events))
+	for _, pe := range events {
+		if !skipped[pe.ID] {
+			out = append(out, pe)
+		}
+	}
+	return out
+}
+
+// GetAndFixedPendingEvents 调用st.GetPendingEvents，并且按规则处理一些特殊事件的转换逻辑，再返回给外层处理
+func (c *Coalescer) GetAndFixedPendingEvents(st *Storage) ([]PendingEvent, error) {
+	all, err := st.GetPendingEventsWindow(c.win)
+	if err != nil {
+		return nil, err
+	}
+	if len(all) == 0 {
+		return all, nil
+	}
+
+	// 先吸收目录事件下的逐文件事件，再合并临时文件链、抵消短命文件、
+	// 合并连续的修改和连续的移动，剩下的事件再走组合规则
+	all = c.absorbDirEvents(st, all)
+	all = coalesceTempFiles(st, all, c.temp)
+	all = c.cancelShortLived(st, all)
+	all = c.debounceModify(st, all)
+	all = c.collapseMoveChains(st, all)
+	if len(all) == 0 {
+		return all, nil
+	}
+
+	earliestTime := all[0].EventTime
+
+	var out []PendingEvent
+	skip := make(map[int]bool)
+	for i := 0; i < len(all); i++ {
+		if skip[i] {
+			// this index was consumed/marked skipped by an earlier merge
+			continue
+		}
+		cur := all[i]
+		if cur.EventTime.Sub(earliestTime) > c.win.MatchWindow {
+			// beyond the match window; stop processing further events
+			break
+		}
+		plogger.Debugf("handle event[%v] type[%v] file[%v] old[%v]",
+			cur.ID, cur.EventType, cur.FilePath, cur.OldFilePath)
+
+		keep := true
+		for _, r := range c.rules {
+			if r.First != cur.EventType {
+				continue
+			}
+			idx := findNextMatchingIndex(all, i, skip, r.matches, r.window(c.win.MatchWindow))
+			if idx == -1 {
+				continue
+			}
+			keep = c.apply(st, r, &cur, all[idx])
+			// mark the follow-up index as handled so it's not processed later in-memory
+			skip[idx] = r.Action != ActionSkipFirst
+			break
+		}
+		if keep {
+			out = append(out, cur)
+		}
+	}
+
+	return out, nil
+}
+
+// apply performs the rule action in the DB and on cur, and reports whether
+// cur should still be processed.
+func (c *Coalescer) apply(st *Storage, r CoalesceRule, cur *PendingEvent, next PendingEvent) bool {
+	var err error
+	switch r.Action {
+	case ActionMergeMove:
+		err = st.ConvertDeleteToMoveAndSkipCreate(cur.ID, next.ID, cur.FilePath, next.FilePath)
+		if err == nil {
+			cur.EventType = EventType_MOVE
+			cur.OldFilePath = cur.FilePath
+			cur.FilePath = next.FilePath
+		}
+	case ActionSkipNext:
+		err = st.MarkSkipped(next.ID)
+	case ActionSkipFirst:
+		err = st.MarkSkipped(cur.ID)
+	case ActionSkipBoth:
+		err = st.RewriteAndSkip(0, "", "", "", []int64{cur.ID, next.ID})
+	}
+	if err != nil {
+		plogger.Errorf("fix event %s[%v]+%s[%v] rule[%s] err[%v]",
+			cur.EventType, cur.ID, next.EventType, next.ID, r.Name, err)
+		return true
+	}
+	plogger.Debugf("fix event %s[%v]+%s[%v] rule[%s] action[%s]",
+		r.First, cur.ID, next.EventType, next.ID, r.Name, r.Action)
+	return r.Action != ActionSkipFirst && r.Action != ActionSkipBoth
+}
+
+// hashFile returns the hex sha256 of the file content.
+func hashFile(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
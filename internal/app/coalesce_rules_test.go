@@ -0,0 +1,164 @@
+package app
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+)
+
+// onlyRule returns a coalescer running just the named default rule.
+func onlyRule(t *testing.T, name string) *Coalescer {
+	t.Helper()
+	var custom []CoalesceRule
+	for _, r := range defaultCoalesceRules {
+		if r.Name != name {
+			custom = append(custom, CoalesceRule{Name: r.Name, Disabled: true})
+		}
+	}
+	c, err := NewCoalescer(CoalesceConfig{Rules: custom, TempPatterns: []string{}, ModifyQuietPeriod: -1})
+	if err != nil {
+		t.Fatalf("NewCoalescer: %v", err)
+	}
+	if len(c.rules) != 1 || c.rules[0].Name != name {
+		t.Fatalf("expected only rule %s, got %+v", name, c.rules)
+	}
+	return c
+}
+
+func openTestStorage(t *testing.T, path string) *Storage {
+	t.Helper()
+	_ = os.Remove(path)
+	st, err := OpenAndInit(path)
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	t.Cleanup(func() {
+		st.Close()
+		os.Remove(path)
+	})
+	return st
+}
+
+func TestCoalesceRuleDeleteCreateMove(t *testing.T) {
+	st := openTestStorage(t, "./test_rule_dcm.db")
+	ids := insertAt(t, st, time.Now().Add(-10*time.Second),
+		Event{EventType: EventType_DELETE, FilePath: `a\1.jpg`, Size: 7},
+		Event{EventType: EventType_CREATE, FilePath: `b\1.jpg`, Size: 7},
+		Event{EventType: EventType_DELETE, FilePath: `a\2.jpg`, Size: 7},
+		Event{EventType: EventType_CREATE, FilePath: `b\2.jpg`, Size: 8},
+	)
+
+	res, err := onlyRule(t, "delete_create_move").GetAndFixedPendingEvents(st)
+	if err != nil {
+		t.Fatalf("get fixed pending: %v", err)
+	}
+	if len(res) != 3 {
+		t.Fatalf("expected 3 events, got %+v", res)
+	}
+	if res[0].ID != ids[0] || res[0].EventType != EventType_MOVE || res[0].OldFilePath != `a\1.jpg` || res[0].FilePath != `b\1.jpg` {
+		t.Errorf("unexpected move %+v", res[0])
+	}
+	if res[1].ID != ids[2] || res[1].EventType != EventType_DELETE {
+		t.Errorf("size mismatch must not merge, got %+v", res[1])
+	}
+	if p := processedOf(t, st, ids[1]); p != 2 {
+		t.Errorf("expected create skipped, got processed=%d", p)
+	}
+}
+
+func TestCoalesceRuleRenameModify(t *testing.T) {
+	st := openTestStorage(t, "./test_rule_rm.db")
+	ids := insertAt(t, st, time.Now().Add(-10*time.Second),
+		Event{EventType: EventType_RENAME, OldFilePath: `a\1.jpg`, FilePath: `a\2.jpg`},
+		Event{EventType: EventType_MODIFY, FilePath: `a\3.jpg`},
+		Event{EventType: EventType_MODIFY, FilePath: `a\2.jpg`},
+	)
+
+	res, err := onlyRule(t, "rename_modify").GetAndFixedPendingEvents(st)
+	if err != nil {
+		t.Fatalf("get fixed pending: %v", err)
+	}
+	if len(res) != 2 || res[0].ID != ids[0] || res[1].ID != ids[1] {
+		t.Fatalf("expected rename and unrelated modify, got %+v", res)
+	}
+	if p := processedOf(t, st, ids[2]); p != 2 {
+		t.Errorf("expected modify skipped, got processed=%d", p)
+	}
+}
+
+func TestCoalesceRuleCreateModify(t *testing.T) {
+	st := openTestStorage(t, "./test_rule_cm.db")
+	ids := insertAt(t, st, time.Now().Add(-10*time.Second),
+		Event{EventType: EventType_CREATE, FilePath: `a\1.jpg`},
+		Event{EventType: EventType_MODIFY, FilePath: `a\1.jpg`},
+	)
+
+	res, err := onlyRule(t, "create_modify").GetAndFixedPendingEvents(st)
+	if err != nil {
+		t.Fatalf("get fixed pending: %v", err)
+	}
+	if len(res) != 1 || res[0].ID != ids[0] || res[0].EventType != EventType_CREATE {
+		t.Fatalf("expected single create, got %+v", res)
+	}
+	if p := processedOf(t, st, ids[1]); p != 2 {
+		t.Errorf("expected modify skipped, got processed=%d", p)
+	}
+}
+
+func TestCoalesceCustomRuleFromConfig(t *testing.T) {
+	var cfg Config
+	err := json.Unmarshal([]byte(`{"coalesce_rules": [
+		{"name": "create_modify", "disabled": true},
+		{"name": "modify_delete", "first": "MODIFY", "next": "DELETE", "match": ["same_path"], "window": "500ms", "action": "skip_first"}
+	]}`), &cfg)
+	if err != nil {
+		t.Fatalf("unmarshal config: %v", err)
+	}
+	c, err := NewCoalescer(CoalesceConfig{Rules: cfg.CoalesceRules})
+	if err != nil {
+		t.Fatalf("NewCoalescer: %v", err)
+	}
+	if len(c.rules) != 3 || c.rules[2].window(rangeInterval) != 500*time.Millisecond {
+		t.Fatalf("unexpected rules %+v", c.rules)
+	}
+
+	st := openTestStorage(t, "./test_rule_custom.db")
+	ids := insertAt(t, st, time.Now().Add(-10*time.Second),
+		Event{EventType: EventType_MODIFY, FilePath: `a\1.log`},
+		Event{EventType: EventType_DELETE, FilePath: `a\1.log`},
+		Event{EventType: EventType_MODIFY, FilePath: `a\2.log`},
+		// outside the 500ms window of the modify above
+		Event{EventType: EventType_DELETE, FilePath: `a\2.log`},
+	)
+	// move the last delete beyond the rule window
+	if _, err := st.db.Exec(`UPDATE file_events SET event_time = ? WHERE id = ?`,
+		formatStorageTime(time.Now().Add(-9*time.Second)), ids[3]); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := c.GetAndFixedPendingEvents(st)
+	if err != nil {
+		t.Fatalf("get fixed pending: %v", err)
+	}
+	if len(res) != 3 || res[0].ID != ids[1] || res[1].ID != ids[2] || res[2].ID != ids[3] {
+		t.Fatalf("expected first modify dropped only, got %+v", res)
+	}
+	if p := processedOf(t, st, ids[0]); p != 2 {
+		t.Errorf("expected modify skipped, got processed=%d", p)
+	}
+}
+
+func TestCoalesceRuleValidation(t *testing.T) {
+	bad := []CoalesceRule{
+		{Name: "x", First: "FOO", Next: EventType_CREATE, Action: ActionSkipNext},
+		{Name: "x", First: EventType_CREATE, Next: EventType_CREATE, Match: []string{"nope"}, Action: ActionSkipNext},
+		{Name: "x", First: EventType_CREATE, Next: EventType_CREATE, Action: "explode"},
+		{Name: "x", First: EventType_CREATE, Next: EventType_CREATE, Action: ActionSkipNext, Window: Duration(time.Minute)},
+	}
+	for _, r := range bad {
+		if _, err := NewCoalescer(CoalesceConfig{Rules: []CoalesceRule{r}}); err == nil {
+			t.Errorf("expected error for %+v", r)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Duration is a time.Duration written as a Go duration string ("10s", "1m")
+// in the config file.
+type Duration time.Duration
+
+// UnmarshalJSON accepts a duration string or a number of nanoseconds.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var v any
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	switch val := v.(type) {
+	case string:
+		p, err := time.ParseDuration(val)
+		if err != nil {
+			return fmt.Errorf("parse duration %q: %w", val, err)
+		}
+		*d = Duration(p)
+	case float64:
+		*d = Duration(time.Duration(val))
+	default:
+		return fmt.Errorf("invalid duration %s", string(b))
+	}
+	return nil
+}
+
+// UnmarshalText accepts a duration string, for YAML and TOML files.
+func (d *Duration) UnmarshalText(b []byte) error {
+	p, err := time.ParseDuration(string(b))
+	if err != nil {
+		return fmt.Errorf("parse duration %q: %w", string(b), err)
+	}
+	*d = Duration(p)
+	return nil
+}
+
+// Config mirrors the optional JSON file passed with -config. Every field is
+// optional; zero values keep the built-in defaults.
+type Config struct {
+	// EventTypeLocales limits the built-in event type tables to the given
+	// locales (e.g. "zh-CN", "en"). Empty means all built-in locales.
+	EventTypeLocales []string `json:"event_type_locales"`
+	// EventTypeAliases maps extra raw Directory Monitor labels to one of the
+	// normalized event types, e.g. {"Neu": "CREATE"}.
+	EventTypeAliases map[string]string `json:"event_type_aliases"`
+	// TimestampLayouts lists Go time layouts for the %date% %time% value.
+	TimestampLayouts []string `json:"timestamp_layouts"`
+	// TimestampZone is the IANA zone of the source timestamps, e.g. "Asia/Shanghai".
+	TimestampZone string `json:"timestamp_zone"`
+	// RulesFile is a gitignore style include/exclude rule file for the producer.
+	RulesFile string `json:"rules_file"`
+	// Roots lists watched roots with optional per-root rule files.
+	Roots []RuleRoot `json:"roots"`
+	// StabilityPeriod is how long a file's size and mtime must stay unchanged
+	// before the consumer runs a CREATE/MODIFY command. 0 disables the check.
+	StabilityPeriod Duration `json:"stability_period"`
+	// StabilityCheckOpen additionally requires that no other process holds
+	// the file open.
+	StabilityCheckOpen bool `json:"stability_check_open"`
+	// CoalesceRules replace default rules of the same name or add new ones.
+	CoalesceRules []CoalesceRule `json:"coalesce_rules"`
+	// TempPatterns replaces the built-in temporary file globs.
+	TempPatterns []string `json:"temp_patterns"`
+	// ModifyQuietPeriod is the debounce gap for MODIFY bursts; negative disables.
+	ModifyQuietPeriod Duration `json:"modify_quiet_period"`
+	// HashMoveLookback enables content-hash move detection, e.g. "24h".
+	HashMoveLookback Duration `json:"hash_move_lookback"`
+	// SettleDelay, FetchWindow, MatchWindow and PollInterval tune the
+	// consumer cycle, see Windows.
+	SettleDelay  Duration `json:"settle_delay"`
+	FetchWindow  Duration `json:"fetch_window"`
+	MatchWindow  Duration `json:"match_window"`
+	PollInterval Duration `json:"poll_interval"`
+	// PriorityRules assign event priorities; higher lanes are served first.
+	PriorityRules []PriorityRule `json:"priority_rules"`
+	// PriorityMaxWait is the starvation bound of low priority events.
+	PriorityMaxWait Duration `json:"priority_max_wait"`
+	// CatchUp processes the backlog window after window, see Options.CatchUp.
+	CatchUp bool `json:"catch_up"`
+	// CatchUpMaxEvents caps the events handled per catch-up cycle.
+	CatchUpMaxEvents int `json:"catch_up_max_events"`
+	// ExecMode is "split" (default) or "argv", see ExecMode.
+	ExecMode ExecMode `json:"exec_mode"`
+	// ExitCodes maps command exit codes to success/retry/failed/skip.
+	ExitCodes map[int]CmdStatus `json:"exit_codes"`
+	// AllowedCmdFileDirs and AllowedExecutables, see Options.
+	AllowedCmdFileDirs []string `json:"allowed_cmd_file_dirs"`
+	AllowedExecutables []string `json:"allowed_executables"`
+	// Sandbox confines command processes on Linux, see SandboxConfig.
+	Sandbox *SandboxConfig `json:"sandbox"`
+	// NoCommandPolicy maps event types or "*" to skip/fail/hold.
+	NoCommandPolicy map[string]NoCmdPolicy `json:"no_command_policy"`
+	// Wakeup enables event-driven wakeup of the consumer, see Options.Wakeup.
+	Wakeup bool `json:"wakeup"`
+}
+
+// LoadConfig reads and parses the JSON config file at path.
+func LoadConfig(path string) (*Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read config %s: %w", path, err)
+	}
+	var c Config
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("unmarshal config %s: %w", path, err)
+	}
+	return &c, nil
+}
+
+// Apply copies the configured values into options. Values already set on
+// options (typically from CLI flags) are left untouched.
+func (c *Config) Apply(o *Options) {
+	if c == nil {
+		return
+	}
+	if len(o.EventTypeLocales) == 0 {
+		o.EventTypeLocales = c.EventTypeLocales
+	}
+	if len(o.EventTypeAliases) == 0 {
+		o.EventTypeAliases = c.EventTypeAliases
+	}
+	if len(o.TimestampLayouts) == 0 {
+		o.TimestampLayouts = c.TimestampLayouts
+	}
+	if o.TimestampZone == "" {
+		o.TimestampZone = c.TimestampZone
+	}
+	if o.RulesFile == "" {
+		o.RulesFile = c.RulesFile
+	}
+	if len(o.RuleRoots) == 0 {
+		o.RuleRoots = c.Roots
+	}
+	if o.StabilityPeriod == 0 {
+		o.StabilityPeriod = time.Duration(c.StabilityPeriod)
+	}
+	if !o.StabilityCheckOpen {
+		o.StabilityCheckOpen = c.StabilityCheckOpen
+	}
+	if len(o.CoalesceRules) == 0 {
+		o.CoalesceRules = c.CoalesceRules
+	}
+	if o.TempPatterns == nil {
+		o.TempPatterns = c.TempPatterns
+	}
+	if o.ModifyQuietPeriod == 0 {
+		o.ModifyQuietPeriod = time.Duration(c.ModifyQuietPeriod)
+	}
+	if o.HashMoveLookback == 0 {
+		o.HashMoveLookback = time.Duration(c.HashMoveLookback)
+	}
+	if o.SettleDelay == 0 {
+		o.SettleDelay = time.Duration(c.SettleDelay)
+	}
+	if o.FetchWindow == 0 {
+		o.FetchWindow = time.Duration(c.FetchWindow)
+	}
+	if o.MatchWindow == 0 {
+		o.MatchWindow = time.Duration(c.MatchWindow)
+	}
+	if o.PollInterval == 0 {
+		o.PollInterval = time.Duration(c.PollInterval)
+	}
+	if len(o.PriorityRules) == 0 {
+		o.PriorityRules = c.PriorityRules
+	}
+	if o.PriorityMaxWait == 0 {
+		o.PriorityMaxWait = time.Duration(c.PriorityMaxWait)
+	}
+	if !o.CatchUp {
+		o.CatchUp = c.CatchUp
+	}
+	if o.CatchUpMaxEvents == 0 {
+		o.CatchUpMaxEvents = c.CatchUpMaxEvents
+	}
+	if o.ExecMode == "" {
+		o.ExecMode = c.ExecMode
+	}
+	if len(o.ExitCodes) == 0 {
+		o.ExitCodes = c.ExitCodes
+	}
+	if len(o.AllowedCmdFileDirs) == 0 {
+		o.AllowedCmdFileDirs = c.AllowedCmdFileDirs
+	}
+	if len(o.AllowedExecutables) == 0 {
+		o.AllowedExecutables = c.AllowedExecutables
+	}
+	if o.Sandbox == nil {
+		o.Sandbox = c.Sandbox
+	}
+	if len(o.NoCmdPolicy) == 0 {
+		o.NoCmdPolicy = c.NoCommandPolicy
+	}
+	if !o.Wakeup {
+		o.Wakeup = c.Wakeup
+	}
+}
@@ -0,0 +1,53 @@
+package app
+
+import (
+	"github.com/pancake-lee/pgo/pkg/plogger"
+)
+
+// 重命名/移动/删除顶层目录时，Directory Monitor 可能只发一个目录事件，
+// 也可能同时发出目录下每个文件的 DELETE+CREATE。目录事件作为一个整体处理，
+// 窗口内该目录下的逐文件事件被吸收（标记跳过）。
+// 没有 isdir 标记的 DELETE/RENAME/MOVE，如果窗口内存在其路径下的子事件，也推断为目录。
+
+// absorbDirEvents handles directory DELETE/RENAME/MOVE events and returns
+// the remaining events of all.
+func (c *Coalescer) absorbDirEvents(st *Storage, all []PendingEvent) []PendingEvent {
+	skipped := make(map[int64]bool)
+	for i := range all {
+		pe := &all[i]
+		if skipped[pe.ID] {
+			continue
+		}
+		var oldDir, newDir string
+		switch pe.EventType {
+		case EventType_DELETE:
+			oldDir = pe.FilePath
+		case EventType_RENAME, EventType_MOVE:
+			if pe.OldFilePath == "" {
+				continue
+			}
+			oldDir, newDir = pe.OldFilePath, pe.FilePath
+		default:
+			continue
+		}
+
+		isDir, absorbed, err := st.AbsorbDirEvents(pe.ID, pe.IsDir, oldDir, newDir, pe.EventTime, c.win.MatchWindow)
+		if err != nil {
+			plogger.Errorf("absorb dir event[%v] %v err[%v]", pe.ID, oldDir, err)
+			continue
+		}
+		if isDir && !pe.IsDir {
+			plogger.Debugf("infer dir event[%v] %v", pe.ID, oldDir)
+		}
+		pe.IsDir = isDir
+		if len(absorbed) == 0 {
+			continue
+		}
+		plogger.Debugf("absorb dir event[%v] %s %v->%v skip%v", pe.ID, pe.EventType, oldDir, newDir, absorbed)
+		for _, id := range absorbed {
+			skipped[id] = true
+		}
+	}
+
+	return dropSkipped(all, skipped)
+}
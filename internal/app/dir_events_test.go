@@ -0,0 +1,66 @@
+package app
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAbsorbDirRename(t *testing.T) {
+	st := openTestStorage(t, "./test_dir_rename.db")
+	ids := insertAt(t, st, time.Now().Add(-30*time.Second),
+		Event{EventType: EventType_DELETE, FilePath: `\\nas\share\old\1.jpg`, Size: 1},
+		Event{EventType: EventType_RENAME, OldFilePath: `\\nas\share\old`, FilePath: `\\nas\share\new`, IsDir: true},
+		Event{EventType: EventType_CREATE, FilePath: `\\nas\share\new\1.jpg`, Size: 1},
+		Event{EventType: EventType_DELETE, FilePath: `\\nas\share\old\sub\2.jpg`, Size: 2},
+		Event{EventType: EventType_CREATE, FilePath: `\\nas\share\new\sub\2.jpg`, Size: 2},
+		Event{EventType: EventType_CREATE, FilePath: `\\nas\share\newer\3.jpg`},
+	)
+
+	res, err := GetAndFixedPendingEvents(st)
+	if err != nil {
+		t.Fatalf("get fixed pending: %v", err)
+	}
+	if len(res) != 2 || res[0].ID != ids[1] || !res[0].IsDir || res[1].ID != ids[5] {
+		t.Fatalf("expected dir rename and unrelated create, got %+v", res)
+	}
+	for _, i := range []int{0, 2, 3, 4} {
+		if p := processedOf(t, st, ids[i]); p != 2 {
+			t.Errorf("expected row %d absorbed, got processed=%d", i, p)
+		}
+	}
+}
+
+func TestAbsorbInferredDirDelete(t *testing.T) {
+	st := openTestStorage(t, "./test_dir_delete.db")
+	ids := insertAt(t, st, time.Now().Add(-30*time.Second),
+		Event{EventType: EventType_DELETE, FilePath: `d/photos/1.jpg`},
+		Event{EventType: EventType_DELETE, FilePath: `d/photos/2.jpg`},
+		Event{EventType: EventType_DELETE, FilePath: `d/photos`},
+		Event{EventType: EventType_DELETE, FilePath: `d/photos2/1.jpg`},
+	)
+
+	res, err := GetAndFixedPendingEvents(st)
+	if err != nil {
+		t.Fatalf("get fixed pending: %v", err)
+	}
+	if len(res) != 2 || res[0].ID != ids[2] || !res[0].IsDir || res[1].ID != ids[3] || res[1].IsDir {
+		t.Fatalf("expected inferred dir delete and sibling file delete, got %+v", res)
+	}
+	got, err := st.GetEventByID(ids[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.IsDir {
+		t.Errorf("expected is_dir persisted")
+	}
+}
+
+func TestParseIsDirFlag(t *testing.T) {
+	event, err := ParseDirectoryMonitorPayload(`{"t":"2025/11/3 16:43:40", "e":"删除", "d":"d", "f":"d\\sub", "isdir":"true"}`)
+	if err != nil {
+		t.Fatalf("ParseDirectoryMonitorPayload() error = %v", err)
+	}
+	if !event.IsDir {
+		t.Errorf("expected IsDir from payload")
+	}
+}
@@ -35,15 +35,7 @@ type jsonPayload struct {
 	OldFile   string `json:"of"`
 	CmdFile   string `json:"cmd_file"`
 	Size      string `json:"s"`
-}
-
-var eventTypeMap = map[string]EventType{
-	"新增":   EventType_CREATE,
-	"创建":   EventType_CREATE,
-	"修改":   EventType_MODIFY,
-	"重命名":  EventType_RENAME,
-	"删除":   EventType_DELETE,
-	"MOVE": EventType_MOVE,
+	IsDir     string `json:"isdir"`
 }
 
 // --------------------------------------------------
@@ -58,6 +50,8 @@ const (
 	EventType_RENAME EventType = "RENAME"
 	EventType_MOVE   EventType = "MOVE"
 	EventType_DELETE EventType = "DELETE"
+	// UNKNOWN 表示无法识别的原始事件类型，原始标签保存在 RawEventType
+	EventType_UNKNOWN EventType = "UNKNOWN"
 )
 
 type Event struct {
@@ -69,11 +63,40 @@ type Event struct {
 	OldFilePath  string
 	CmdFile      string
 	Size         int64
+	// IsDir marks an event on a directory rather than a file.
+	IsDir bool
+	// Priority orders the consumer lanes, see PriorityRules.
+	Priority int
 }
 
 // --------------------------------------------------
-// ParseDirectoryMonitorPayload converts the raw JSON string argument into a structured Event.
+// PayloadParser converts Directory Monitor payloads using configured mappings.
+type PayloadParser struct {
+	types *EventTypeMapper
+	times *TimestampParser
+}
+
+// NewPayloadParser constructs a parser; nil arguments use the built-in
+// defaults (all locales, default layouts in the local zone).
+func NewPayloadParser(types *EventTypeMapper, times *TimestampParser) *PayloadParser {
+	if types == nil {
+		types = defaultEventTypeMapper
+	}
+	if times == nil {
+		times = defaultTimestampParser
+	}
+	return &PayloadParser{types: types, times: times}
+}
+
+// ParseDirectoryMonitorPayload converts the raw JSON string argument into a
+// structured Event using the built-in defaults.
 func ParseDirectoryMonitorPayload(raw string) (*Event, error) {
+	return NewPayloadParser(nil, nil).Parse(raw)
+}
+
+// Parse converts the raw JSON string argument into a structured Event.
+// Unrecognized event labels are kept as EventType_UNKNOWN instead of failing.
+func (p *PayloadParser) Parse(raw string) (*Event, error) {
 	trimmed := strings.TrimSpace(raw)
 	if trimmed == "" {
 		return nil, fmt.Errorf("empty Directory Monitor payload")
@@ -85,16 +108,15 @@ func ParseDirectoryMonitorPayload(raw string) (*Event, error) {
 		return nil, fmt.Errorf("unmarshal json: %w", err)
 	}
 
-	occurredAt, err := time.ParseInLocation(timestampLayout, payload.Timestamp, time.Local)
+	occurredAt, err := p.times.Parse(payload.Timestamp)
 	if err != nil {
 		plogger.Errorf("failed to parse timestamp %q: %v", payload.Timestamp, err)
 		return nil, fmt.Errorf("parse timestamp %q: %w", payload.Timestamp, err)
 	}
 
-	normalizedType, ok := eventTypeMap[payload.EventType]
-	if !ok {
-		plogger.Errorf("unmapped event type %q, using uppercase version %q", payload.EventType, normalizedType)
-		return nil, fmt.Errorf("unmapped event type %q", payload.EventType)
+	normalizedType := p.types.Map(payload.EventType)
+	if normalizedType == EventType_UNKNOWN {
+		plogger.Errorf("unmapped event type %q, storing as %s", payload.EventType, EventType_UNKNOWN)
 	}
 
 	event := Event{
@@ -106,7 +128,17 @@ func ParseDirectoryMonitorPayload(raw string) (*Event, error) {
 		OldFilePath:  payload.OldFile,
 		CmdFile:      payload.CmdFile,
 		Size:         putil.StrToInt64WithDefault(payload.Size, 0),
+		IsDir:        parseBoolFlag(payload.IsDir),
 	}
 
 	return &event, nil
 }
+
+// parseBoolFlag accepts "1", "true", "yes" (any case) as true.
+func parseBoolFlag(s string) bool {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "1", "true", "yes":
+		return true
+	}
+	return false
+}
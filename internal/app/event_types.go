@@ -0,0 +1,141 @@
+package app
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Directory Monitor 的 %event% 会随界面语言变化，这里按语言内置别名表，
+// 用户也可以在配置里补充自定义别名。
+
+// builtinEventTypeTables holds the raw %event% labels per Directory Monitor
+// locale. Keys are matched case-insensitively.
+var builtinEventTypeTables = map[string]map[string]EventType{
+	"zh-CN": {
+		"新增":  EventType_CREATE,
+		"创建":  EventType_CREATE,
+		"修改":  EventType_MODIFY,
+		"重命名": EventType_RENAME,
+		"删除":  EventType_DELETE,
+	},
+	"zh-TW": {
+		"新增":   EventType_CREATE,
+		"建立":   EventType_CREATE,
+		"修改":   EventType_MODIFY,
+		"變更":   EventType_MODIFY,
+		"重新命名": EventType_RENAME,
+		"刪除":   EventType_DELETE,
+	},
+	"en": {
+		"new":      EventType_CREATE,
+		"added":    EventType_CREATE,
+		"created":  EventType_CREATE,
+		"change":   EventType_MODIFY,
+		"changed":  EventType_MODIFY,
+		"modified": EventType_MODIFY,
+		"rename":   EventType_RENAME,
+		"renamed":  EventType_RENAME,
+		"delete":   EventType_DELETE,
+		"deleted":  EventType_DELETE,
+		"removed":  EventType_DELETE,
+	},
+	"de": {
+		"neu":         EventType_CREATE,
+		"hinzugefügt": EventType_CREATE,
+		"erstellt":    EventType_CREATE,
+		"geändert":    EventType_MODIFY,
+		"änderung":    EventType_MODIFY,
+		"umbenannt":   EventType_RENAME,
+		"umbenennen":  EventType_RENAME,
+		"gelöscht":    EventType_DELETE,
+		"löschen":     EventType_DELETE,
+		"entfernt":    EventType_DELETE,
+	},
+	"fr": {
+		"nouveau":  EventType_CREATE,
+		"ajouté":   EventType_CREATE,
+		"créé":     EventType_CREATE,
+		"modifié":  EventType_MODIFY,
+		"renommé":  EventType_RENAME,
+		"supprimé": EventType_DELETE,
+	},
+	"ja": {
+		"新規":    EventType_CREATE,
+		"追加":    EventType_CREATE,
+		"作成":    EventType_CREATE,
+		"変更":    EventType_MODIFY,
+		"名前の変更": EventType_RENAME,
+		"名前変更":  EventType_RENAME,
+		"削除":    EventType_DELETE,
+	},
+}
+
+// EventTypeMapper normalizes raw Directory Monitor event labels.
+type EventTypeMapper struct {
+	aliases map[string]EventType
+}
+
+// NewEventTypeMapper builds a mapper from the built-in tables of the given
+// locales (all locales when empty) plus custom aliases. Custom aliases win
+// over built-in ones and must target a known EventType.
+func NewEventTypeMapper(locales []string, custom map[string]string) (*EventTypeMapper, error) {
+	m := &EventTypeMapper{aliases: make(map[string]EventType)}
+
+	if len(locales) == 0 {
+		for l := range builtinEventTypeTables {
+			locales = append(locales, l)
+		}
+		sort.Strings(locales)
+	}
+	for _, l := range locales {
+		table, ok := builtinEventTypeTables[l]
+		if !ok {
+			return nil, fmt.Errorf("unknown event type locale %q", l)
+		}
+		for raw, ev := range table {
+			m.aliases[strings.ToLower(raw)] = ev
+		}
+	}
+
+	// 保留旧的内部名称，MOVE 没有对应的 Directory Monitor 标签
+	for _, ev := range knownEventTypes {
+		m.aliases[strings.ToLower(string(ev))] = ev
+	}
+
+	for raw, target := range custom {
+		ev := EventType(strings.ToUpper(strings.TrimSpace(target)))
+		if !isKnownEventType(ev) {
+			return nil, fmt.Errorf("alias %q maps to unknown event type %q", raw, target)
+		}
+		m.aliases[strings.ToLower(strings.TrimSpace(raw))] = ev
+	}
+	return m, nil
+}
+
+// Map returns the normalized EventType for raw, or EventType_UNKNOWN.
+func (m *EventTypeMapper) Map(raw string) EventType {
+	if ev, ok := m.aliases[strings.ToLower(strings.TrimSpace(raw))]; ok {
+		return ev
+	}
+	return EventType_UNKNOWN
+}
+
+var knownEventTypes = []EventType{
+	EventType_CREATE,
+	EventType_MODIFY,
+	EventType_RENAME,
+	EventType_MOVE,
+	EventType_DELETE,
+}
+
+func isKnownEventType(ev EventType) bool {
+	for _, k := range knownEventTypes {
+		if k == ev {
+			return true
+		}
+	}
+	return false
+}
+
+var defaultEventTypeMapper, _ = NewEventTypeMapper(nil, nil)
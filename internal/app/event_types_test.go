@@ -0,0 +1,59 @@
+package app
+
+import "testing"
+
+func TestEventTypeMapperBuiltinLocales(t *testing.T) {
+	m, err := NewEventTypeMapper(nil, nil)
+	if err != nil {
+		t.Fatalf("NewEventTypeMapper: %v", err)
+	}
+	cases := map[string]EventType{
+		"新增":        EventType_CREATE,
+		"删除":        EventType_DELETE,
+		"Renamed":   EventType_RENAME,
+		"DELETED":   EventType_DELETE,
+		"Geändert":  EventType_MODIFY,
+		"名前の変更":     EventType_RENAME,
+		"MOVE":      EventType_MOVE,
+		"something": EventType_UNKNOWN,
+	}
+	for raw, want := range cases {
+		if got := m.Map(raw); got != want {
+			t.Errorf("Map(%q) = %q, want %q", raw, got, want)
+		}
+	}
+}
+
+func TestEventTypeMapperLocalesAndAliases(t *testing.T) {
+	m, err := NewEventTypeMapper([]string{"en"}, map[string]string{"Neu": "create"})
+	if err != nil {
+		t.Fatalf("NewEventTypeMapper: %v", err)
+	}
+	if got := m.Map("新增"); got != EventType_UNKNOWN {
+		t.Errorf("expected zh label unmapped when only en is selected, got %q", got)
+	}
+	if got := m.Map("neu"); got != EventType_CREATE {
+		t.Errorf("expected custom alias to map to CREATE, got %q", got)
+	}
+
+	if _, err := NewEventTypeMapper([]string{"xx"}, nil); err == nil {
+		t.Errorf("expected error for unknown locale")
+	}
+	if _, err := NewEventTypeMapper(nil, map[string]string{"foo": "BAR"}); err == nil {
+		t.Errorf("expected error for alias to unknown event type")
+	}
+}
+
+func TestParseUnknownEventTypeKeepsRaw(t *testing.T) {
+	const payload = `{"t":"2025/11/3 16:43:40", "e":"Verschoben", "d":"d", "f":"d\\1.jpg"}`
+	event, err := ParseDirectoryMonitorPayload(payload)
+	if err != nil {
+		t.Fatalf("ParseDirectoryMonitorPayload() error = %v", err)
+	}
+	if event.EventType != EventType_UNKNOWN {
+		t.Errorf("expected UNKNOWN, got %q", event.EventType)
+	}
+	if event.RawEventType != "Verschoben" {
+		t.Errorf("expected raw label kept, got %q", event.RawEventType)
+	}
+}
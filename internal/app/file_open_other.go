@@ -0,0 +1,33 @@
+//go:build !windows
+
+package app
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// isFileOpenElsewhere scans /proc/*/fd for a descriptor pointing at path.
+// Without /proc (non-Linux) it cannot tell and reports false.
+func isFileOpenElsewhere(path string) (bool, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return false, err
+	}
+	fds, err := filepath.Glob("/proc/[0-9]*/fd/*")
+	if err != nil || len(fds) == 0 {
+		return false, nil
+	}
+	self := "/proc/" + strconv.Itoa(os.Getpid()) + "/"
+	for _, fd := range fds {
+		if strings.HasPrefix(fd, self) {
+			continue
+		}
+		if target, err := os.Readlink(fd); err == nil && target == abs {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,34 @@
+//go:build windows
+
+package app
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// errorSharingViolation is ERROR_SHARING_VIOLATION, not exported by syscall.
+const errorSharingViolation syscall.Errno = 32
+
+// isFileOpenElsewhere opens the file without any sharing; Windows refuses
+// with ERROR_SHARING_VIOLATION while another process still holds a handle.
+func isFileOpenElsewhere(path string) (bool, error) {
+	p, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return false, err
+	}
+	h, err := syscall.CreateFile(p, syscall.GENERIC_READ, 0, nil,
+		syscall.OPEN_EXISTING, syscall.FILE_ATTRIBUTE_NORMAL, 0)
+	if err != nil {
+		if errors.Is(err, errorSharingViolation) {
+			return true, nil
+		}
+		if errors.Is(err, syscall.ERROR_FILE_NOT_FOUND) || errors.Is(err, syscall.ERROR_PATH_NOT_FOUND) {
+			return false, nil
+		}
+		return false, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	syscall.CloseHandle(h)
+	return false, nil
+}
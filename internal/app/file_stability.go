@@ -0,0 +1,95 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// errFileUnstable marks an event deferred because its file is still being
+// written. It is not a failure: the event stays pending and is retried on a
+// later cycle.
+var errFileUnstable = errors.New("file still being written")
+
+type fileObservation struct {
+	size    int64
+	modTime time.Time
+	seenAt  time.Time
+}
+
+// StabilityChecker decides whether a file has been quiet long enough to be
+// processed. A file is stable once its size and mtime have not changed
+// across period, measured between consumer cycles so the loop never sleeps.
+type StabilityChecker struct {
+	period    time.Duration
+	checkOpen bool
+	now       func() time.Time
+
+	mu  sync.Mutex
+	obs map[string]fileObservation
+}
+
+// NewStabilityChecker constructs a checker; period <= 0 disables the check.
+// With checkOpen the file must also not be held open by another process.
+func NewStabilityChecker(period time.Duration, checkOpen bool) *StabilityChecker {
+	return &StabilityChecker{
+		period:    period,
+		checkOpen: checkOpen,
+		now:       time.Now,
+		obs:       make(map[string]fileObservation),
+	}
+}
+
+// Check returns nil when pe may be processed now, or an error wrapping
+// errFileUnstable when it should be deferred. Only file CREATE and MODIFY
+// are checked; a missing file is reported stable and left to the command.
+func (c *StabilityChecker) Check(pe PendingEvent) error {
+	if c == nil || c.period <= 0 {
+		return nil
+	}
+	if pe.IsDir || (pe.EventType != EventType_CREATE && pe.EventType != EventType_MODIFY) {
+		return nil
+	}
+
+	fi, err := os.Stat(pe.FilePath)
+	if err != nil {
+		c.forget(pe.FilePath)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("stat %s: %w", pe.FilePath, err)
+	}
+
+	now := c.now()
+	c.mu.Lock()
+	prev, ok := c.obs[pe.FilePath]
+	if !ok || prev.size != fi.Size() || !prev.modTime.Equal(fi.ModTime()) {
+		c.obs[pe.FilePath] = fileObservation{size: fi.Size(), modTime: fi.ModTime(), seenAt: now}
+		c.mu.Unlock()
+		return fmt.Errorf("%w: %s size=%d changed or first seen", errFileUnstable, pe.FilePath, fi.Size())
+	}
+	c.mu.Unlock()
+
+	if quiet := now.Sub(prev.seenAt); quiet < c.period {
+		return fmt.Errorf("%w: %s quiet for %v of %v", errFileUnstable, pe.FilePath, quiet, c.period)
+	}
+	if c.checkOpen {
+		open, err := isFileOpenElsewhere(pe.FilePath)
+		if err != nil {
+			return fmt.Errorf("check open handles %s: %w", pe.FilePath, err)
+		}
+		if open {
+			return fmt.Errorf("%w: %s is open in another process", errFileUnstable, pe.FilePath)
+		}
+	}
+	c.forget(pe.FilePath)
+	return nil
+}
+
+func (c *StabilityChecker) forget(path string) {
+	c.mu.Lock()
+	delete(c.obs, path)
+	c.mu.Unlock()
+}
@@ -0,0 +1,91 @@
+package app
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStabilityChecker(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "video.mp4")
+	if err := os.WriteFile(path, []byte("part"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	c := NewStabilityChecker(10*time.Second, false)
+	c.now = func() time.Time { return now }
+	pe := PendingEvent{ID: 1, Event: Event{EventType: EventType_CREATE, FilePath: path}}
+
+	// first sighting always defers
+	if err := c.Check(pe); !errors.Is(err, errFileUnstable) {
+		t.Fatalf("expected unstable on first check, got %v", err)
+	}
+
+	// still growing
+	now = now.Add(11 * time.Second)
+	if err := os.WriteFile(path, []byte("partial content"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Check(pe); !errors.Is(err, errFileUnstable) {
+		t.Fatalf("expected unstable after size change, got %v", err)
+	}
+
+	// unchanged but not for long enough
+	now = now.Add(5 * time.Second)
+	if err := c.Check(pe); !errors.Is(err, errFileUnstable) {
+		t.Fatalf("expected unstable before period elapsed, got %v", err)
+	}
+
+	now = now.Add(6 * time.Second)
+	if err := c.Check(pe); err != nil {
+		t.Fatalf("expected stable, got %v", err)
+	}
+
+	// other event types and missing files are never deferred
+	if err := c.Check(PendingEvent{Event: Event{EventType: EventType_DELETE, FilePath: path}}); err != nil {
+		t.Fatalf("expected DELETE not checked, got %v", err)
+	}
+	if err := c.Check(PendingEvent{Event: Event{EventType: EventType_MODIFY, FilePath: path + ".gone"}}); err != nil {
+		t.Fatalf("expected missing file reported stable, got %v", err)
+	}
+	if err := NewStabilityChecker(0, true).Check(pe); err != nil {
+		t.Fatalf("expected disabled checker to pass, got %v", err)
+	}
+}
+
+func TestUnstableFileDoesNotStallOtherPaths(t *testing.T) {
+	st := openTestStorage(t, "./test_unstable.db")
+	path := filepath.Join(t.TempDir(), "big.iso")
+	if err := os.WriteFile(path, []byte("copying"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	base := time.Now().Add(-time.Minute)
+	copying := insertAt(t, st, base, Event{EventType: EventType_CREATE, FilePath: path})[0]
+	other := insertAt(t, st, base.Add(30*time.Second), Event{EventType: EventType_DELETE, FilePath: `d\other.txt`})[0]
+
+	c, err := NewCoalescer(CoalesceConfig{})
+	if err != nil {
+		t.Fatalf("NewCoalescer: %v", err)
+	}
+	a := New(Options{Mode: ModeConsumer, Cmd: "true", CatchUp: true})
+	a.stability = NewStabilityChecker(time.Hour, false)
+	a.runCycle(st, c, NewCmdFileManager(0))
+
+	if got := processedOf(t, st, other); got != 1 {
+		t.Errorf("expected the other path processed, got processed %d", got)
+	}
+	var (
+		attempts int
+		next     string
+	)
+	row := st.db.QueryRow("SELECT COALESCE(attempts, 0), next_attempt_at FROM file_events WHERE id = ?", copying)
+	if err := row.Scan(&attempts, &next); err != nil || attempts != 0 || next == "" {
+		t.Errorf("expected the copying file parked without attempts, got attempts %d next %q err %v", attempts, next, err)
+	}
+	if got := processedOf(t, st, copying); got != 0 {
+		t.Errorf("expected the copying file pending, got processed %d", got)
+	}
+}
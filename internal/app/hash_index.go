@@ -0,0 +1,102 @@
+package app
+
+import (
+	"time"
+
+	"github.com/pancake-lee/pgo/pkg/plogger"
+)
+
+// "剪切后一小时再粘贴"或者"移动并重命名"无法在 rangeInterval 内按文件名配对，
+// 会变成完整的重新上传。这里记录目标端文件的内容哈希：
+//   - CREATE/MODIFY 成功后记录文件哈希
+//   - RENAME/MOVE 成功后更新路径
+//   - DELETE 成功后把哈希移入"最近删除"，保留 lookback 时长
+// 新的 CREATE 如果与最近删除的文件内容相同，改写为从被删除路径的 MOVE（由命令在服务端完成移动）。
+// 删除命令通常已经删掉了目标端的旧文件，这时 MOVE 会失败：事件改回 CREATE 重新上传，
+// 失败的 MOVE 计一次尝试，之后的尝试不再按哈希改写。
+
+// HashIndex tracks content hashes of files at the destination.
+type HashIndex struct {
+	st       *Storage
+	lookback time.Duration
+	now      func() time.Time
+}
+
+// NewHashIndex returns nil (disabled) when lookback <= 0.
+func NewHashIndex(st *Storage, lookback time.Duration) *HashIndex {
+	if lookback <= 0 {
+		return nil
+	}
+	return &HashIndex{st: st, lookback: lookback, now: time.Now}
+}
+
+// BeforeProcess hashes the file of a CREATE and, when it matches a file
+// deleted within the lookback, rewrites pe (in the DB and in memory) into a
+// MOVE from the deleted path. Only first attempts are rewritten. It returns
+// the content hash, "" if not hashed.
+func (h *HashIndex) BeforeProcess(pe *PendingEvent) string {
+	if h == nil || pe.IsDir || pe.EventType != EventType_CREATE || pe.Attempts > 0 {
+		return ""
+	}
+	hash, err := hashFile(pe.FilePath)
+	if err != nil {
+		plogger.Debugf("hash %s: %v", pe.FilePath, err)
+		return ""
+	}
+	oldPath, err := h.st.ConvertCreateToHashMove(pe.ID, hash, h.now().Add(-h.lookback))
+	if err != nil {
+		plogger.Errorf("hash move lookup id=%d: %v", pe.ID, err)
+		return hash
+	}
+	if oldPath != "" {
+		plogger.Debugf("fix event CREATE[%v] -> MOVE from %v by content hash", pe.ID, oldPath)
+		pe.EventType = EventType_MOVE
+		pe.OldFilePath = oldPath
+	}
+	return hash
+}
+
+// RevertMove turns pe back into a pending CREATE if BeforeProcess rewrote
+// it into a MOVE (hash is its return value), so that a failed move is
+// uploaded instead. It reports whether pe was reverted.
+func (h *HashIndex) RevertMove(pe PendingEvent, hash, message string) bool {
+	if h == nil || hash == "" || pe.EventType != EventType_MOVE {
+		return false
+	}
+	if err := h.st.RevertHashMove(pe.ID, message); err != nil {
+		plogger.Errorf("revert hash move id=%d: %v", pe.ID, err)
+	}
+	return true
+}
+
+// AfterProcess updates the index once pe was processed successfully; hash
+// is the value returned by BeforeProcess.
+func (h *HashIndex) AfterProcess(pe PendingEvent, hash string) {
+	if h == nil || pe.IsDir {
+		return
+	}
+	var err error
+	switch pe.EventType {
+	case EventType_CREATE, EventType_MODIFY:
+		if hash == "" {
+			if hash, err = hashFile(pe.FilePath); err != nil {
+				plogger.Debugf("hash %s: %v", pe.FilePath, err)
+				return
+			}
+		}
+		err = h.st.RecordFileHash(pe.FilePath, hash, pe.Size)
+	case EventType_MOVE, EventType_RENAME:
+		if hash != "" {
+			// a CREATE converted by content hash: the old entry is already gone
+			err = h.st.RecordFileHash(pe.FilePath, hash, pe.Size)
+		} else {
+			err = h.st.RenameFileHash(pe.OldFilePath, pe.FilePath)
+		}
+	case EventType_DELETE:
+		now := h.now()
+		err = h.st.RecordDeletedHash(pe.FilePath, now, now.Add(-h.lookback))
+	}
+	if err != nil {
+		plogger.Errorf("update hash index id=%d: %v", pe.ID, err)
+	}
+}
@@ -0,0 +1,151 @@
+package app
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func pendingOf(t *testing.T, st *Storage, id int64) *PendingEvent {
+	t.Helper()
+	ev, err := st.GetEventByID(id)
+	if err != nil {
+		t.Fatalf("get event %d: %v", id, err)
+	}
+	return &PendingEvent{ID: id, Event: ev}
+}
+
+func TestHashIndexDetectsMove(t *testing.T) {
+	st := openTestStorage(t, "./test_hash_index.db")
+	dir := t.TempDir()
+	oldPath := filepath.Join(dir, "a", "photo.jpg")
+	newPath := filepath.Join(dir, "b", "renamed.jpg")
+	for _, p := range []string{oldPath, newPath} {
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte("same content"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now := time.Now()
+	h := NewHashIndex(st, 24*time.Hour)
+	h.now = func() time.Time { return now }
+
+	// original upload, then a delete processed long before the new copy shows up
+	ids := insertAt(t, st, now.Add(-time.Hour),
+		Event{EventType: EventType_CREATE, FilePath: oldPath},
+		Event{EventType: EventType_DELETE, FilePath: oldPath},
+		Event{EventType: EventType_CREATE, FilePath: newPath},
+	)
+	for _, id := range ids[:2] {
+		pe := pendingOf(t, st, id)
+		h.AfterProcess(*pe, h.BeforeProcess(pe))
+	}
+
+	now = now.Add(time.Hour)
+	pe := pendingOf(t, st, ids[2])
+	hash := h.BeforeProcess(pe)
+	if pe.EventType != EventType_MOVE || pe.OldFilePath != oldPath || pe.FilePath != newPath {
+		t.Fatalf("expected MOVE from %s, got %+v", oldPath, pe)
+	}
+	got, err := st.GetEventByID(ids[2])
+	if err != nil {
+		t.Fatalf("get event: %v", err)
+	}
+	if got.EventType != EventType_MOVE || got.OldFilePath != oldPath {
+		t.Errorf("expected rewrite persisted, got %+v", got)
+	}
+	h.AfterProcess(*pe, hash)
+
+	// the deleted entry is consumed; a second copy stays a CREATE
+	again := &PendingEvent{ID: ids[2], Event: Event{EventType: EventType_CREATE, FilePath: newPath}}
+	h.BeforeProcess(again)
+	if again.EventType != EventType_CREATE {
+		t.Errorf("expected deleted hash consumed, got %+v", again)
+	}
+}
+
+func TestHashIndexLookback(t *testing.T) {
+	st := openTestStorage(t, "./test_hash_lookback.db")
+	path := filepath.Join(t.TempDir(), "doc.pdf")
+	if err := os.WriteFile(path, []byte("pdf"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	h := NewHashIndex(st, time.Hour)
+	h.now = func() time.Time { return now }
+
+	hash, err := hashFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.RecordFileHash(`old\doc.pdf`, hash, 3); err != nil {
+		t.Fatal(err)
+	}
+	h.AfterProcess(PendingEvent{Event: Event{EventType: EventType_DELETE, FilePath: `old\doc.pdf`}}, "")
+
+	now = now.Add(2 * time.Hour)
+	ids := insertAt(t, st, now.Add(-10*time.Second), Event{EventType: EventType_CREATE, FilePath: path})
+	pe := pendingOf(t, st, ids[0])
+	h.BeforeProcess(pe)
+	if pe.EventType != EventType_CREATE {
+		t.Errorf("expected delete beyond lookback ignored, got %+v", pe)
+	}
+
+	if NewHashIndex(st, 0) != nil {
+		t.Errorf("expected lookback 0 to disable the index")
+	}
+}
+
+func TestHashMoveFailureUploads(t *testing.T) {
+	st := openTestStorage(t, "./test_hash_move_fail.db")
+	dir := t.TempDir()
+	path := filepath.Join(dir, "copy.jpg")
+	if err := os.WriteFile(path, []byte("same content"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := hashFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.RecordFileHash(`old\photo.jpg`, hash, 12); err != nil {
+		t.Fatal(err)
+	}
+
+	a := New(Options{Mode: ModeConsumer})
+	a.hashIndex = NewHashIndex(st, time.Hour)
+	// the delete command really removed the old file, so the move fails
+	a.hashIndex.AfterProcess(PendingEvent{Event: Event{EventType: EventType_DELETE, FilePath: `old\photo.jpg`}}, "")
+	script := filepath.Join(dir, "sync.sh")
+	runs := filepath.Join(dir, "runs.txt")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\necho \"$1\" >> "+runs+"\n[ \"$1\" != MOVE ]\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	a.options.Cmd = script + " %event_type%"
+
+	ids := insertAt(t, st, time.Now().Add(-time.Minute), Event{EventType: EventType_CREATE, FilePath: path})
+	if err := a.processPendingEvent(st, *pendingOf(t, st, ids[0]), NewCmdFileManager(0)); err == nil {
+		t.Fatal("expected the failed move to keep the event pending")
+	}
+	pe := pendingOf(t, st, ids[0])
+	if pe.EventType != EventType_CREATE || pe.OldFilePath != "" || processedOf(t, st, ids[0]) != 0 {
+		t.Fatalf("expected a pending CREATE after the failed move, got %+v", pe)
+	}
+	if err := a.processPendingEvent(st, *pe, NewCmdFileManager(0)); err != nil {
+		t.Fatalf("process: %v", err)
+	}
+	if got := processedOf(t, st, ids[0]); got != 1 {
+		t.Errorf("expected the file uploaded, got processed %d", got)
+	}
+	b, err := os.ReadFile(runs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "MOVE\nCREATE\n" {
+		t.Errorf("expected MOVE then CREATE runs, got %q", b)
+	}
+}
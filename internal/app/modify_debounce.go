@@ -0,0 +1,63 @@
+package app
+
+import (
+	"time"
+
+	"github.com/pancake-lee/pgo/pkg/plogger"
+)
+
+// 数据库、虚拟机磁盘、日志等文件会在短时间内产生大量 MODIFY，
+// 同一路径上间隔不超过 modifyQuiet 的连续 MODIFY 只保留最后一个。
+// 最后一个可能还不在本次窗口内（甚至还没过 cutoff），那么本轮该路径不处理，
+// 等它变为可处理时再执行一次。
+// 保留的 MODIFY 之后 modifyQuiet 内还可能有新的 MODIFY，所以它要推迟到
+// 静默期结束才执行；推迟期间同一路径后面的事件也不会被读取，新来的 MODIFY
+// 会在下一次合并时接上这一串，重新开始计算静默期。
+
+// debounceModify collapses MODIFY bursts per path and returns the remaining
+// events of all. A path whose latest MODIFY is younger than modifyQuiet is
+// deferred until the quiet period has passed.
+func (c *Coalescer) debounceModify(st *Storage, all []PendingEvent) []PendingEvent {
+	if c.modifyQuiet < 0 {
+		return all
+	}
+
+	done := make(map[string]bool)
+	skipped := make(map[int64]bool)
+	var waiting []string
+	for _, pe := range all {
+		if pe.EventType != EventType_MODIFY || done[pe.FilePath] || skipped[pe.ID] {
+			continue
+		}
+		done[pe.FilePath] = true
+
+		keptID, keptAt, skipIDs, err := st.CollapseModifyBurst(pe.FilePath, pe.EventTime, c.modifyQuiet)
+		if err != nil {
+			plogger.Errorf("debounce MODIFY file[%v] err[%v]", pe.FilePath, err)
+			continue
+		}
+		if len(skipIDs) > 0 {
+			plogger.Debugf("debounce MODIFY file[%v] keep[%v] skip%v", pe.FilePath, keptID, skipIDs)
+			for _, id := range skipIDs {
+				skipped[id] = true
+			}
+		}
+		if until := keptAt.Add(c.modifyQuiet); keptID != 0 && time.Now().Before(until) {
+			if err := st.DeferEvent(keptID, until); err != nil {
+				plogger.Errorf("debounce MODIFY file[%v] defer err[%v]", pe.FilePath, err)
+			}
+			plogger.Debugf("debounce MODIFY file[%v] wait for quiet until %v", pe.FilePath, until)
+			waiting = append(waiting, pe.FilePath)
+		}
+	}
+
+	// the rest of a waiting path runs after its MODIFY
+	for _, p := range waiting {
+		for _, pe := range all {
+			if pe.FilePath == p || pe.OldFilePath == p {
+				skipped[pe.ID] = true
+			}
+		}
+	}
+	return dropSkipped(all, skipped)
+}
@@ -0,0 +1,113 @@
+package app
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDebounceModifyBurst(t *testing.T) {
+	st := openTestStorage(t, "./test_debounce.db")
+	base := time.Now().Add(-20 * time.Second)
+	ids := insertAt(t, st, base,
+		Event{EventType: EventType_MODIFY, FilePath: `d\vm.vhdx`},
+		Event{EventType: EventType_MODIFY, FilePath: `d\other.log`},
+		Event{EventType: EventType_MODIFY, FilePath: `d\vm.vhdx`},
+		Event{EventType: EventType_MODIFY, FilePath: `d\vm.vhdx`},
+	)
+	// the burst continues through a row 0.9s after the previous one; a row
+	// after a long gap starts a new burst
+	late := Event{EventType: EventType_MODIFY, FilePath: `d\vm.vhdx`, EventTime: base.Add(1200 * time.Millisecond)}
+	lateID, err := st.InsertEvent(&late)
+	if err != nil {
+		t.Fatal(err)
+	}
+	far := Event{EventType: EventType_MODIFY, FilePath: `d\vm.vhdx`, EventTime: base.Add(15 * time.Second)}
+	farID, err := st.InsertEvent(&far)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := NewCoalescer(CoalesceConfig{ModifyQuietPeriod: time.Second})
+	if err != nil {
+		t.Fatalf("NewCoalescer: %v", err)
+	}
+	res, err := c.GetAndFixedPendingEvents(st)
+	if err != nil {
+		t.Fatalf("get fixed pending: %v", err)
+	}
+	if len(res) != 2 || res[0].ID != ids[1] || res[1].ID != lateID {
+		t.Fatalf("expected other.log and the latest vm.vhdx modify, got %+v", res)
+	}
+	for _, id := range []int64{ids[0], ids[2], ids[3]} {
+		if p := processedOf(t, st, id); p != 2 {
+			t.Errorf("expected id %d skipped, got processed=%d", id, p)
+		}
+	}
+	if p := processedOf(t, st, farID); p != 0 {
+		t.Errorf("expected separate burst left pending, got processed=%d", p)
+	}
+}
+
+func TestDebounceModifyStopsAtOtherEvent(t *testing.T) {
+	st := openTestStorage(t, "./test_debounce2.db")
+	ids := insertAt(t, st, time.Now().Add(-20*time.Second),
+		Event{EventType: EventType_MODIFY, FilePath: `d\a.txt`},
+		Event{EventType: EventType_RENAME, OldFilePath: `d\a.txt`, FilePath: `d\b.txt`},
+		Event{EventType: EventType_MODIFY, FilePath: `d\a.txt`},
+	)
+	c, err := NewCoalescer(CoalesceConfig{Rules: []CoalesceRule{{Name: "rename_modify", Disabled: true}}})
+	if err != nil {
+		t.Fatalf("NewCoalescer: %v", err)
+	}
+	res, err := c.GetAndFixedPendingEvents(st)
+	if err != nil {
+		t.Fatalf("get fixed pending: %v", err)
+	}
+	if len(res) != 3 || res[0].ID != ids[0] {
+		t.Fatalf("expected nothing collapsed across a rename, got %+v", res)
+	}
+}
+
+func TestDebounceModifyWaitsForQuiet(t *testing.T) {
+	st := openTestStorage(t, "./test_debounce3.db")
+	dir := t.TempDir()
+	runs := filepath.Join(dir, "runs.txt")
+	script := filepath.Join(dir, "sync.sh")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\necho \"$1\" >> "+runs+"\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewCoalescer(CoalesceConfig{ModifyQuietPeriod: time.Minute})
+	if err != nil {
+		t.Fatalf("NewCoalescer: %v", err)
+	}
+	a := New(Options{Mode: ModeConsumer, Cmd: script + " %file_path%"})
+	now := time.Now()
+
+	// still inside the quiet period: parked, no command
+	first := insertAt(t, st, now.Add(-50*time.Second), Event{EventType: EventType_MODIFY, FilePath: `d\vm.vhdx`})[0]
+	a.runCycle(st, c, NewCmdFileManager(0))
+	// a new MODIFY arrives while the first one waits
+	second := insertAt(t, st, now.Add(-10*time.Second), Event{EventType: EventType_MODIFY, FilePath: `d\vm.vhdx`})[0]
+	a.runCycle(st, c, NewCmdFileManager(0))
+	// the first one comes due: the burst now ends at the second one, which waits
+	if err := st.DeferEvent(first, now.Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	a.runCycle(st, c, NewCmdFileManager(0))
+
+	if _, err := os.Stat(runs); !os.IsNotExist(err) {
+		t.Errorf("expected no command inside the quiet period, got %v", err)
+	}
+	if got := processedOf(t, st, first); got != 2 {
+		t.Errorf("expected the first modify skipped, got processed %d", got)
+	}
+	if got := processedOf(t, st, second); got != 0 {
+		t.Errorf("expected the latest modify pending, got processed %d", got)
+	}
+	var next string
+	if err := st.db.QueryRow("SELECT next_attempt_at FROM file_events WHERE id = ?", second).Scan(&next); err != nil || next == "" {
+		t.Errorf("expected the latest modify deferred, got %q err %v", next, err)
+	}
+}
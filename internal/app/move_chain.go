@@ -0,0 +1,44 @@
+package app
+
+import (
+	"path"
+
+	"github.com/pancake-lee/pgo/pkg/plogger"
+)
+
+// 连续重命名/移动 a->b->c（或经过中转目录）合并为一次 a->c；
+// a->b->a 这种往返直接全部跳过。后续的跳转可能不在本次窗口内，所以查询数据库。
+
+// collapseMoveChains rewrites each RENAME/MOVE into its net move and
+// returns the remaining events of all.
+func (c *Coalescer) collapseMoveChains(st *Storage, all []PendingEvent) []PendingEvent {
+	skipped := make(map[int64]bool)
+	for i := range all {
+		pe := &all[i]
+		if (pe.EventType != EventType_RENAME && pe.EventType != EventType_MOVE) ||
+			pe.OldFilePath == "" || skipped[pe.ID] {
+			continue
+		}
+		finalPath, skipIDs, err := st.CollapseMoveChain(pe.ID, pe.OldFilePath, pe.FilePath, pe.EventTime)
+		if err != nil {
+			plogger.Errorf("collapse move chain[%v] %v->%v err[%v]", pe.ID, pe.OldFilePath, pe.FilePath, err)
+			continue
+		}
+		if len(skipIDs) == 0 {
+			continue
+		}
+		plogger.Debugf("collapse move chain[%v] %v->%v skip%v", pe.ID, pe.OldFilePath, finalPath, skipIDs)
+		for _, id := range skipIDs {
+			skipped[id] = true
+		}
+		if finalPath != pe.OldFilePath {
+			pe.FilePath = finalPath
+			pe.EventType = EventType_MOVE
+			if path.Dir(toSlash(pe.OldFilePath)) == path.Dir(toSlash(finalPath)) {
+				pe.EventType = EventType_RENAME
+			}
+		}
+	}
+
+	return dropSkipped(all, skipped)
+}
@@ -0,0 +1,58 @@
+package app
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCollapseMoveChains(t *testing.T) {
+	st := openTestStorage(t, "./test_move_chain.db")
+	base := time.Now().Add(-30 * time.Second)
+	ids := insertAt(t, st, base,
+		Event{EventType: EventType_RENAME, OldFilePath: `d\a.txt`, FilePath: `d\b.txt`},
+		Event{EventType: EventType_RENAME, OldFilePath: `d\x.txt`, FilePath: `d\y.txt`},
+		Event{EventType: EventType_MOVE, OldFilePath: `d\b.txt`, FilePath: `staging\b.txt`},
+		Event{EventType: EventType_RENAME, OldFilePath: `d\y.txt`, FilePath: `d\x.txt`},
+		Event{EventType: EventType_RENAME, OldFilePath: `d\m.txt`, FilePath: `d\n.txt`},
+		Event{EventType: EventType_MODIFY, FilePath: `d\n.txt`},
+		Event{EventType: EventType_RENAME, OldFilePath: `d\n.txt`, FilePath: `d\o.txt`},
+	)
+	// the last hop lands in a later window and back in the original folder
+	last := Event{EventType: EventType_MOVE, OldFilePath: `staging\b.txt`, FilePath: `d\c.txt`, EventTime: base.Add(10 * time.Second)}
+	lastID, err := st.InsertEvent(&last)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := NewCoalescer(CoalesceConfig{Rules: []CoalesceRule{{Name: "rename_modify", Disabled: true}}})
+	if err != nil {
+		t.Fatalf("NewCoalescer: %v", err)
+	}
+	res, err := c.GetAndFixedPendingEvents(st)
+	if err != nil {
+		t.Fatalf("get fixed pending: %v", err)
+	}
+	if len(res) != 4 {
+		t.Fatalf("expected 4 events, got %+v", res)
+	}
+	if res[0].ID != ids[0] || res[0].EventType != EventType_RENAME || res[0].OldFilePath != `d\a.txt` || res[0].FilePath != `d\c.txt` {
+		t.Errorf("unexpected net move %+v", res[0])
+	}
+	// a MODIFY in between breaks the chain
+	if res[1].ID != ids[4] || res[1].FilePath != `d\n.txt` || res[2].ID != ids[5] || res[3].ID != ids[6] {
+		t.Errorf("expected m->n, modify, n->o untouched, got %+v", res[1:])
+	}
+
+	got, err := st.GetEventByID(ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.FilePath != `d\c.txt` || got.EventType != EventType_RENAME {
+		t.Errorf("expected net move persisted, got %+v", got)
+	}
+	for _, id := range []int64{ids[1], ids[2], ids[3], lastID} {
+		if p := processedOf(t, st, id); p != 2 {
+			t.Errorf("expected id %d skipped, got processed=%d", id, p)
+		}
+	}
+}
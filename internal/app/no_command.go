@@ -0,0 +1,152 @@
+package app
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/pancake-lee/pgo/pkg/plogger"
+)
+
+// 没有任何命令可用于某个事件时（没有 -cmd，命令文件中没有命中的规则也没有 default），
+// 按事件类型的策略处理，而不是每轮都报错重试：
+//   - skip: 标记跳过（processed = 2）
+//   - fail: 进入死信（processed = 3）
+//   - hold: 挂起（processed = 4），同一路径之后的事件也等待；命令文件变化或消费者重启时
+//     挂起的事件重新变为待处理
+// 三种情况都在 result_status 记录 no_command。
+// 无法识别类型的事件（UNKNOWN）从不执行命令，默认跳过，可以用 UNKNOWN 键改为 hold 或 fail；
+// "*" 不包括 UNKNOWN。
+
+// NoCmdPolicy decides what happens to an event no command resolves for.
+type NoCmdPolicy string
+
+const (
+	NoCmdSkip NoCmdPolicy = "skip"
+	NoCmdFail NoCmdPolicy = "fail"
+	NoCmdHold NoCmdPolicy = "hold"
+)
+
+// defaultNoCmdPolicy keeps the event, the closest to the old behaviour of
+// leaving it pending.
+const defaultNoCmdPolicy = NoCmdHold
+
+// noCmdPolicyAny is the policies key matching every event type except
+// EventType_UNKNOWN.
+const noCmdPolicyAny = "*"
+
+// defaultUnknownPolicy applies to EventType_UNKNOWN events without an
+// UNKNOWN key: no command should run for an event nobody could map.
+const defaultUnknownPolicy = NoCmdSkip
+
+// StatusNoCommand is recorded as result_status of events no command
+// resolved for; commands cannot report it.
+const StatusNoCommand CmdStatus = "no_command"
+
+func (p NoCmdPolicy) valid() bool {
+	switch p {
+	case NoCmdSkip, NoCmdFail, NoCmdHold:
+		return true
+	}
+	return false
+}
+
+// validateNoCmdPolicies checks keys are event types, UNKNOWN or "*".
+func validateNoCmdPolicies(policies map[string]NoCmdPolicy) error {
+	for k, p := range policies {
+		if k != noCmdPolicyAny && EventType(k) != EventType_UNKNOWN && !isKnownEventType(EventType(k)) {
+			return fmt.Errorf("no command policy: unknown event type %q", k)
+		}
+		if !p.valid() {
+			return fmt.Errorf("no command policy %s: unknown policy %q", k, p)
+		}
+	}
+	return nil
+}
+
+// noCmdPolicy returns the policy for events of type t.
+func (o Options) noCmdPolicy(t EventType) NoCmdPolicy {
+	if p, ok := o.NoCmdPolicy[string(t)]; ok {
+		return p
+	}
+	if t == EventType_UNKNOWN {
+		return defaultUnknownPolicy
+	}
+	if p, ok := o.NoCmdPolicy[noCmdPolicyAny]; ok {
+		return p
+	}
+	return defaultNoCmdPolicy
+}
+
+// applyNoCommand records pe according to the policy for its type.
+func (a *App) applyNoCommand(st *Storage, pe PendingEvent) error {
+	policy := a.options.noCmdPolicy(pe.EventType)
+	msg := fmt.Sprintf("no command configured for %s (policy %s)", pe.EventType, policy)
+	if pe.EventType == EventType_UNKNOWN {
+		msg = fmt.Sprintf("unknown event type %q (policy %s)", pe.RawEventType, policy)
+	}
+	res := CmdResult{Status: StatusNoCommand, Message: msg}
+
+	processed := processedHeld
+	switch policy {
+	case NoCmdSkip:
+		processed = 2
+	case NoCmdFail:
+		processed = 3
+	}
+	if err := st.RecordResult(pe.ID, processed, res); err != nil {
+		plogger.Errorf("record no command id=%d: %v", pe.ID, err)
+		return plogger.LogErr(err)
+	}
+	switch policy {
+	case NoCmdSkip:
+		plogger.Infof("no command, skipped id=%d type=%s file=%s", pe.ID, pe.EventType, pe.FilePath)
+	case NoCmdFail:
+		plogger.Errorf("no command, dead letter id=%d type=%s file=%s", pe.ID, pe.EventType, pe.FilePath)
+	default:
+		plogger.Warnf("no command, held id=%d type=%s file=%s until the cmd file changes", pe.ID, pe.EventType, pe.FilePath)
+	}
+	return nil
+}
+
+// releaseHeldOnReload is the CmdFileManager reload hook: held events that
+// may resolve to a command now become pending again. A change of the -f
+// file can affect every event. Cmd file paths are compared by cmdFileKey,
+// since events may spell the same file differently.
+func (a *App) releaseHeldOnReload(st *Storage) func(path string) {
+	return func(path string) {
+		var ids []int64
+		key := cmdFileKey(path)
+		if a.options.CmdFile == "" || cmdFileKey(a.options.CmdFile) != key {
+			held, err := st.GetHeldEvents()
+			if err != nil {
+				plogger.Errorf("release held events after reloading %s: %v", path, err)
+				return
+			}
+			for _, pe := range held {
+				if pe.CmdFile != "" && cmdFileKey(pe.CmdFile) == key {
+					ids = append(ids, pe.ID)
+				}
+			}
+			if len(ids) == 0 {
+				return
+			}
+		}
+		n, err := st.ReleaseHeldEvents(ids)
+		if err != nil {
+			plogger.Errorf("release held events after reloading %s: %v", path, err)
+			return
+		}
+		if n > 0 {
+			plogger.Infof("released %d held events after reloading %s", n, filepath.Base(path))
+		}
+	}
+}
+
+// cmdFileKey is the absolute, symlink-resolved form of a cmd file path,
+// case-folded on Windows.
+func cmdFileKey(p string) string {
+	if real, err := resolvePath(p); err == nil {
+		return pathKey(real)
+	}
+	return pathKey(p)
+}
@@ -0,0 +1,159 @@
+package app
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNoCommandPolicies(t *testing.T) {
+	st := openTestStorage(t, "./test_no_command.db")
+	base := time.Now().Add(-10 * time.Minute)
+	at := func(i int, e Event) int64 {
+		return insertAt(t, st, base.Add(time.Duration(i)*10*time.Second), e)[0]
+	}
+	heldModify := at(0, Event{EventType: EventType_MODIFY, FilePath: `d\a.txt`})
+	skipped := at(1, Event{EventType: EventType_DELETE, FilePath: `d\b.txt`})
+	failed := at(2, Event{EventType: EventType_RENAME, FilePath: `d\c2.txt`, OldFilePath: `d\c.txt`})
+	behind := at(3, Event{EventType: EventType_CREATE, FilePath: `d\a.txt`})
+	other := at(4, Event{EventType: EventType_CREATE, FilePath: `d\e.txt`})
+
+	p := writeCmdFile(t, "cmds.yaml", "rules:\n  - types: [CREATE]\n    command: 'true'\n")
+	a := New(Options{
+		Mode:        ModeConsumer,
+		CmdFile:     p,
+		CatchUp:     true,
+		NoCmdPolicy: map[string]NoCmdPolicy{"DELETE": NoCmdSkip, "RENAME": NoCmdFail, "*": NoCmdHold},
+	})
+	if err := validateNoCmdPolicies(a.options.NoCmdPolicy); err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewCoalescer(CoalesceConfig{})
+	if err != nil {
+		t.Fatalf("NewCoalescer: %v", err)
+	}
+	mgr := NewCmdFileManager(time.Hour)
+	if err := mgr.Load(p); err != nil {
+		t.Fatal(err)
+	}
+	mgr.OnReload(a.releaseHeldOnReload(st))
+
+	a.runCycle(st, c, mgr)
+	want := map[int64]int{heldModify: processedHeld, skipped: 2, failed: 3, behind: 0, other: 1}
+	for id, w := range want {
+		if got := processedOf(t, st, id); got != w {
+			t.Errorf("event %d: expected processed %d, got %d", id, w, got)
+		}
+	}
+	if more, err := st.HasPendingEvents(0); err != nil || more {
+		t.Errorf("expected the event behind the held one to wait, got %v err %v", more, err)
+	}
+	if held, err := st.GetHeldEvents(); err != nil || len(held) != 1 || held[0].ID != heldModify {
+		t.Errorf("expected one held event, got %+v err %v", held, err)
+	}
+
+	// a cmd file change releases the held event, which runs before the
+	// CREATE behind it
+	if err := os.WriteFile(p, []byte("rules:\n  - types: [CREATE, MODIFY]\n    command: 'true'\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	mgr.mu.Lock()
+	mgr.cache[p].expires = time.Time{}
+	mgr.mu.Unlock()
+	if _, err := mgr.GetSpec(p, PendingEvent{Event: Event{EventType: EventType_CREATE}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := processedOf(t, st, heldModify); got != 0 {
+		t.Fatalf("expected held event released, got processed %d", got)
+	}
+	a.runCycle(st, c, mgr)
+	for _, id := range []int64{heldModify, behind} {
+		if got := processedOf(t, st, id); got != 1 {
+			t.Errorf("event %d: expected processed 1, got %d", id, got)
+		}
+	}
+}
+
+func TestReleaseHeldMatchesCmdFileSpelling(t *testing.T) {
+	st := openTestStorage(t, "./test_release_held.db")
+	dir := t.TempDir()
+	p := filepath.Join(dir, "real", "cmds.yaml")
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p, []byte("rules: []\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink(filepath.Join(dir, "real"), link); err != nil {
+		t.Skip(err)
+	}
+	ids := insertAt(t, st, time.Now().Add(-time.Minute),
+		Event{EventType: EventType_MODIFY, FilePath: `d\a.txt`, CmdFile: filepath.Join(link, "cmds.yaml")},
+		Event{EventType: EventType_MODIFY, FilePath: `d\b.txt`, CmdFile: filepath.Join(dir, "real", ".", "cmds.yaml")},
+		Event{EventType: EventType_MODIFY, FilePath: `d\c.txt`, CmdFile: filepath.Join(dir, "other.yaml")},
+	)
+	if _, err := st.db.Exec(`UPDATE file_events SET processed = ?`, processedHeld); err != nil {
+		t.Fatal(err)
+	}
+
+	a := New(Options{Mode: ModeConsumer})
+	a.releaseHeldOnReload(st)(p)
+	want := map[int64]int{ids[0]: 0, ids[1]: 0, ids[2]: processedHeld}
+	for id, w := range want {
+		if got := processedOf(t, st, id); got != w {
+			t.Errorf("event %d: expected processed %d, got %d", id, w, got)
+		}
+	}
+}
+
+func TestValidateNoCmdPolicies(t *testing.T) {
+	for _, bad := range []map[string]NoCmdPolicy{
+		{"CREATE": "drop"},
+		{"CREAT": NoCmdSkip},
+	} {
+		if err := validateNoCmdPolicies(bad); err == nil {
+			t.Errorf("expected %v to be rejected", bad)
+		}
+	}
+	o := Options{NoCmdPolicy: map[string]NoCmdPolicy{"DELETE": NoCmdSkip}}
+	if p := o.noCmdPolicy(EventType_DELETE); p != NoCmdSkip {
+		t.Errorf("expected skip for DELETE, got %s", p)
+	}
+	if p := o.noCmdPolicy(EventType_CREATE); p != defaultNoCmdPolicy {
+		t.Errorf("expected default for CREATE, got %s", p)
+	}
+}
+
+func TestUnknownEventsRunNoCommand(t *testing.T) {
+	st := openTestStorage(t, "./test_unknown_type.db")
+	base := time.Now().Add(-10 * time.Minute)
+	unknown := insertAt(t, st, base, Event{EventType: EventType_UNKNOWN, RawEventType: "Neu", FilePath: `d\a.txt`})[0]
+	known := insertAt(t, st, base.Add(10*time.Second), Event{EventType: EventType_DELETE, FilePath: `d\b.txt`})[0]
+	c, err := NewCoalescer(CoalesceConfig{})
+	if err != nil {
+		t.Fatalf("NewCoalescer: %v", err)
+	}
+
+	// the global command runs for known types only, even with "*" set
+	a := New(Options{Mode: ModeConsumer, Cmd: "true", CatchUp: true, NoCmdPolicy: map[string]NoCmdPolicy{"*": NoCmdHold}})
+	a.runCycle(st, c, NewCmdFileManager(0))
+	if got := processedOf(t, st, unknown); got != 2 {
+		t.Errorf("expected the UNKNOWN event skipped, got processed %d", got)
+	}
+	if got := processedOf(t, st, known); got != 1 {
+		t.Errorf("expected the DELETE processed, got processed %d", got)
+	}
+
+	policies := map[string]NoCmdPolicy{"UNKNOWN": NoCmdHold}
+	if err := validateNoCmdPolicies(policies); err != nil {
+		t.Fatalf("expected UNKNOWN as a policy key, got %v", err)
+	}
+	unknown = insertAt(t, st, base.Add(20*time.Second), Event{EventType: EventType_UNKNOWN, RawEventType: "Neu", FilePath: `d\c.txt`})[0]
+	a = New(Options{Mode: ModeConsumer, Cmd: "true", CatchUp: true, NoCmdPolicy: policies})
+	a.runCycle(st, c, NewCmdFileManager(0))
+	if got := processedOf(t, st, unknown); got != processedHeld {
+		t.Errorf("expected the UNKNOWN event held, got processed %d", got)
+	}
+}
@@ -0,0 +1,320 @@
+package app
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 规则文件使用 gitignore 语法，按顺序匹配，最后一条命中的规则生效：
+//   - 空行和 # 开头的行忽略
+//   - ! 开头表示重新包含（include），否则为排除（exclude）
+//   - / 结尾只匹配目录（即路径中的某一级父目录）
+//   - 以 / 开头或中间含 / 的模式相对于监控根目录锚定，否则匹配任意层级
+//   - 支持 *、?、[...] 和 **
+// 与 git 不同的是，父目录被排除后仍可用 ! 重新包含其中的文件。
+
+// defaultRules replaces the old substring skip list; they always apply first
+// so that rule files can re-include with "!".
+const defaultRules = `@eaDir/
+*@SynoEAStream*
+._*
+.DS_Store
+Thumbs.db
+`
+
+// PathRule is one parsed line of a rule file.
+type PathRule struct {
+	Pattern string
+	// Include is true for "!" rules.
+	Include bool
+	DirOnly bool
+	// Source is "file:line" of the rule, or "builtin:line".
+	Source string
+	re     *regexp.Regexp
+}
+
+// RuleSet is an ordered list of rules.
+type RuleSet struct {
+	Rules []PathRule
+}
+
+// ParseRules parses gitignore style rules from r; source is used to label
+// each rule for explanations.
+func ParseRules(r io.Reader, source string) (*RuleSet, error) {
+	rs := &RuleSet{}
+	sc := bufio.NewScanner(r)
+	lineNo := 0
+	for sc.Scan() {
+		lineNo++
+		line := strings.TrimRight(sc.Text(), " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule := PathRule{Source: fmt.Sprintf("%s:%d", source, lineNo)}
+		if strings.HasPrefix(line, "!") {
+			rule.Include = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+			line = line[1:]
+		}
+		rule.Pattern = line
+		if strings.HasSuffix(line, "/") {
+			rule.DirOnly = true
+			line = strings.TrimSuffix(line, "/")
+		}
+		if line == "" {
+			return nil, fmt.Errorf("%s: empty pattern", rule.Source)
+		}
+		re, err := compileGlob(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", rule.Source, err)
+		}
+		rule.re = re
+		rs.Rules = append(rs.Rules, rule)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("read rules %s: %w", source, err)
+	}
+	return rs, nil
+}
+
+// compileGlob converts a gitignore glob into an anchored regexp over
+// slash-separated relative paths.
+func compileGlob(pattern string) (*regexp.Regexp, error) {
+	anchored := strings.Contains(strings.TrimPrefix(pattern, "/"), "/") || strings.HasPrefix(pattern, "/")
+	pattern = strings.TrimPrefix(pattern, "/")
+
+	var b strings.Builder
+	b.WriteString("^")
+	if !anchored {
+		b.WriteString("(?:.*/)?")
+	}
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch c {
+		case '*':
+			if i+1 < len(pattern) && pattern[i+1] == '*' {
+				i++
+				if i+1 < len(pattern) && pattern[i+1] == '/' {
+					// "**/" matches zero or more directories
+					i++
+					b.WriteString("(?:.*/)?")
+				} else {
+					b.WriteString(".*")
+				}
+			} else {
+				b.WriteString("[^/]*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated character class in %q", pattern)
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + class + "]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+				b.WriteString(regexp.QuoteMeta(string(pattern[i])))
+			}
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+// matches reports whether the rule matches rel or, for directory rules and
+// rules naming a parent, any of its parent directories.
+func (r *PathRule) matches(rel string) bool {
+	if !r.DirOnly && r.re.MatchString(rel) {
+		return true
+	}
+	for i := len(rel) - 1; i > 0; i-- {
+		if rel[i] == '/' && r.re.MatchString(rel[:i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Match returns whether rel is excluded and the last rule that matched it
+// (nil when no rule matched, which means included).
+func (rs *RuleSet) Match(rel string) (bool, *PathRule) {
+	var hit *PathRule
+	for i := range rs.Rules {
+		if rs.Rules[i].matches(rel) {
+			hit = &rs.Rules[i]
+		}
+	}
+	if hit == nil {
+		return false, nil
+	}
+	return !hit.Include, hit
+}
+
+// --------------------------------------------------
+
+// RuleRoot binds a watched root directory to its own rule file.
+type RuleRoot struct {
+	Path      string `json:"path"`
+	RulesFile string `json:"rules_file"`
+}
+
+// RuleMatch explains the decision for one path.
+type RuleMatch struct {
+	Root     string
+	Rel      string
+	Excluded bool
+	// Rule is the deciding rule, nil when nothing matched.
+	Rule *PathRule
+}
+
+type ruleFileEntry struct {
+	rules   *RuleSet
+	modTime time.Time
+}
+
+// PathFilter evaluates the built-in rules, the global rule file and the rule
+// file of the matching root, in that order. Rule files are re-read whenever
+// their modification time changes.
+type PathFilter struct {
+	rulesFile string
+	roots     []RuleRoot
+	builtin   *RuleSet
+
+	mu    sync.Mutex
+	cache map[string]*ruleFileEntry
+}
+
+// NewPathFilter constructs a filter; rulesFile and roots are optional.
+func NewPathFilter(rulesFile string, roots []RuleRoot) *PathFilter {
+	builtin, _ := ParseRules(strings.NewReader(defaultRules), "builtin")
+	return &PathFilter{
+		rulesFile: rulesFile,
+		roots:     roots,
+		builtin:   builtin,
+		cache:     make(map[string]*ruleFileEntry),
+	}
+}
+
+// loadRules returns the parsed rule file, re-reading it if it changed.
+func (f *PathFilter) loadRules(path string) (*RuleSet, error) {
+	if path == "" {
+		return &RuleSet{}, nil
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("stat rules %s: %w", path, err)
+	}
+
+	f.mu.Lock()
+	e, ok := f.cache[path]
+	f.mu.Unlock()
+	if ok && e.modTime.Equal(fi.ModTime()) {
+		return e.rules, nil
+	}
+
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open rules %s: %w", path, err)
+	}
+	defer fh.Close()
+	rules, err := ParseRules(fh, path)
+	if err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	f.cache[path] = &ruleFileEntry{rules: rules, modTime: fi.ModTime()}
+	f.mu.Unlock()
+	return rules, nil
+}
+
+// relativeTo returns filePath relative to the longest configured root, or to
+// dirPath when no root matches. Separators are normalized to "/".
+func (f *PathFilter) relativeTo(filePath, dirPath string) (RuleRoot, string) {
+	p := toSlash(filePath)
+	var best RuleRoot
+	bestLen := -1
+	for _, r := range f.roots {
+		root := strings.TrimSuffix(toSlash(r.Path), "/")
+		if hasPathPrefix(p, root) && len(root) > bestLen {
+			best, bestLen = r, len(root)
+		}
+	}
+	if bestLen < 0 && dirPath != "" {
+		root := strings.TrimSuffix(toSlash(dirPath), "/")
+		if hasPathPrefix(p, root) {
+			best, bestLen = RuleRoot{Path: dirPath}, len(root)
+		}
+	}
+	if bestLen < 0 {
+		return best, strings.TrimLeft(p, "/")
+	}
+	return best, strings.TrimLeft(p[bestLen:], "/")
+}
+
+// Explain evaluates all applicable rule sets for filePath.
+func (f *PathFilter) Explain(filePath, dirPath string) (RuleMatch, error) {
+	root, rel := f.relativeTo(filePath, dirPath)
+	res := RuleMatch{Root: root.Path, Rel: rel}
+
+	sets := []*RuleSet{f.builtin}
+	for _, path := range []string{f.rulesFile, root.RulesFile} {
+		rs, err := f.loadRules(path)
+		if err != nil {
+			return res, err
+		}
+		sets = append(sets, rs)
+	}
+	for _, rs := range sets {
+		if excluded, rule := rs.Match(rel); rule != nil {
+			res.Excluded, res.Rule = excluded, rule
+		}
+	}
+	return res, nil
+}
+
+// ShouldSkip reports whether the event is excluded. A RENAME/MOVE is only
+// skipped when both its old and new paths are excluded.
+func (f *PathFilter) ShouldSkip(e *Event) (bool, error) {
+	m, err := f.Explain(e.FilePath, e.DirPath)
+	if err != nil || !m.Excluded {
+		return false, err
+	}
+	if e.OldFilePath != "" {
+		om, err := f.Explain(e.OldFilePath, e.DirPath)
+		if err != nil || !om.Excluded {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func toSlash(p string) string {
+	return strings.ReplaceAll(p, `\`, "/")
+}
+
+func hasPathPrefix(p, prefix string) bool {
+	if prefix == "" || len(p) < len(prefix) {
+		return false
+	}
+	if !strings.EqualFold(p[:len(prefix)], prefix) {
+		return false
+	}
+	return len(p) == len(prefix) || p[len(prefix)] == '/'
+}
@@ -0,0 +1,131 @@
+package app
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRuleSetMatch(t *testing.T) {
+	rs, err := ParseRules(strings.NewReader(`
+# comment
+*.tmp
+/build/
+docs/**/*.pdf
+!keep.tmp
+`), "test")
+	if err != nil {
+		t.Fatalf("ParseRules: %v", err)
+	}
+	cases := map[string]bool{
+		"a.tmp":             true,
+		"x/y/a.tmp":         true,
+		"keep.tmp":          false,
+		"x/keep.tmp":        false,
+		"build/out.bin":     true,
+		"src/build/out.bin": false,
+		"build":             false, // directory rules only match parents
+		"docs/a.pdf":        true,
+		"docs/x/y/a.pdf":    true,
+		"other/docs/a.pdf":  false,
+		"a.txt":             false,
+	}
+	for rel, want := range cases {
+		if got, _ := rs.Match(rel); got != want {
+			t.Errorf("Match(%q) = %v, want %v", rel, got, want)
+		}
+	}
+}
+
+func TestPathFilterBuiltinRules(t *testing.T) {
+	f := NewPathFilter("", nil)
+	cases := map[string]bool{
+		`\\host\share\@eaDir\1.jpg@SynoEAStream`: true,
+		`\\host\share\a\@eaDir\thumb.jpg`:        true,
+		`\\host\share\._1.jpg`:                   true,
+		`\\host\share\.DS_Store`:                 true,
+		`\\host\share\my._notes.txt`:             false,
+		`\\host\share\a.jpg`:                     false,
+	}
+	for p, want := range cases {
+		skip, err := f.ShouldSkip(&Event{FilePath: p, DirPath: `\\host\share`})
+		if err != nil {
+			t.Fatalf("ShouldSkip(%q): %v", p, err)
+		}
+		if skip != want {
+			t.Errorf("ShouldSkip(%q) = %v, want %v", p, skip, want)
+		}
+	}
+
+	// a rename out of an excluded name is kept
+	skip, _ := f.ShouldSkip(&Event{FilePath: `\\host\share\a.jpg`, OldFilePath: `\\host\share\._a.jpg`})
+	if skip {
+		t.Errorf("expected rename from excluded name to be kept")
+	}
+}
+
+func TestPathFilterRootsAndReload(t *testing.T) {
+	dir := t.TempDir()
+	global := filepath.Join(dir, "global.rules")
+	photos := filepath.Join(dir, "photos.rules")
+	if err := os.WriteFile(global, []byte("*.bak\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(photos, []byte("/raw/\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	f := NewPathFilter(global, []RuleRoot{
+		{Path: `\\nas\share`},
+		{Path: `\\nas\share\photos`, RulesFile: photos},
+	})
+
+	m, err := f.Explain(`\\nas\share\photos\raw\1.cr2`, "")
+	if err != nil {
+		t.Fatalf("Explain: %v", err)
+	}
+	if !m.Excluded || m.Rel != "raw/1.cr2" || m.Rule == nil || m.Rule.Source != photos+":1" {
+		t.Fatalf("unexpected match %+v", m)
+	}
+	m, _ = f.Explain(`\\nas\share\raw\1.cr2`, "")
+	if m.Excluded {
+		t.Fatalf("per-root rule must not apply outside its root: %+v", m)
+	}
+	m, _ = f.Explain(`\\nas\share\a.bak`, "")
+	if !m.Excluded {
+		t.Fatalf("global rule should apply: %+v", m)
+	}
+
+	// rewriting the rule file is picked up without a new filter
+	if err := os.WriteFile(global, []byte("*.bak\n!a.bak\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Minute)
+	_ = os.Chtimes(global, future, future)
+	m, _ = f.Explain(`\\nas\share\a.bak`, "")
+	if m.Excluded {
+		t.Fatalf("expected reloaded rule to re-include: %+v", m)
+	}
+}
+
+func TestRunRulesTest(t *testing.T) {
+	var out bytes.Buffer
+	a := New(Options{Mode: ModeRules})
+	a.stdout = &out
+	if err := a.Run([]string{"test", "x/._a.jpg", "x/a.jpg"}); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %q", out.String())
+	}
+	if !strings.HasPrefix(lines[0], "exclude") || !strings.Contains(lines[0], `builtin:3 "._*"`) {
+		t.Errorf("unexpected first line %q", lines[0])
+	}
+	if !strings.HasPrefix(lines[1], "include") || !strings.Contains(lines[1], "no rule matched") {
+		t.Errorf("unexpected second line %q", lines[1])
+	}
+}
@@ -0,0 +1,97 @@
+package app
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// 大批量照片导入时，删除和小文档的修改不应排在后面等待。生产者按优先级规则给事件打上
+// priority，消费者每轮先从最高优先级的通道中选取窗口起点（见 Storage.GetPendingEventsWindow），
+// 同一路径上更早的未处理事件仍然先处理；最早的事件等待超过 PriorityMaxWait 后无论优先级都先处理，
+// 防止低优先级事件饿死。
+
+// PriorityRule assigns Priority to events matching all of its conditions.
+// Empty conditions match everything.
+type PriorityRule struct {
+	Name string `json:"name"`
+	// Types lists the event types the rule applies to.
+	Types []EventType `json:"types"`
+	// Glob is a gitignore style glob matched against the slash separated
+	// full file path; a pattern without "/" matches the basename at any
+	// depth, otherwise use "**/" to match below any root.
+	Glob string `json:"glob"`
+	// MinSize and MaxSize bound the payload size in bytes; 0 means no bound.
+	MinSize  int64 `json:"min_size"`
+	MaxSize  int64 `json:"max_size"`
+	Priority int   `json:"priority"`
+
+	re *regexp.Regexp
+}
+
+// PriorityRules assigns event priorities; the first matching rule wins and
+// unmatched events get priority 0. Higher values are served first.
+type PriorityRules struct {
+	rules []PriorityRule
+}
+
+// NewPriorityRules validates and compiles rules.
+func NewPriorityRules(rules []PriorityRule) (*PriorityRules, error) {
+	p := &PriorityRules{}
+	for _, r := range rules {
+		for _, t := range r.Types {
+			if !isKnownEventType(t) {
+				return nil, fmt.Errorf("priority rule %q: unknown event type %q", r.Name, t)
+			}
+		}
+		if r.MaxSize != 0 && r.MaxSize < r.MinSize {
+			return nil, fmt.Errorf("priority rule %q: max_size %d below min_size %d", r.Name, r.MaxSize, r.MinSize)
+		}
+		if r.Glob != "" {
+			re, err := compileGlob(r.Glob)
+			if err != nil {
+				return nil, fmt.Errorf("priority rule %q: %w", r.Name, err)
+			}
+			r.re = re
+		}
+		p.rules = append(p.rules, r)
+	}
+	return p, nil
+}
+
+// Priority returns the priority of e.
+func (p *PriorityRules) Priority(e *Event) int {
+	if p == nil {
+		return 0
+	}
+	for _, r := range p.rules {
+		if r.matches(e) {
+			return r.Priority
+		}
+	}
+	return 0
+}
+
+func (r *PriorityRule) matches(e *Event) bool {
+	if len(r.Types) > 0 {
+		found := false
+		for _, t := range r.Types {
+			if t == e.EventType {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if r.re != nil && !r.re.MatchString(toSlash(e.FilePath)) {
+		return false
+	}
+	if r.MinSize > 0 && e.Size < r.MinSize {
+		return false
+	}
+	if r.MaxSize > 0 && e.Size > r.MaxSize {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,69 @@
+package app
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPriorityRules(t *testing.T) {
+	p, err := NewPriorityRules([]PriorityRule{
+		{Name: "deletes", Types: []EventType{EventType_DELETE}, Priority: 10},
+		{Name: "small docs", Glob: "*.docx", MaxSize: 1 << 20, Priority: 5},
+		{Name: "photos", Glob: "**/photos/**", Priority: -1},
+	})
+	if err != nil {
+		t.Fatalf("NewPriorityRules: %v", err)
+	}
+	cases := []struct {
+		ev   Event
+		want int
+	}{
+		{Event{EventType: EventType_DELETE, FilePath: `d\photos\1.jpg`}, 10},
+		{Event{EventType: EventType_MODIFY, FilePath: `d\a.docx`, Size: 100}, 5},
+		{Event{EventType: EventType_MODIFY, FilePath: `d\a.docx`, Size: 2 << 20}, 0},
+		{Event{EventType: EventType_CREATE, FilePath: `d\photos\1.jpg`}, -1},
+		{Event{EventType: EventType_CREATE, FilePath: `d\1.jpg`}, 0},
+	}
+	for _, c := range cases {
+		if got := p.Priority(&c.ev); got != c.want {
+			t.Errorf("Priority(%s %s size=%d) = %d, want %d", c.ev.EventType, c.ev.FilePath, c.ev.Size, got, c.want)
+		}
+	}
+
+	if _, err := NewPriorityRules([]PriorityRule{{Types: []EventType{"FOO"}}}); err == nil {
+		t.Errorf("expected error for unknown event type")
+	}
+	if _, err := NewPriorityRules([]PriorityRule{{MinSize: 10, MaxSize: 5}}); err == nil {
+		t.Errorf("expected error for inverted size bounds")
+	}
+}
+
+func TestPendingPriorityLanes(t *testing.T) {
+	st := openTestStorage(t, "./test_priority.db")
+	base := time.Now().Add(-time.Minute)
+	bulk := insertAt(t, st, base,
+		Event{EventType: EventType_CREATE, FilePath: `d\photos\1.jpg`},
+		Event{EventType: EventType_CREATE, FilePath: `d\photos\2.jpg`},
+		Event{EventType: EventType_MODIFY, FilePath: `d\b.docx`},
+	)
+	// queued behind the low priority MODIFY of the same path
+	insertAt(t, st, base.Add(20*time.Second), Event{EventType: EventType_MODIFY, FilePath: `d\b.docx`, Priority: 5})
+	del := insertAt(t, st, base.Add(30*time.Second), Event{EventType: EventType_DELETE, FilePath: `d\a.docx`, Priority: 10})
+
+	res, err := st.GetPendingEventsWindow(Windows{})
+	if err != nil {
+		t.Fatalf("get pending: %v", err)
+	}
+	if len(res) != 1 || res[0].ID != del[0] || res[0].Priority != 10 {
+		t.Fatalf("expected the high priority delete first, got %+v", res)
+	}
+
+	// the oldest event has waited too long: served regardless of lane
+	res, err = st.GetPendingEventsWindow(Windows{PriorityMaxWait: 30 * time.Second})
+	if err != nil {
+		t.Fatalf("get pending: %v", err)
+	}
+	if len(res) != 3 || res[0].ID != bulk[0] {
+		t.Fatalf("expected the starving bulk window, got %+v", res)
+	}
+}
@@ -0,0 +1,97 @@
+package app
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// 可选的子进程沙箱（仅 Linux）：命令以配置的 uid/gid 运行，工作目录限制在 dir 之内，
+// 设置 rlimit 和 no_new_privs。Go 无法在 fork 之后、exec 之前为子进程设置 rlimit
+// 和 no_new_privs，所以先以 SandboxExecArg 参数重新执行自身，由这个中间进程设置后
+// 再 exec 真正的命令（进程号不变，超时仍能杀掉命令）。
+
+// SandboxExecArg is the first argument of the helper process that applies
+// the sandbox and execs the command, see RunSandboxExec.
+const SandboxExecArg = "__sandbox-exec"
+
+// SandboxConfig confines command processes. Only supported on Linux.
+type SandboxConfig struct {
+	// UID and GID the command runs as; nil keeps the consumer's. Setting
+	// them also drops supplementary groups.
+	UID *int `json:"uid"`
+	GID *int `json:"gid"`
+	// Dir is the working directory of commands. A cmd file dir must lie
+	// inside it; relative ones are taken relative to it.
+	Dir string `json:"dir"`
+	// Rlimits sets soft and hard limits by name, see sandboxRlimits.
+	Rlimits map[string]uint64 `json:"rlimits"`
+	// NoNewPrivs sets PR_SET_NO_NEW_PRIVS, so setuid binaries and file
+	// capabilities cannot gain privileges.
+	NoNewPrivs bool `json:"no_new_privs"`
+}
+
+// sandboxRlimits are the rlimit names SandboxConfig.Rlimits accepts.
+var sandboxRlimits = []string{"as", "core", "cpu", "data", "fsize", "nofile", "nproc", "stack"}
+
+// sandboxChild is passed to the helper process as JSON.
+type sandboxChild struct {
+	Rlimits    map[string]uint64 `json:"rlimits"`
+	NoNewPrivs bool              `json:"no_new_privs"`
+}
+
+func (c *SandboxConfig) enabled() bool {
+	return c != nil && (c.UID != nil || c.GID != nil || c.Dir != "" || len(c.Rlimits) > 0 || c.NoNewPrivs)
+}
+
+func (c *SandboxConfig) validate() error {
+	if !c.enabled() {
+		return nil
+	}
+	if !sandboxSupported {
+		return fmt.Errorf("sandbox is only supported on linux")
+	}
+	names := make([]string, 0, len(c.Rlimits))
+	for name := range c.Rlimits {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		i := sort.SearchStrings(sandboxRlimits, name)
+		if i == len(sandboxRlimits) || sandboxRlimits[i] != name {
+			return fmt.Errorf("sandbox: unknown rlimit %q", name)
+		}
+	}
+	if c.Dir != "" {
+		if !filepath.IsAbs(c.Dir) {
+			return fmt.Errorf("sandbox: dir %s must be absolute", c.Dir)
+		}
+		fi, err := os.Stat(c.Dir)
+		if err != nil {
+			return fmt.Errorf("sandbox: dir: %w", err)
+		}
+		if !fi.IsDir() {
+			return fmt.Errorf("sandbox: dir %s is not a directory", c.Dir)
+		}
+	}
+	return nil
+}
+
+// workDir returns the working directory for a command whose spec asks for
+// dir, refusing dirs outside c.Dir.
+func (c *SandboxConfig) workDir(dir string) (string, error) {
+	if c.Dir == "" {
+		return dir, nil
+	}
+	if dir == "" {
+		return c.Dir, nil
+	}
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(c.Dir, dir)
+	}
+	if !within(c.Dir, filepath.Clean(dir)) {
+		return "", fmt.Errorf("dir %s: %w: outside the sandbox dir %s", dir, errNotAllowed, c.Dir)
+	}
+	return dir, nil
+}
@@ -0,0 +1,96 @@
+//go:build linux
+
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"syscall"
+)
+
+const sandboxSupported = true
+
+// prSetNoNewPrivs is PR_SET_NO_NEW_PRIVS, not exported by syscall.
+const prSetNoNewPrivs = 38
+
+var rlimitResources = map[string]int{
+	"as":     syscall.RLIMIT_AS,
+	"core":   syscall.RLIMIT_CORE,
+	"cpu":    syscall.RLIMIT_CPU,
+	"data":   syscall.RLIMIT_DATA,
+	"fsize":  syscall.RLIMIT_FSIZE,
+	"nofile": syscall.RLIMIT_NOFILE,
+	"nproc":  6, // RLIMIT_NPROC
+	"stack":  syscall.RLIMIT_STACK,
+}
+
+// command returns a command running argv through the sandbox helper.
+func (c *SandboxConfig) command(ctx context.Context, argv []string) (*exec.Cmd, error) {
+	prog, err := exec.LookPath(argv[0])
+	if err != nil {
+		return nil, err
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("sandbox: %w", err)
+	}
+	child, err := json.Marshal(sandboxChild{Rlimits: c.Rlimits, NoNewPrivs: c.NoNewPrivs})
+	if err != nil {
+		return nil, fmt.Errorf("sandbox: %w", err)
+	}
+
+	args := append([]string{SandboxExecArg, string(child), prog}, argv...)
+	cmd := exec.CommandContext(ctx, self, args...)
+	if c.UID != nil || c.GID != nil {
+		cred := &syscall.Credential{Uid: uint32(os.Getuid()), Gid: uint32(os.Getgid()), Groups: []uint32{}}
+		if c.UID != nil {
+			cred.Uid = uint32(*c.UID)
+		}
+		if c.GID != nil {
+			cred.Gid = uint32(*c.GID)
+		}
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: cred}
+	}
+	return cmd, nil
+}
+
+// RunSandboxExec is the helper process started by the sandbox with the
+// arguments following SandboxExecArg: the sandboxChild JSON, the program
+// path and its argv. It applies the limits and execs the program; it only
+// returns by exiting with status 126.
+func RunSandboxExec(args []string) {
+	if len(args) < 3 {
+		sandboxExecFail(fmt.Errorf("expected <json> <program> <argv...>, got %d arguments", len(args)))
+	}
+	var child sandboxChild
+	if err := json.Unmarshal([]byte(args[0]), &child); err != nil {
+		sandboxExecFail(err)
+	}
+
+	// no_new_privs is per thread and execve keeps the calling thread only
+	runtime.LockOSThread()
+	for name, v := range child.Rlimits {
+		res, ok := rlimitResources[name]
+		if !ok {
+			sandboxExecFail(fmt.Errorf("unknown rlimit %q", name))
+		}
+		if err := syscall.Setrlimit(res, &syscall.Rlimit{Cur: v, Max: v}); err != nil {
+			sandboxExecFail(fmt.Errorf("setrlimit %s: %w", name, err))
+		}
+	}
+	if child.NoNewPrivs {
+		if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0); errno != 0 {
+			sandboxExecFail(fmt.Errorf("prctl no_new_privs: %w", errno))
+		}
+	}
+	sandboxExecFail(syscall.Exec(args[1], args[2:], os.Environ()))
+}
+
+func sandboxExecFail(err error) {
+	fmt.Fprintf(os.Stderr, "sandbox exec: %v\n", err)
+	os.Exit(126)
+}
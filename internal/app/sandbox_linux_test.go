@@ -0,0 +1,72 @@
+//go:build linux
+
+package app
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestMain lets the test binary act as the sandbox helper, as main does.
+func TestMain(m *testing.M) {
+	if len(os.Args) > 1 && os.Args[1] == SandboxExecArg {
+		RunSandboxExec(os.Args[2:])
+	}
+	os.Exit(m.Run())
+}
+
+func TestSandboxExec(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no sh")
+	}
+	dir := t.TempDir()
+	sb := &SandboxConfig{Dir: dir, Rlimits: map[string]uint64{"nofile": 64}, NoNewPrivs: true}
+	if err := sb.validate(); err != nil {
+		t.Fatal(err)
+	}
+	spec := &CmdSpec{Argv: []string{"sh", "-c", "ulimit -n; grep NoNewPrivs /proc/self/status; pwd; echo $BS_EVENT_TYPE"}}
+	pe := PendingEvent{ID: 1, Event: Event{EventType: EventType_CREATE, EventTime: time.Now()}}
+	_, out, stderr, err := execCommand(execEnv{mode: ExecModeArgv, sandbox: sb}, spec, pe)
+	if err != nil {
+		t.Fatalf("exec: %v %s", err, stderr)
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 4 || lines[0] != "64" || !strings.HasSuffix(lines[1], "1") || lines[2] != dir || lines[3] != "CREATE" {
+		t.Errorf("unexpected sandboxed output %q", out)
+	}
+
+	spec.Dir = "/etc"
+	if _, _, _, err := execCommand(execEnv{mode: ExecModeArgv, sandbox: sb}, spec, pe); err == nil {
+		t.Error("expected a dir outside the sandbox dir to be refused")
+	}
+
+	// split mode keeps quoted paths with spaces as one argument
+	spec = &CmdSpec{Command: `printf [%%s] %file_path|quote% "two words"`}
+	pe.FilePath = "/data/my file.txt"
+	_, out, stderr, err = execCommand(execEnv{mode: ExecModeSplit, sandbox: sb}, spec, pe)
+	if err != nil {
+		t.Fatalf("exec: %v %s", err, stderr)
+	}
+	if out != "[/data/my file.txt][two words]" {
+		t.Errorf("unexpected sandboxed split argv %q", out)
+	}
+}
+
+func TestSandboxValidate(t *testing.T) {
+	for _, bad := range []*SandboxConfig{
+		{Rlimits: map[string]uint64{"files": 1}},
+		{Dir: "relative"},
+		{Dir: "/no/such/dir/bs"},
+	} {
+		if err := bad.validate(); err == nil {
+			t.Errorf("expected %+v to be rejected", bad)
+		}
+	}
+	var none *SandboxConfig
+	if none.enabled() || none.validate() != nil {
+		t.Error("nil sandbox should be disabled and valid")
+	}
+}
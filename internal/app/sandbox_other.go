@@ -0,0 +1,24 @@
+//go:build !linux
+
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+const sandboxSupported = false
+
+func (c *SandboxConfig) command(ctx context.Context, argv []string) (*exec.Cmd, error) {
+	return nil, errors.New("sandbox is only supported on linux")
+}
+
+// RunSandboxExec exits with status 126: the sandbox is only supported on
+// Linux.
+func RunSandboxExec(args []string) {
+	fmt.Fprintln(os.Stderr, "sandbox exec: only supported on linux")
+	os.Exit(126)
+}
@@ -0,0 +1,33 @@
+package app
+
+import (
+	"github.com/pancake-lee/pgo/pkg/plogger"
+)
+
+// 文件在消费者处理之前就被创建又删除：CREATE (+MODIFY...) + DELETE 整条链标记跳过，
+// 不执行任何命令。DELETE 可能在本次窗口之后，所以直接查询数据库中该路径的后续事件。
+
+// cancelShortLived skips CREATE..DELETE chains and returns the remaining
+// events of all.
+func (c *Coalescer) cancelShortLived(st *Storage, all []PendingEvent) []PendingEvent {
+	skipped := make(map[int64]bool)
+	for _, pe := range all {
+		if pe.EventType != EventType_CREATE || skipped[pe.ID] {
+			continue
+		}
+		skipIDs, err := st.CancelCreateDelete(pe.ID, pe.FilePath, pe.EventTime)
+		if err != nil {
+			plogger.Errorf("cancel CREATE[%v]..DELETE file[%v] err[%v]", pe.ID, pe.FilePath, err)
+			continue
+		}
+		if len(skipIDs) == 0 {
+			continue
+		}
+		plogger.Debugf("cancel CREATE[%v]..DELETE file[%v] skip%v", pe.ID, pe.FilePath, skipIDs)
+		for _, id := range skipIDs {
+			skipped[id] = true
+		}
+	}
+
+	return dropSkipped(all, skipped)
+}
@@ -0,0 +1,56 @@
+package app
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCancelCreateDelete(t *testing.T) {
+	st := openTestStorage(t, "./test_short_lived.db")
+	base := time.Now().Add(-30 * time.Second)
+	ids := insertAt(t, st, base,
+		Event{EventType: EventType_CREATE, FilePath: `d\a.txt`},
+		Event{EventType: EventType_MODIFY, FilePath: `d\a.txt`},
+		Event{EventType: EventType_CREATE, FilePath: `d\b.txt`},
+		Event{EventType: EventType_CREATE, FilePath: `d\c.txt`},
+		Event{EventType: EventType_RENAME, OldFilePath: `d\c.txt`, FilePath: `d\e.txt`},
+	)
+	// the delete of a.txt lands well after the fetch window
+	late := Event{EventType: EventType_DELETE, FilePath: `d\a.txt`, EventTime: base.Add(20 * time.Second)}
+	lateID, err := st.InsertEvent(&late)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// b.txt: an executed event between create and delete keeps the chain
+	doneID, err := st.InsertEvent(&Event{EventType: EventType_MODIFY, FilePath: `d\b.txt`, EventTime: base.Add(10 * time.Second)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.MarkProcessed(doneID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.InsertEvent(&Event{EventType: EventType_DELETE, FilePath: `d\b.txt`, EventTime: base.Add(11 * time.Second)}); err != nil {
+		t.Fatal(err)
+	}
+	// c.txt was renamed away, so its later delete is unrelated
+	if _, err := st.InsertEvent(&Event{EventType: EventType_DELETE, FilePath: `d\c.txt`, EventTime: base.Add(12 * time.Second)}); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := NewCoalescer(CoalesceConfig{Rules: []CoalesceRule{{Name: "create_modify", Disabled: true}}})
+	if err != nil {
+		t.Fatalf("NewCoalescer: %v", err)
+	}
+	res, err := c.GetAndFixedPendingEvents(st)
+	if err != nil {
+		t.Fatalf("get fixed pending: %v", err)
+	}
+	if len(res) != 3 || res[0].ID != ids[2] || res[1].ID != ids[3] || res[2].ID != ids[4] {
+		t.Fatalf("expected b, c and the rename left, got %+v", res)
+	}
+	for _, id := range []int64{ids[0], ids[1], lateID} {
+		if p := processedOf(t, st, id); p != 2 {
+			t.Errorf("expected id %d skipped, got processed=%d", id, p)
+		}
+	}
+}
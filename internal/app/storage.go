@@ -4,11 +4,22 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"path"
+	"strings"
 	"time"
 
 	_ "github.com/glebarez/sqlite"
 )
 
+// storageTimeLayout is a fixed-width RFC3339 variant so that event_time
+// strings sort correctly even with sub-second precision (RFC3339Nano trims
+// trailing zeros, which breaks lexical ordering).
+const storageTimeLayout = "2006-01-02T15:04:05.000000000Z07:00"
+
+func formatStorageTime(t time.Time) string {
+	return t.UTC().Format(storageTimeLayout)
+}
+
 // Storage wraps an sqlite DB connection.
 type Storage struct {
 	db *sql.DB
@@ -43,9 +54,60 @@ func OpenAndInit(path string) (*Storage, error) {
 		s.Close()
 		return nil, err
 	}
+	if err := s.migrateEventTimes(); err != nil {
+		s.Close()
+		return nil, err
+	}
 	return s, nil
 }
 
+// migrateEventTimes rewrites event_time values stored by older versions as
+// RFC3339Nano into storageTimeLayout, so string comparisons and ordering
+// hold across old and new rows. Rows already migrated are left alone.
+func (s *Storage) migrateEventTimes() error {
+	width := len(formatStorageTime(time.Time{}))
+	rows, err := s.db.Query(`SELECT id, event_time FROM file_events WHERE length(event_time) != ?`, width)
+	if err != nil {
+		return fmt.Errorf("query old event_time: %w", err)
+	}
+	fixed := make(map[int64]string)
+	for rows.Next() {
+		var (
+			id  int64
+			old string
+		)
+		if err := rows.Scan(&id, &old); err != nil {
+			rows.Close()
+			return fmt.Errorf("scan old event_time: %w", err)
+		}
+		// values that do not parse are left as they are
+		if t, err := time.Parse(time.RFC3339Nano, old); err == nil {
+			fixed[id] = formatStorageTime(t)
+		}
+	}
+	if err := rows.Close(); err != nil {
+		return fmt.Errorf("old event_time rows: %w", err)
+	}
+	if len(fixed) == 0 {
+		return nil
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin migrate event_time: %w", err)
+	}
+	defer tx.Rollback()
+	for id, v := range fixed {
+		if _, err := tx.Exec(`UPDATE file_events SET event_time = ? WHERE id = ?`, v, id); err != nil {
+			return fmt.Errorf("migrate event_time of %d: %w", id, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit migrate event_time: %w", err)
+	}
+	return nil
+}
+
 // Close closes the DB connection.
 func (s *Storage) Close() error {
 	if s == nil || s.db == nil {
@@ -54,7 +116,8 @@ func (s *Storage) Close() error {
 	return s.db.Close()
 }
 
-// InitSchema creates the file_events table if not exists.
+// InitSchema creates the file_events table if not exists and adds columns
+// introduced after the table was first created.
 func (s *Storage) InitSchema() error {
 	const schema = `CREATE TABLE IF NOT EXISTS file_events (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
@@ -72,15 +135,81 @@ func (s *Storage) InitSchema() error {
 	if err != nil {
 		return fmt.Errorf("create table: %w", err)
 	}
+
+	if err := s.ensureColumn("file_size", "INTEGER DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := s.ensureColumn("is_dir", "INTEGER DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := s.ensureColumn("priority", "INTEGER DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := s.ensureColumn("attempts", "INTEGER DEFAULT 0"); err != nil {
+		return err
+	}
+	// command results, see cmd_result.go
+	for _, col := range []string{"next_attempt_at", "result_status", "result_message", "remote_id"} {
+		if err := s.ensureColumn(col, "TEXT"); err != nil {
+			return err
+		}
+	}
+
+	const index = `CREATE INDEX IF NOT EXISTS idx_file_events_pending ON file_events (processed, event_time)`
+	if _, err := s.db.Exec(index); err != nil {
+		return fmt.Errorf("create index: %w", err)
+	}
+	// per-path ordering checks of the priority lanes look up earlier events by path
+	const pathIndex = `CREATE INDEX IF NOT EXISTS idx_file_events_path ON file_events (file_path, processed, event_time)`
+	if _, err := s.db.Exec(pathIndex); err != nil {
+		return fmt.Errorf("create index: %w", err)
+	}
+	if err := s.initHashSchema(); err != nil {
+		return err
+	}
+	return s.initStepSchema()
+}
+
+// ensureColumn adds column to file_events when an older database lacks it.
+func (s *Storage) ensureColumn(column, definition string) error {
+	rows, err := s.db.Query(`PRAGMA table_info(file_events)`)
+	if err != nil {
+		return fmt.Errorf("table info: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			cid       int
+			name      string
+			colType   string
+			notNull   int
+			dfltValue sql.NullString
+			pk        int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dfltValue, &pk); err != nil {
+			return fmt.Errorf("scan table info: %w", err)
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("table info rows: %w", err)
+	}
+	rows.Close()
+
+	if _, err := s.db.Exec(fmt.Sprintf(`ALTER TABLE file_events ADD COLUMN %s %s`, column, definition)); err != nil {
+		return fmt.Errorf("add column %s: %w", column, err)
+	}
 	return nil
 }
 
 // InsertEvent inserts the Event and returns the inserted row id.
 func (s *Storage) InsertEvent(e *Event) (int64, error) {
-	const query = `INSERT INTO file_events (event_time, event_type, raw_event_type, dir_path, cmd_file, file_path, old_file_path) VALUES (?, ?, ?, ?, ?, ?, ?)`
+	const query = `INSERT INTO file_events (event_time, event_type, raw_event_type, dir_path, cmd_file, file_path, old_file_path, file_size, is_dir, priority) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
 
 	// Use time in UTC for storage
-	res, err := s.db.Exec(query, e.EventTime.UTC().Format(time.RFC3339Nano), e.EventType, e.RawEventType, e.DirPath, e.CmdFile, e.FilePath, e.OldFilePath)
+	res, err := s.db.Exec(query, formatStorageTime(e.EventTime), e.EventType, e.RawEventType, e.DirPath, e.CmdFile, e.FilePath, e.OldFilePath, e.Size, e.IsDir, e.Priority)
 	if err != nil {
 		return 0, fmt.Errorf("insert event: %w", err)
 	}
@@ -93,9 +222,31 @@ func (s *Storage) InsertEvent(e *Event) (int64, error) {
 
 // GetEventByID returns the Event stored with the given id.
 func (s *Storage) GetEventByID(id int64) (Event, error) {
-	const query = `SELECT event_time, event_type, raw_event_type, dir_path, cmd_file, file_path, old_file_path FROM file_events WHERE id = ?`
+	pe, err := s.GetPendingEventByID(id)
+	if err != nil {
+		return Event{}, err
+	}
+	return pe.Event, nil
+}
+
+// GetPendingEventByID returns the event stored with the given id, whatever
+// its processed state.
+func (s *Storage) GetPendingEventByID(id int64) (PendingEvent, error) {
+	query := `SELECT ` + eventColumns + ` FROM file_events WHERE id = ?`
+	return scanPendingEvent(s.db.QueryRow(query, id))
+}
 
+// eventColumns is the column list read by scanPendingEvent.
+const eventColumns = `id, event_time, event_type, raw_event_type, dir_path, cmd_file, file_path, old_file_path, file_size, is_dir, priority, attempts`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// scanPendingEvent reads one row selected with eventColumns.
+func scanPendingEvent(r rowScanner) (PendingEvent, error) {
 	var (
+		id           int64
 		eventTimeStr string
 		eventType    string
 		rawEventType sql.NullString
@@ -103,77 +254,116 @@ func (s *Storage) GetEventByID(id int64) (Event, error) {
 		cmdFile      sql.NullString
 		filePath     string
 		oldFilePath  sql.NullString
+		fileSize     sql.NullInt64
+		isDir        sql.NullBool
+		priority     sql.NullInt64
+		attempts     sql.NullInt64
 	)
-
-	row := s.db.QueryRow(query, id)
-	if err := row.Scan(&eventTimeStr, &eventType, &rawEventType, &dirPath, &cmdFile, &filePath, &oldFilePath); err != nil {
-		return Event{}, fmt.Errorf("scan event: %w", err)
+	if err := r.Scan(&id, &eventTimeStr, &eventType, &rawEventType, &dirPath, &cmdFile, &filePath, &oldFilePath, &fileSize, &isDir, &priority, &attempts); err != nil {
+		return PendingEvent{}, fmt.Errorf("scan event: %w", err)
 	}
 
 	t, err := time.Parse(time.RFC3339Nano, eventTimeStr)
 	if err != nil {
-		return Event{}, fmt.Errorf("parse time: %w", err)
+		return PendingEvent{}, fmt.Errorf("parse time: %w", err)
 	}
 
 	ev := Event{
 		EventTime:    t,
-		RawEventType: "",
+		RawEventType: rawEventType.String,
 		EventType:    EventType(eventType),
 		DirPath:      dirPath,
-		CmdFile:      "",
+		CmdFile:      cmdFile.String,
 		FilePath:     filePath,
-		OldFilePath:  "",
-	}
-	if rawEventType.Valid {
-		ev.RawEventType = rawEventType.String
+		OldFilePath:  oldFilePath.String,
+		Size:         fileSize.Int64,
+		IsDir:        isDir.Bool,
+		Priority:     int(priority.Int64),
 	}
-	if cmdFile.Valid {
-		ev.CmdFile = cmdFile.String
-	}
-	if oldFilePath.Valid {
-		ev.OldFilePath = oldFilePath.String
-	}
-
-	return ev, nil
+	return PendingEvent{ID: id, Event: ev, Attempts: int(attempts.Int64)}, nil
 }
 
 // PendingEvent is an event read from storage including its DB id.
 type PendingEvent struct {
 	ID int64
 	Event
+	// Attempts counts earlier failed command runs of this event.
+	Attempts int
+
+	// batch is set on the event a batch command is rendered for.
+	batch *batchInfo
 }
 
-// GetPendingEvents returns the earliest unprocessed event (older than 2s)
-// and any subsequent unprocessed events whose event_time is within 2 second
-// after that earliest event. Results are ordered by event_time ascending.
+// GetPendingEvents reads a pending window with the default windows, see
+// GetPendingEventsWindow.
 func (s *Storage) GetPendingEvents() ([]PendingEvent, error) {
-	// only consider events older than 2X to avoid racing with writer
-	cutoff := time.Now().Add(-2 * rangeInterval).UTC().Format(time.RFC3339)
+	return s.GetPendingEventsWindow(defaultWindows)
+}
 
-	// 1) find the earliest event_time among unprocessed events older than cutoff
-	const minQuery = `SELECT MIN(event_time) FROM file_events WHERE processed = 0 AND event_time <= ?`
-	var minEventTime sql.NullString
-	if err := s.db.QueryRow(minQuery, cutoff).Scan(&minEventTime); err != nil {
-		return nil, fmt.Errorf("query min event_time: %w", err)
+// samePathWaiting returns a subquery matching unprocessed rows p on the path
+// of row e that also satisfy cond; e must wait for them.
+func samePathWaiting(cond string) string {
+	return `SELECT 1 FROM file_events p WHERE p.processed = 0 AND ` + cond + `
+		AND (p.file_path = e.file_path OR p.file_path = e.old_file_path OR p.old_file_path = e.file_path)`
+}
+
+// dueCond excludes events waiting for a scheduled retry; it takes the
+// current storage time as parameter.
+const dueCond = `(next_attempt_at IS NULL OR next_attempt_at <= ?)`
+
+// processedHeld marks events held by NoCmdHold until a cmd file changes.
+const processedHeld = 4
+
+// processedBatched marks events collected into a batch command that has not
+// run yet.
+const processedBatched = 5
+
+// notBehindHeld excludes rows e queued behind a held or batched event of
+// their path.
+const notBehindHeld = `NOT EXISTS (SELECT 1 FROM file_events h WHERE h.processed IN (4, 5) AND h.event_time < e.event_time
+		AND (h.file_path = e.file_path OR h.file_path = e.old_file_path OR h.old_file_path = e.file_path))`
+
+// GetPendingEventsWindow returns the window start event (older than
+// w.SettleDelay, see pendingAnchor) and any subsequent unprocessed events
+// whose event_time is within w.FetchWindow after it. Events queued behind an
+// older unprocessed event of the same path are left out. Results are ordered
+// by event_time ascending, with the insert order (id) breaking ties between
+// events that share a timestamp.
+func (s *Storage) GetPendingEventsWindow(w Windows) ([]PendingEvent, error) {
+	w = w.withDefaults()
+	// only consider events older than settle to avoid racing with writer
+	cutoff := formatStorageTime(time.Now().Add(-w.SettleDelay))
+
+	now := formatStorageTime(time.Now())
+
+	// 1) find the event_time the window starts at
+	minEventTime, err := s.pendingAnchor(cutoff, now, w.PriorityMaxWait)
+	if err != nil {
+		return nil, err
 	}
 	if !minEventTime.Valid || minEventTime.String == "" {
 		// no eligible events
 		return nil, nil
 	}
 
-	tmin, err := time.Parse(time.RFC3339, minEventTime.String)
+	tmin, err := time.Parse(time.RFC3339Nano, minEventTime.String)
 	if err != nil {
 		return nil, fmt.Errorf("parse min event_time: %w", err)
 	}
 
-	// upper bound = minEventTime + 2X (storage returns a slightly larger window;
-	// GetAndFixedPendingEvents will only act on matches within 1s)
-	upper := tmin.Add(2 * rangeInterval).UTC().Format(time.RFC3339Nano)
-	lower := tmin.UTC().Format(time.RFC3339Nano)
+	// upper bound = minEventTime + fetch (storage returns a slightly larger window;
+	// GetAndFixedPendingEvents will only act on events within the match window)
+	upper := formatStorageTime(tmin.Add(w.FetchWindow))
+	lower := formatStorageTime(tmin)
 
-	const query = `SELECT id, event_time, event_type, raw_event_type, dir_path, cmd_file, file_path, old_file_path FROM file_events WHERE processed = 0 AND event_time >= ? AND event_time <= ? ORDER BY event_time ASC`
+	// events behind an older pending event of their path wait, whether that
+	// one is before the window or inside it waiting for a retry
+	query := `SELECT ` + eventColumns + ` FROM file_events e WHERE processed = 0 AND event_time >= ? AND event_time <= ? AND ` + dueCond + `
+		AND ` + notBehindHeld + `
+		AND NOT EXISTS (` + samePathWaiting("p.event_time < e.event_time AND (p.event_time < ? OR p.next_attempt_at > ?)") + `)
+		ORDER BY event_time ASC, id ASC`
 
-	rows, err := s.db.Query(query, lower, upper)
+	rows, err := s.db.Query(query, lower, upper, now, lower, now)
 	if err != nil {
 		return nil, fmt.Errorf("query pending window: %w", err)
 	}
@@ -181,43 +371,225 @@ func (s *Storage) GetPendingEvents() ([]PendingEvent, error) {
 
 	var res []PendingEvent
 	for rows.Next() {
-		var id int64
-		var (
-			eventTimeStr string
-			eventType    string
-			rawEventType sql.NullString
-			dirPath      string
-			cmdFile      sql.NullString
-			filePath     string
-			oldFilePath  sql.NullString
-		)
-		if err := rows.Scan(&id, &eventTimeStr, &eventType, &rawEventType, &dirPath, &cmdFile, &filePath, &oldFilePath); err != nil {
-			return nil, fmt.Errorf("scan pending row: %w", err)
+		pe, err := scanPendingEvent(rows)
+		if err != nil {
+			return nil, fmt.Errorf("pending row: %w", err)
 		}
-		t, err := time.Parse(time.RFC3339Nano, eventTimeStr)
+		res = append(res, pe)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows err: %w", err)
+	}
+	return res, nil
+}
+
+// pendingAnchor returns the event_time the next window starts at, among
+// unprocessed events not newer than cutoff and not waiting for a retry. Normally that is the earliest
+// event of the highest priority lane that is not queued behind an older
+// event of the same path; once the oldest event has waited longer than
+// maxWait it is served first regardless of its lane. The result is invalid
+// when no event is eligible.
+func (s *Storage) pendingAnchor(cutoff, now string, maxWait time.Duration) (sql.NullString, error) {
+	const minQuery = `SELECT MIN(event_time) FROM file_events e WHERE processed = 0 AND event_time <= ? AND ` + dueCond + ` AND ` + notBehindHeld
+	var oldest sql.NullString
+	if err := s.db.QueryRow(minQuery, cutoff, now).Scan(&oldest); err != nil {
+		return oldest, fmt.Errorf("query min event_time: %w", err)
+	}
+	if !oldest.Valid || oldest.String == "" {
+		return oldest, nil
+	}
+	if oldest.String <= formatStorageTime(time.Now().Add(-maxWait)) {
+		// starvation protection
+		return oldest, nil
+	}
+
+	rows, err := s.db.Query(`SELECT DISTINCT priority FROM file_events e WHERE processed = 0 AND event_time <= ? AND `+dueCond+` AND `+notBehindHeld+` ORDER BY priority DESC`, cutoff, now)
+	if err != nil {
+		return oldest, fmt.Errorf("query priorities: %w", err)
+	}
+	var lanes []sql.NullInt64
+	for rows.Next() {
+		var p sql.NullInt64
+		if err := rows.Scan(&p); err != nil {
+			rows.Close()
+			return oldest, fmt.Errorf("scan priority: %w", err)
+		}
+		lanes = append(lanes, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return oldest, fmt.Errorf("priorities rows err: %w", err)
+	}
+	if len(lanes) < 2 {
+		// a single lane: plain event_time order
+		return oldest, nil
+	}
+
+	laneQuery := `SELECT MIN(event_time) FROM file_events e WHERE processed = 0 AND event_time <= ? AND COALESCE(priority, 0) = ? AND ` + dueCond + ` AND ` + notBehindHeld + `
+		AND NOT EXISTS (` + samePathWaiting("p.event_time < e.event_time") + `)`
+	for _, p := range lanes {
+		var anchor sql.NullString
+		if err := s.db.QueryRow(laneQuery, cutoff, p.Int64, now).Scan(&anchor); err != nil {
+			return oldest, fmt.Errorf("query lane %d: %w", p.Int64, err)
+		}
+		if anchor.Valid && anchor.String != "" {
+			return anchor, nil
+		}
+	}
+	return oldest, nil
+}
+
+// HasPendingEvents reports whether an unprocessed event older than settle,
+// not waiting for a retry and not behind a held event exists.
+func (s *Storage) HasPendingEvents(settle time.Duration) (bool, error) {
+	const query = `SELECT EXISTS (SELECT 1 FROM file_events e WHERE processed = 0 AND event_time <= ? AND ` + dueCond + ` AND ` + notBehindHeld + `)`
+	var exists bool
+	if err := s.db.QueryRow(query, formatStorageTime(time.Now().Add(-settle)), formatStorageTime(time.Now())).Scan(&exists); err != nil {
+		return false, fmt.Errorf("query pending exists: %w", err)
+	}
+	return exists, nil
+}
+
+// NextDueTime returns when the next pending event becomes fetchable: the
+// earliest event still younger than settle becomes old enough, or the
+// earliest scheduled retry (or parked event) is due. ok is false when there
+// is no such event.
+func (s *Storage) NextDueTime(settle time.Duration) (due time.Time, ok bool, err error) {
+	const youngQuery = `SELECT MIN(event_time) FROM file_events WHERE processed = 0 AND event_time > ?`
+	var minEventTime sql.NullString
+	if err := s.db.QueryRow(youngQuery, formatStorageTime(time.Now().Add(-settle))).Scan(&minEventTime); err != nil {
+		return time.Time{}, false, fmt.Errorf("query young event_time: %w", err)
+	}
+	if minEventTime.Valid && minEventTime.String != "" {
+		t, err := time.Parse(time.RFC3339Nano, minEventTime.String)
 		if err != nil {
-			return nil, fmt.Errorf("parse time: %w", err)
+			return time.Time{}, false, fmt.Errorf("parse young event_time: %w", err)
 		}
-		ev := Event{
-			EventTime:    t,
-			RawEventType: "",
-			EventType:    EventType(eventType),
-			DirPath:      dirPath,
-			CmdFile:      "",
-			FilePath:     filePath,
-			OldFilePath:  "",
+		due, ok = t.Add(settle), true
+	}
+
+	const retryQuery = `SELECT MIN(next_attempt_at) FROM file_events WHERE processed = 0 AND next_attempt_at > ?`
+	var minNext sql.NullString
+	if err := s.db.QueryRow(retryQuery, formatStorageTime(time.Now())).Scan(&minNext); err != nil {
+		return time.Time{}, false, fmt.Errorf("query next_attempt_at: %w", err)
+	}
+	if minNext.Valid && minNext.String != "" {
+		t, err := time.Parse(time.RFC3339Nano, minNext.String)
+		if err != nil {
+			return time.Time{}, false, fmt.Errorf("parse next_attempt_at: %w", err)
 		}
-		if rawEventType.Valid {
-			ev.RawEventType = rawEventType.String
+		if !ok || t.Before(due) {
+			due, ok = t, true
 		}
-		if cmdFile.Valid {
-			ev.CmdFile = cmdFile.String
+	}
+	return due, ok, nil
+}
+
+// ScheduleRetry counts a failed command run of the event with given id and
+// keeps it pending; with a non-zero at it is not fetched again before then.
+func (s *Storage) ScheduleRetry(id int64, at time.Time, message string) error {
+	var next sql.NullString
+	if !at.IsZero() {
+		next = sql.NullString{String: formatStorageTime(at), Valid: true}
+	}
+	const query = `UPDATE file_events SET attempts = COALESCE(attempts, 0) + 1, next_attempt_at = ?,
+		result_status = ?, result_message = ? WHERE id = ?`
+	if _, err := s.db.Exec(query, next, string(StatusRetry), message, id); err != nil {
+		return fmt.Errorf("schedule retry exec: %w", err)
+	}
+	return nil
+}
+
+// DeferEvent keeps the event with given id pending but not fetched before
+// at, without counting an attempt.
+func (s *Storage) DeferEvent(id int64, at time.Time) error {
+	const query = `UPDATE file_events SET next_attempt_at = ? WHERE id = ?`
+	if _, err := s.db.Exec(query, formatStorageTime(at), id); err != nil {
+		return fmt.Errorf("defer event exec: %w", err)
+	}
+	return nil
+}
+
+// RecordResult stores a final command result and moves the event with given
+// id to processed state (1 done, 2 skipped, 3 failed / dead letter, 4 held).
+func (s *Storage) RecordResult(id int64, processed int, res CmdResult) error {
+	const query = `UPDATE file_events SET processed = ?, next_attempt_at = NULL,
+		result_status = ?, result_message = ?, remote_id = ? WHERE id = ?`
+	r, err := s.db.Exec(query, processed, string(res.Status), res.Message, res.RemoteID, id)
+	if err != nil {
+		return fmt.Errorf("record result exec: %w", err)
+	}
+	if ra, err := r.RowsAffected(); err == nil && ra == 0 {
+		return fmt.Errorf("record result: no rows affected for id %d", id)
+	}
+	return nil
+}
+
+// ReleaseHeldEvents makes held events pending again so their command is
+// resolved anew: all of them when ids is empty, else those with given ids.
+// It returns the number of released events.
+func (s *Storage) ReleaseHeldEvents(ids []int64) (int64, error) {
+	query := `UPDATE file_events SET processed = 0, result_status = NULL, result_message = NULL WHERE processed = 4`
+	args := make([]any, 0, len(ids))
+	if len(ids) > 0 {
+		query += ` AND id IN (?` + strings.Repeat(`, ?`, len(ids)-1) + `)`
+		for _, id := range ids {
+			args = append(args, id)
 		}
-		if oldFilePath.Valid {
-			ev.OldFilePath = oldFilePath.String
+	}
+	res, err := s.db.Exec(query, args...)
+	if err != nil {
+		return 0, fmt.Errorf("release held exec: %w", err)
+	}
+	return res.RowsAffected()
+}
+
+// SetBatched marks the event as collected into a batch (processed = 5).
+func (s *Storage) SetBatched(id int64) error {
+	const query = `UPDATE file_events SET processed = 5 WHERE id = ? AND processed = 0`
+	res, err := s.db.Exec(query, id)
+	if err != nil {
+		return fmt.Errorf("set batched exec: %w", err)
+	}
+	if ra, err := res.RowsAffected(); err == nil && ra == 0 {
+		return fmt.Errorf("set batched: no pending row for id %d", id)
+	}
+	return nil
+}
+
+// ReleaseBatched makes batched events pending again: all of them when ids
+// is empty, e.g. after a restart lost the in-memory batches.
+func (s *Storage) ReleaseBatched(ids []int64) (int64, error) {
+	query := `UPDATE file_events SET processed = 0 WHERE processed = 5`
+	args := make([]any, 0, len(ids))
+	if len(ids) > 0 {
+		query += ` AND id IN (?` + strings.Repeat(`, ?`, len(ids)-1) + `)`
+		for _, id := range ids {
+			args = append(args, id)
 		}
+	}
+	res, err := s.db.Exec(query, args...)
+	if err != nil {
+		return 0, fmt.Errorf("release batched exec: %w", err)
+	}
+	return res.RowsAffected()
+}
+
+// GetHeldEvents returns the held events in event_time order.
+func (s *Storage) GetHeldEvents() ([]PendingEvent, error) {
+	rows, err := s.db.Query(`SELECT ` + eventColumns + ` FROM file_events WHERE processed = 4 ORDER BY event_time ASC, id ASC`)
+	if err != nil {
+		return nil, fmt.Errorf("query held: %w", err)
+	}
+	defer rows.Close()
 
-		res = append(res, PendingEvent{ID: id, Event: ev})
+	var res []PendingEvent
+	for rows.Next() {
+		pe, err := scanPendingEvent(rows)
+		if err != nil {
+			return nil, fmt.Errorf("held row: %w", err)
+		}
+		res = append(res, pe)
 	}
 	if err := rows.Err(); err != nil {
 		return nil, fmt.Errorf("rows err: %w", err)
@@ -301,3 +673,352 @@ func (s *Storage) ConvertDeleteToMoveAndSkipCreate(deleteID int64, createID int6
 	}
 	return nil
 }
+
+// RewriteAndSkip updates the type and paths of row keepID and marks every row
+// in skipIDs as skipped (processed = 2) in a single transaction. keepID may
+// be 0 to only skip rows.
+func (s *Storage) RewriteAndSkip(keepID int64, eventType EventType, filePath, oldFilePath string, skipIDs []int64) (err error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin tx: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	if keepID != 0 {
+		const upd = `UPDATE file_events SET event_type = ?, file_path = ?, old_file_path = ? WHERE id = ?`
+		res, err := tx.Exec(upd, string(eventType), filePath, oldFilePath, keepID)
+		if err != nil {
+			return fmt.Errorf("rewrite event exec: %w", err)
+		}
+		if ra, err := res.RowsAffected(); err == nil && ra == 0 {
+			return fmt.Errorf("rewrite event: no rows affected for id %d", keepID)
+		}
+	}
+
+	const skip = `UPDATE file_events SET processed = 2 WHERE id = ? AND processed = 0`
+	for _, id := range skipIDs {
+		res, err := tx.Exec(skip, id)
+		if err != nil {
+			return fmt.Errorf("mark skipped exec: %w", err)
+		}
+		if ra, err := res.RowsAffected(); err == nil && ra == 0 {
+			return fmt.Errorf("mark skipped: no pending row for id %d", id)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("commit tx: %w", err)
+	}
+	return nil
+}
+
+// CollapseModifyBurst finds the pending MODIFY rows of filePath starting at
+// from, where consecutive rows are at most quiet apart and no other pending
+// event of the path lies between them. All but the latest are marked
+// skipped in one transaction. It returns the kept id and event time, and
+// the skipped ids.
+func (s *Storage) CollapseModifyBurst(filePath string, from time.Time, quiet time.Duration) (keptID int64, keptAt time.Time, skipIDs []int64, err error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, time.Time{}, nil, fmt.Errorf("begin tx: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	const query = `SELECT id, event_time, event_type FROM file_events WHERE processed = 0 AND (file_path = ? OR old_file_path = ?) AND event_time >= ? ORDER BY event_time ASC, id ASC`
+	rows, err := tx.Query(query, filePath, filePath, formatStorageTime(from))
+	if err != nil {
+		return 0, time.Time{}, nil, fmt.Errorf("query modify burst: %w", err)
+	}
+	var (
+		burst []int64
+		prev  time.Time
+	)
+	for rows.Next() {
+		var (
+			id           int64
+			eventTimeStr string
+			eventType    string
+		)
+		if err = rows.Scan(&id, &eventTimeStr, &eventType); err != nil {
+			rows.Close()
+			return 0, time.Time{}, nil, fmt.Errorf("scan modify burst: %w", err)
+		}
+		t, perr := time.Parse(time.RFC3339Nano, eventTimeStr)
+		if perr != nil {
+			rows.Close()
+			err = fmt.Errorf("parse time: %w", perr)
+			return 0, time.Time{}, nil, err
+		}
+		if EventType(eventType) != EventType_MODIFY || (len(burst) > 0 && t.Sub(prev) > quiet) {
+			break
+		}
+		burst = append(burst, id)
+		prev = t
+		keptAt = t
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, time.Time{}, nil, fmt.Errorf("modify burst rows: %w", err)
+	}
+	if len(burst) < 2 {
+		err = tx.Commit()
+		if len(burst) == 1 {
+			keptID = burst[0]
+		}
+		return keptID, keptAt, nil, err
+	}
+
+	keptID, skipIDs = burst[len(burst)-1], burst[:len(burst)-1]
+	const skip = `UPDATE file_events SET processed = 2 WHERE id = ?`
+	for _, id := range skipIDs {
+		if _, err = tx.Exec(skip, id); err != nil {
+			return 0, time.Time{}, nil, fmt.Errorf("mark skipped exec: %w", err)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, time.Time{}, nil, fmt.Errorf("commit tx: %w", err)
+	}
+	return keptID, keptAt, skipIDs, nil
+}
+
+// CancelCreateDelete checks whether the CREATE row createID of filePath is
+// followed only by MODIFY rows and then a DELETE of the same path, with no
+// row of the path processed in between. If so the whole chain is marked
+// skipped in one transaction and its ids are returned.
+func (s *Storage) CancelCreateDelete(createID int64, filePath string, createdAt time.Time) (skipIDs []int64, err error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("begin tx: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	// skipped rows (processed = 2) never ran, so they do not break the chain
+	const query = `SELECT id, event_type, file_path, processed FROM file_events WHERE processed != 2 AND (file_path = ? OR old_file_path = ?) AND event_time >= ? ORDER BY event_time ASC, id ASC`
+	rows, err := tx.Query(query, filePath, filePath, formatStorageTime(createdAt))
+	if err != nil {
+		return nil, fmt.Errorf("query create chain: %w", err)
+	}
+	var (
+		chain    []int64
+		complete bool
+		started  bool
+	)
+	for rows.Next() {
+		var (
+			id        int64
+			eventType string
+			path      string
+			processed int
+		)
+		if err = rows.Scan(&id, &eventType, &path, &processed); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("scan create chain: %w", err)
+		}
+		if !started {
+			// rows sharing the CREATE's timestamp may sort before it
+			if id != createID {
+				continue
+			}
+			started = true
+		}
+		if processed != 0 {
+			break
+		}
+		ev := EventType(eventType)
+		if id == createID || (ev == EventType_MODIFY && path == filePath) {
+			chain = append(chain, id)
+			continue
+		}
+		if ev == EventType_DELETE && path == filePath {
+			chain = append(chain, id)
+			complete = true
+		}
+		break
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("create chain rows: %w", err)
+	}
+	if !complete {
+		return nil, tx.Commit()
+	}
+
+	const skip = `UPDATE file_events SET processed = 2 WHERE id = ?`
+	for _, id := range chain {
+		if _, err = tx.Exec(skip, id); err != nil {
+			return nil, fmt.Errorf("mark skipped exec: %w", err)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("commit tx: %w", err)
+	}
+	return chain, nil
+}
+
+// CollapseMoveChain follows the RENAME/MOVE row firstID (oldPath -> newPath)
+// through later pending RENAME/MOVE rows whose old_file_path is the previous
+// new path, stopping at any other pending event touching the path. The first
+// row becomes the net move and the others are skipped; a chain ending at
+// oldPath is a round trip and every row is skipped. All in one transaction.
+// It returns the final path and the skipped ids (nil when nothing changed).
+func (s *Storage) CollapseMoveChain(firstID int64, oldPath, newPath string, from time.Time) (finalPath string, skipIDs []int64, err error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return "", nil, fmt.Errorf("begin tx: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	const next = `SELECT id, event_time, event_type, file_path, old_file_path FROM file_events WHERE processed = 0 AND id != ? AND (file_path = ? OR old_file_path = ?) AND event_time >= ? ORDER BY event_time ASC, id ASC LIMIT 1`
+	finalPath = newPath
+	lastID, at := firstID, formatStorageTime(from)
+	for {
+		var (
+			id           int64
+			eventTimeStr string
+			eventType    string
+			target       string
+			old          sql.NullString
+		)
+		err = tx.QueryRow(next, lastID, finalPath, finalPath, at).Scan(&id, &eventTimeStr, &eventType, &target, &old)
+		if err == sql.ErrNoRows {
+			err = nil
+			break
+		}
+		if err != nil {
+			return "", nil, fmt.Errorf("query move chain: %w", err)
+		}
+		ev := EventType(eventType)
+		if (ev != EventType_RENAME && ev != EventType_MOVE) || old.String != finalPath {
+			break
+		}
+		finalPath = target
+		skipIDs = append(skipIDs, id)
+		lastID, at = id, eventTimeStr
+		if finalPath == oldPath {
+			break
+		}
+	}
+	if len(skipIDs) == 0 {
+		return newPath, nil, tx.Commit()
+	}
+
+	const skip = `UPDATE file_events SET processed = 2 WHERE id = ?`
+	if finalPath == oldPath {
+		skipIDs = append([]int64{firstID}, skipIDs...)
+	} else {
+		eventType := EventType_MOVE
+		if path.Dir(toSlash(oldPath)) == path.Dir(toSlash(finalPath)) {
+			eventType = EventType_RENAME
+		}
+		const upd = `UPDATE file_events SET event_type = ?, file_path = ? WHERE id = ?`
+		if _, err = tx.Exec(upd, string(eventType), finalPath, firstID); err != nil {
+			return "", nil, fmt.Errorf("rewrite net move exec: %w", err)
+		}
+	}
+	for _, id := range skipIDs {
+		if _, err = tx.Exec(skip, id); err != nil {
+			return "", nil, fmt.Errorf("mark skipped exec: %w", err)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return "", nil, fmt.Errorf("commit tx: %w", err)
+	}
+	return finalPath, skipIDs, nil
+}
+
+// AbsorbDirEvents treats row dirID as a directory event on oldDir (and
+// newDir for a RENAME/MOVE) and marks the per-file rows it covers within
+// window of at as skipped: DELETEs under oldDir, CREATEs under newDir and
+// RENAME/MOVEs from oldDir to newDir. A row not flagged isDir is promoted to
+// a directory event only when such rows exist. Everything happens in one
+// transaction; it returns whether the row is a directory and the absorbed ids.
+func (s *Storage) AbsorbDirEvents(dirID int64, isDir bool, oldDir, newDir string, at time.Time, window time.Duration) (bool, []int64, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, nil, fmt.Errorf("begin tx: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	const query = `SELECT id, event_type, file_path, old_file_path FROM file_events WHERE processed = 0 AND id != ? AND event_time >= ? AND event_time <= ?`
+	rows, err := tx.Query(query, dirID, formatStorageTime(at.Add(-window)), formatStorageTime(at.Add(window)))
+	if err != nil {
+		return false, nil, fmt.Errorf("query dir children: %w", err)
+	}
+	var absorbed []int64
+	for rows.Next() {
+		var (
+			id        int64
+			eventType string
+			filePath  string
+			old       sql.NullString
+		)
+		if err = rows.Scan(&id, &eventType, &filePath, &old); err != nil {
+			rows.Close()
+			return false, nil, fmt.Errorf("scan dir children: %w", err)
+		}
+		switch EventType(eventType) {
+		case EventType_DELETE:
+			if isUnderDir(filePath, oldDir) {
+				absorbed = append(absorbed, id)
+			}
+		case EventType_CREATE:
+			if newDir != "" && isUnderDir(filePath, newDir) {
+				absorbed = append(absorbed, id)
+			}
+		case EventType_RENAME, EventType_MOVE:
+			if newDir != "" && isUnderDir(old.String, oldDir) && isUnderDir(filePath, newDir) {
+				absorbed = append(absorbed, id)
+			}
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return false, nil, fmt.Errorf("dir children rows: %w", err)
+	}
+	if !isDir && len(absorbed) == 0 {
+		return false, nil, tx.Commit()
+	}
+
+	if _, err = tx.Exec(`UPDATE file_events SET is_dir = 1 WHERE id = ?`, dirID); err != nil {
+		return false, nil, fmt.Errorf("mark dir exec: %w", err)
+	}
+	const skip = `UPDATE file_events SET processed = 2 WHERE id = ?`
+	for _, id := range absorbed {
+		if _, err = tx.Exec(skip, id); err != nil {
+			return false, nil, fmt.Errorf("mark skipped exec: %w", err)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return false, nil, fmt.Errorf("commit tx: %w", err)
+	}
+	return true, absorbed, nil
+}
+
+// isUnderDir reports whether p lies strictly inside dir.
+func isUnderDir(p, dir string) bool {
+	if dir == "" {
+		return false
+	}
+	sp, sd := toSlash(p), strings.TrimSuffix(toSlash(dir), "/")
+	return len(sp) > len(sd) && hasPathPrefix(sp, sd)
+}
@@ -0,0 +1,139 @@
+package app
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// initHashSchema creates the tables backing HashIndex.
+func (s *Storage) initHashSchema() error {
+	const schema = `CREATE TABLE IF NOT EXISTS file_hashes (
+		file_path TEXT PRIMARY KEY,
+		hash TEXT NOT NULL,
+		file_size INTEGER,
+		updated_at DATETIME NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS deleted_hashes (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		hash TEXT NOT NULL,
+		file_path TEXT NOT NULL,
+		file_size INTEGER,
+		deleted_at DATETIME NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_deleted_hashes_hash ON deleted_hashes (hash, deleted_at);`
+
+	if _, err := s.db.Exec(schema); err != nil {
+		return fmt.Errorf("create hash tables: %w", err)
+	}
+	return nil
+}
+
+// RecordFileHash stores the content hash of a file present at the destination.
+func (s *Storage) RecordFileHash(filePath, hash string, size int64) error {
+	const query = `INSERT INTO file_hashes (file_path, hash, file_size, updated_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT(file_path) DO UPDATE SET hash = excluded.hash, file_size = excluded.file_size, updated_at = excluded.updated_at`
+	if _, err := s.db.Exec(query, filePath, hash, size, formatStorageTime(time.Now())); err != nil {
+		return fmt.Errorf("record file hash exec: %w", err)
+	}
+	return nil
+}
+
+// RenameFileHash moves the hash entry of oldPath to newPath, if any.
+func (s *Storage) RenameFileHash(oldPath, newPath string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin tx: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM file_hashes WHERE file_path = ?`, newPath); err != nil {
+		return fmt.Errorf("rename file hash exec: %w", err)
+	}
+	if _, err := tx.Exec(`UPDATE file_hashes SET file_path = ?, updated_at = ? WHERE file_path = ?`,
+		newPath, formatStorageTime(time.Now()), oldPath); err != nil {
+		return fmt.Errorf("rename file hash exec: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit tx: %w", err)
+	}
+	return nil
+}
+
+// RecordDeletedHash moves the hash entry of filePath into deleted_hashes and
+// prunes deleted entries older than keepSince. It is a no-op when the file
+// was never hashed.
+func (s *Storage) RecordDeletedHash(filePath string, deletedAt, keepSince time.Time) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin tx: %w", err)
+	}
+	defer tx.Rollback()
+
+	const ins = `INSERT INTO deleted_hashes (hash, file_path, file_size, deleted_at)
+		SELECT hash, file_path, file_size, ? FROM file_hashes WHERE file_path = ?`
+	if _, err := tx.Exec(ins, formatStorageTime(deletedAt), filePath); err != nil {
+		return fmt.Errorf("record deleted hash exec: %w", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM file_hashes WHERE file_path = ?`, filePath); err != nil {
+		return fmt.Errorf("drop file hash exec: %w", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM deleted_hashes WHERE deleted_at < ?`, formatStorageTime(keepSince)); err != nil {
+		return fmt.Errorf("prune deleted hashes exec: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit tx: %w", err)
+	}
+	return nil
+}
+
+// ConvertCreateToHashMove looks up the most recent file deleted since since
+// with the given hash. If found, the CREATE row createID becomes a MOVE from
+// the deleted path and the deleted entry is consumed, in one transaction.
+// It returns the old path, or "" when nothing matched.
+func (s *Storage) ConvertCreateToHashMove(createID int64, hash string, since time.Time) (oldPath string, err error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return "", fmt.Errorf("begin tx: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	const find = `SELECT id, file_path FROM deleted_hashes WHERE hash = ? AND deleted_at >= ? ORDER BY deleted_at DESC LIMIT 1`
+	var deletedID int64
+	err = tx.QueryRow(find, hash, formatStorageTime(since)).Scan(&deletedID, &oldPath)
+	if err == sql.ErrNoRows {
+		return "", tx.Commit()
+	}
+	if err != nil {
+		return "", fmt.Errorf("query deleted hash: %w", err)
+	}
+
+	const upd = `UPDATE file_events SET event_type = ?, old_file_path = ? WHERE id = ?`
+	if _, err = tx.Exec(upd, string(EventType_MOVE), oldPath, createID); err != nil {
+		return "", fmt.Errorf("convert create->move exec: %w", err)
+	}
+	if _, err = tx.Exec(`DELETE FROM deleted_hashes WHERE id = ?`, deletedID); err != nil {
+		return "", fmt.Errorf("consume deleted hash exec: %w", err)
+	}
+	if err = tx.Commit(); err != nil {
+		return "", fmt.Errorf("commit tx: %w", err)
+	}
+	return oldPath, nil
+}
+
+// RevertHashMove turns the event with given id, rewritten into a MOVE by
+// ConvertCreateToHashMove, back into a pending CREATE. The failed move
+// counts as an attempt.
+func (s *Storage) RevertHashMove(id int64, message string) error {
+	const query = `UPDATE file_events SET event_type = ?, old_file_path = NULL,
+		attempts = COALESCE(attempts, 0) + 1, next_attempt_at = NULL,
+		result_status = ?, result_message = ? WHERE id = ?`
+	if _, err := s.db.Exec(query, string(EventType_CREATE), string(StatusRetry), message, id); err != nil {
+		return fmt.Errorf("revert hash move exec: %w", err)
+	}
+	return nil
+}
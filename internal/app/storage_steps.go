@@ -0,0 +1,78 @@
+package app
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// StepRecord is the stored outcome of one pipeline step of an event.
+type StepRecord struct {
+	Index      int
+	Name       string
+	Status     string
+	Message    string
+	FinishedAt time.Time
+}
+
+// step statuses besides the CmdStatus values
+const stepCompensated = "compensated"
+
+// initStepSchema creates the table recording pipeline step progress.
+func (s *Storage) initStepSchema() error {
+	const schema = `CREATE TABLE IF NOT EXISTS event_steps (
+		event_id INTEGER NOT NULL,
+		step INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		status TEXT NOT NULL,
+		message TEXT,
+		finished_at DATETIME NOT NULL,
+		PRIMARY KEY (event_id, step)
+	);`
+	if _, err := s.db.Exec(schema); err != nil {
+		return fmt.Errorf("create steps table: %w", err)
+	}
+	return nil
+}
+
+// RecordStep stores the outcome of step index of the event, replacing an
+// earlier one.
+func (s *Storage) RecordStep(eventID int64, index int, name, status, message string) error {
+	const query = `INSERT INTO event_steps (event_id, step, name, status, message, finished_at) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT(event_id, step) DO UPDATE SET name = excluded.name, status = excluded.status,
+		message = excluded.message, finished_at = excluded.finished_at`
+	if _, err := s.db.Exec(query, eventID, index, name, status, message, formatStorageTime(time.Now())); err != nil {
+		return fmt.Errorf("record step exec: %w", err)
+	}
+	return nil
+}
+
+// GetSteps returns the recorded steps of the event in step order.
+func (s *Storage) GetSteps(eventID int64) ([]StepRecord, error) {
+	rows, err := s.db.Query(`SELECT step, name, status, message, finished_at FROM event_steps WHERE event_id = ? ORDER BY step`, eventID)
+	if err != nil {
+		return nil, fmt.Errorf("query steps: %w", err)
+	}
+	defer rows.Close()
+
+	var res []StepRecord
+	for rows.Next() {
+		var (
+			r        StepRecord
+			message  sql.NullString
+			finished string
+		)
+		if err := rows.Scan(&r.Index, &r.Name, &r.Status, &message, &finished); err != nil {
+			return nil, fmt.Errorf("scan step: %w", err)
+		}
+		r.Message = message.String
+		if r.FinishedAt, err = time.Parse(time.RFC3339Nano, finished); err != nil {
+			return nil, fmt.Errorf("parse step time: %w", err)
+		}
+		res = append(res, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows err: %w", err)
+	}
+	return res, nil
+}
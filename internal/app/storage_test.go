@@ -102,3 +102,94 @@ func TestStorageInsertEvent(t *testing.T) {
 		t.Fatalf("event_time mismatch (2): got %v want %v (delta %v)", got2.EventTime, ev2.EventTime.UTC(), delta2)
 	}
 }
+
+// TestPendingOrderSameTimestamp ensures events sharing an event_time come back
+// in ingest order.
+func TestPendingOrderSameTimestamp(t *testing.T) {
+	path := "./test_seq.db"
+	_ = os.Remove(path)
+	defer os.Remove(path)
+
+	st, err := OpenAndInit(path)
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	defer st.Close()
+
+	at := time.Now().Add(-10 * time.Second).Truncate(time.Second)
+	var ids []int64
+	for _, name := range []string{"c.jpg", "a.jpg", "b.jpg"} {
+		id, err := st.InsertEvent(&Event{EventTime: at, EventType: EventType_MODIFY, FilePath: name})
+		if err != nil {
+			t.Fatalf("insert %s: %v", name, err)
+		}
+		ids = append(ids, id)
+	}
+	// a sub-second later event must sort after all of them
+	later, err := st.InsertEvent(&Event{EventTime: at.Add(300 * time.Millisecond), EventType: EventType_MODIFY, FilePath: "d.jpg"})
+	if err != nil {
+		t.Fatalf("insert later: %v", err)
+	}
+	ids = append(ids, later)
+
+	pending, err := st.GetPendingEvents()
+	if err != nil {
+		t.Fatalf("get pending: %v", err)
+	}
+	if len(pending) != len(ids) {
+		t.Fatalf("expected %d pending, got %d", len(ids), len(pending))
+	}
+	for i, pe := range pending {
+		if pe.ID != ids[i] {
+			t.Fatalf("position %d: expected id %d, got %d", i, ids[i], pe.ID)
+		}
+	}
+}
+
+// TestMigrateEventTimes ensures rows stored as RFC3339Nano by older versions
+// are rewritten to the fixed-width layout when the db is opened.
+func TestMigrateEventTimes(t *testing.T) {
+	path := "./test_migrate_time.db"
+	st := openTestStorage(t, path)
+	at := time.Now().Add(-10 * time.Second).Truncate(time.Second)
+	var ids []int64
+	for _, d := range []time.Duration{500 * time.Millisecond, 0, 250 * time.Millisecond} {
+		id, err := st.InsertEvent(&Event{EventTime: at.Add(d), EventType: EventType_MODIFY, FilePath: "a.jpg"})
+		if err != nil {
+			t.Fatalf("insert: %v", err)
+		}
+		ids = append(ids, id)
+		old := at.Add(d).UTC().Format(time.RFC3339Nano)
+		if _, err := st.db.Exec(`UPDATE file_events SET event_time = ? WHERE id = ?`, old, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	st.Close()
+
+	st, err := OpenAndInit(path)
+	if err != nil {
+		t.Fatalf("reopen db: %v", err)
+	}
+	defer st.Close()
+	// the driver hands DATETIME values back as time.Time, so check the
+	// stored text by its length
+	rows, err := st.db.Query(`SELECT id, length(event_time) FROM file_events ORDER BY event_time`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var got []int64
+	for rows.Next() {
+		var id, n int64
+		if err := rows.Scan(&id, &n); err != nil {
+			t.Fatal(err)
+		}
+		if want := len(formatStorageTime(at)); n != int64(want) {
+			t.Errorf("id %d: expected fixed-width event_time of %d chars, got %d", id, want, n)
+		}
+		got = append(got, id)
+	}
+	if want := []int64{ids[1], ids[2], ids[0]}; len(got) != 3 || got[0] != want[0] || got[1] != want[1] || got[2] != want[2] {
+		t.Errorf("expected order %v after migration, got %v", want, got)
+	}
+}
@@ -0,0 +1,216 @@
+package app
+
+import (
+	"path"
+	"regexp"
+
+	"github.com/pancake-lee/pgo/pkg/plogger"
+)
+
+// Office、浏览器、rsync 等程序保存文件时先写临时文件，再重命名为正式文件名：
+//   - Word:    CREATE ~WRL0001.tmp -> RENAME a.docx=>~WRL0002.tmp -> RENAME ~WRL0001.tmp=>a.docx -> DELETE ~WRL0002.tmp
+//   - 浏览器:  CREATE a.zip.crdownload -> MODIFY ... -> RENAME a.zip.crdownload=>a.zip
+//   - rsync:   CREATE .a.txt.Xy12Ab -> RENAME .a.txt.Xy12Ab=>a.txt
+// 在同一个查询窗口内：
+//   - 临时文件被重命名为正式文件名：整条链合并为正式文件的一个 CREATE（原文件存在则为 MODIFY）
+//   - 临时文件出现后又被删除：整条链跳过
+//   - 正式文件被重命名为临时文件后删除，且未被替换：合并为正式文件的 DELETE
+
+// rsyncTempPattern in a pattern list stands for isRsyncTemp.
+const rsyncTempPattern = "<rsync>"
+
+// defaultTempPatterns are basename globs of temporary or partial files.
+var defaultTempPatterns = []string{
+	"~$*",
+	"~*.tmp",
+	"*.tmp",
+	"*.temp",
+	"*.crdownload",
+	"*.download",
+	"*.part",
+	"*.partial",
+	".~lock.*#",
+	rsyncTempPattern,
+}
+
+// rsyncTempName matches the ".filename.XXXXXX" names rsync writes to.
+var rsyncTempName = regexp.MustCompile(`^\..+\.([A-Za-z0-9]{6})$`)
+
+// isRsyncTemp reports whether base looks like an rsync temp file. The
+// random suffix must contain an upper case letter or digit, so dotfiles
+// such as .bashrc.backup or .env.sample are not taken for one.
+func isRsyncTemp(base string) bool {
+	m := rsyncTempName.FindStringSubmatch(base)
+	if m == nil {
+		return false
+	}
+	for _, c := range m[1] {
+		if (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') {
+			return true
+		}
+	}
+	return false
+}
+
+// TempFileMatcher recognizes temporary files by basename.
+type TempFileMatcher struct {
+	patterns []*regexp.Regexp
+	rsync    bool
+}
+
+// NewTempFileMatcher compiles basename globs; nil uses defaultTempPatterns.
+// The entry rsyncTempPattern enables isRsyncTemp.
+func NewTempFileMatcher(patterns []string) (*TempFileMatcher, error) {
+	if patterns == nil {
+		patterns = defaultTempPatterns
+	}
+	m := &TempFileMatcher{}
+	for _, p := range patterns {
+		if p == rsyncTempPattern {
+			m.rsync = true
+			continue
+		}
+		re, err := compileGlob(p)
+		if err != nil {
+			return nil, err
+		}
+		m.patterns = append(m.patterns, re)
+	}
+	return m, nil
+}
+
+// IsTemp reports whether the basename of filePath is a temporary file.
+func (m *TempFileMatcher) IsTemp(filePath string) bool {
+	if filePath == "" {
+		return false
+	}
+	base := path.Base(toSlash(filePath))
+	if m.rsync && isRsyncTemp(base) {
+		return true
+	}
+	for _, re := range m.patterns {
+		if re.MatchString(base) {
+			return true
+		}
+	}
+	return false
+}
+
+var defaultTempFileMatcher, _ = NewTempFileMatcher(nil)
+
+// tempChain tracks pending events of one temporary path.
+type tempChain struct {
+	idx     []int // CREATE/MODIFY/RENAME rows touching the temp path
+	created bool
+	// parkedFrom is the real path renamed to this temp path, parkIdx its row.
+	parkedFrom string
+	parkIdx    int
+}
+
+// coalesceTempFiles collapses temp file chains in all (ordered by time) and
+// returns the remaining events. DB updates are applied per chain; a chain
+// whose update fails is left untouched.
+func coalesceTempFiles(st *Storage, all []PendingEvent, m *TempFileMatcher) []PendingEvent {
+	chains := make(map[string]*tempChain)
+	parked := make(map[string]bool)   // real paths renamed away to a temp name
+	replaced := make(map[string]bool) // real paths replaced from a temp file
+	deleted := make(map[string]bool)  // real paths deleted earlier in the list
+	skip := make(map[int64]bool)
+
+	apply := func(keep int, ev PendingEvent, skipIdx []int, what string) {
+		var keepID int64
+		if keep >= 0 {
+			keepID = all[keep].ID
+		}
+		var skipIDs []int64
+		for _, i := range skipIdx {
+			skipIDs = append(skipIDs, all[i].ID)
+		}
+		if err := st.RewriteAndSkip(keepID, ev.EventType, ev.FilePath, ev.OldFilePath, skipIDs); err != nil {
+			plogger.Errorf("fix temp file %s keep[%v] skip%v err[%v]", what, keepID, skipIDs, err)
+			return
+		}
+		plogger.Debugf("fix temp file %s keep[%v] skip%v", what, keepID, skipIDs)
+		if keep >= 0 {
+			all[keep].EventType = ev.EventType
+			all[keep].FilePath = ev.FilePath
+			all[keep].OldFilePath = ev.OldFilePath
+		}
+		for _, i := range skipIdx {
+			skip[all[i].ID] = true
+		}
+	}
+
+	for i, cur := range all {
+		switch cur.EventType {
+		case EventType_CREATE, EventType_MODIFY:
+			if !m.IsTemp(cur.FilePath) {
+				continue
+			}
+			c := chains[cur.FilePath]
+			if c == nil {
+				c = &tempChain{parkIdx: -1}
+				chains[cur.FilePath] = c
+			}
+			c.idx = append(c.idx, i)
+			if cur.EventType == EventType_CREATE {
+				c.created = true
+			}
+
+		case EventType_RENAME, EventType_MOVE:
+			oldTemp, newTemp := m.IsTemp(cur.OldFilePath), m.IsTemp(cur.FilePath)
+			switch {
+			case oldTemp && newTemp:
+				if c := chains[cur.OldFilePath]; c != nil {
+					c.idx = append(c.idx, i)
+					delete(chains, cur.OldFilePath)
+					chains[cur.FilePath] = c
+				}
+			case oldTemp:
+				// temp -> real: the real file now has the final content
+				c := chains[cur.OldFilePath]
+				if c == nil || !c.created {
+					continue
+				}
+				delete(chains, cur.OldFilePath)
+				ev := cur
+				ev.EventType = EventType_CREATE
+				if parked[cur.FilePath] || deleted[cur.FilePath] {
+					ev.EventType = EventType_MODIFY
+				}
+				ev.OldFilePath = ""
+				replaced[cur.FilePath] = true
+				apply(i, ev, c.idx, "temp->"+string(ev.EventType))
+			case newTemp:
+				// real -> temp: the real file is parked while being replaced
+				chains[cur.FilePath] = &tempChain{parkedFrom: cur.OldFilePath, parkIdx: i}
+				parked[cur.OldFilePath] = true
+			}
+
+		case EventType_DELETE:
+			if !m.IsTemp(cur.FilePath) {
+				deleted[cur.FilePath] = true
+				continue
+			}
+			c := chains[cur.FilePath]
+			if c == nil {
+				continue
+			}
+			delete(chains, cur.FilePath)
+			switch {
+			case c.created:
+				apply(-1, cur, append(c.idx, i), "appeared+disappeared")
+			case c.parkIdx >= 0 && replaced[c.parkedFrom]:
+				apply(-1, cur, append(append(c.idx, c.parkIdx), i), "parked+replaced")
+			case c.parkIdx >= 0:
+				ev := all[c.parkIdx]
+				ev.EventType = EventType_DELETE
+				ev.FilePath = c.parkedFrom
+				ev.OldFilePath = ""
+				apply(c.parkIdx, ev, append(c.idx, i), "parked+deleted")
+			}
+		}
+	}
+
+	return dropSkipped(all, skip)
+}
@@ -0,0 +1,145 @@
+package app
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestTempFileMatcher(t *testing.T) {
+	m := defaultTempFileMatcher
+	cases := map[string]bool{
+		`d\~$report.docx`:      true,
+		`d\~WRL0001.tmp`:       true,
+		`d\a.zip.crdownload`:   true,
+		`d/.notes.txt.Xy12Ab`:  true,
+		`d\report.docx`:        false,
+		`d\a.zip`:              false,
+		`d\.gitignore`:         false,
+		`d\tmp\report.docx`:    false,
+		`d\.~lock.report.odt#`: true,
+		`d/.bashrc.XQ3f9a`:     true,
+		`d/.bashrc.backup`:     false,
+		`d\.env.sample`:        false,
+		`d\.config.backup`:     false,
+	}
+	for p, want := range cases {
+		if got := m.IsTemp(p); got != want {
+			t.Errorf("IsTemp(%q) = %v, want %v", p, got, want)
+		}
+	}
+
+	custom, err := NewTempFileMatcher([]string{"*.bak", rsyncTempPattern})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !custom.IsTemp(`d\a.bak`) || !custom.IsTemp(`d/.a.txt.Xy12Ab`) || custom.IsTemp(`d\a.tmp`) {
+		t.Errorf("unexpected custom matcher results")
+	}
+}
+
+// insertAt inserts events offset from base and returns their ids.
+func insertAt(t *testing.T, st *Storage, base time.Time, evs ...Event) []int64 {
+	t.Helper()
+	var ids []int64
+	for i := range evs {
+		evs[i].EventTime = base.Add(time.Duration(i) * 100 * time.Millisecond)
+		id, err := st.InsertEvent(&evs[i])
+		if err != nil {
+			t.Fatalf("insert %d: %v", i, err)
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func processedOf(t *testing.T, st *Storage, id int64) int {
+	t.Helper()
+	var processed int
+	if err := st.db.QueryRow("SELECT processed FROM file_events WHERE id = ?", id).Scan(&processed); err != nil {
+		t.Fatalf("scan processed: %v", err)
+	}
+	return processed
+}
+
+func TestCoalesceTempFiles(t *testing.T) {
+	path := "./test_temp.db"
+	_ = os.Remove(path)
+	defer os.Remove(path)
+
+	st, err := OpenAndInit(path)
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	defer st.Close()
+
+	base := time.Now().Add(-10 * time.Second)
+	ids := insertAt(t, st, base,
+		// Word save of an existing document
+		Event{EventType: EventType_CREATE, FilePath: `d\~WRL0001.tmp`},
+		Event{EventType: EventType_MODIFY, FilePath: `d\~WRL0001.tmp`},
+		Event{EventType: EventType_RENAME, OldFilePath: `d\a.docx`, FilePath: `d\~WRL0002.tmp`},
+		Event{EventType: EventType_RENAME, OldFilePath: `d\~WRL0001.tmp`, FilePath: `d\a.docx`},
+		Event{EventType: EventType_DELETE, FilePath: `d\~WRL0002.tmp`},
+		// browser download of a new file
+		Event{EventType: EventType_CREATE, FilePath: `d\b.zip.crdownload`},
+		Event{EventType: EventType_RENAME, OldFilePath: `d\b.zip.crdownload`, FilePath: `d\b.zip`},
+		// lock file that comes and goes
+		Event{EventType: EventType_CREATE, FilePath: `d\~$c.docx`},
+		Event{EventType: EventType_DELETE, FilePath: `d\~$c.docx`},
+	)
+
+	res, err := GetAndFixedPendingEvents(st)
+	if err != nil {
+		t.Fatalf("get fixed pending: %v", err)
+	}
+	if len(res) != 2 {
+		t.Fatalf("expected 2 events left, got %d: %+v", len(res), res)
+	}
+	if res[0].ID != ids[3] || res[0].EventType != EventType_MODIFY || res[0].FilePath != `d\a.docx` || res[0].OldFilePath != "" {
+		t.Errorf("unexpected word result %+v", res[0])
+	}
+	if res[1].ID != ids[6] || res[1].EventType != EventType_CREATE || res[1].FilePath != `d\b.zip` {
+		t.Errorf("unexpected download result %+v", res[1])
+	}
+
+	got, err := st.GetEventByID(ids[3])
+	if err != nil {
+		t.Fatalf("get event: %v", err)
+	}
+	if got.EventType != EventType_MODIFY {
+		t.Errorf("expected rewrite persisted, got %s", got.EventType)
+	}
+	for _, i := range []int{0, 1, 2, 4, 5, 7, 8} {
+		if p := processedOf(t, st, ids[i]); p != 2 {
+			t.Errorf("expected row %d skipped, got processed=%d", i, p)
+		}
+	}
+}
+
+func TestCoalesceTempParkedThenDeleted(t *testing.T) {
+	path := "./test_temp2.db"
+	_ = os.Remove(path)
+	defer os.Remove(path)
+
+	st, err := OpenAndInit(path)
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	defer st.Close()
+
+	ids := insertAt(t, st, time.Now().Add(-10*time.Second),
+		Event{EventType: EventType_RENAME, OldFilePath: `d\a.docx`, FilePath: `d\~WRL0002.tmp`},
+		Event{EventType: EventType_DELETE, FilePath: `d\~WRL0002.tmp`},
+	)
+	res, err := GetAndFixedPendingEvents(st)
+	if err != nil {
+		t.Fatalf("get fixed pending: %v", err)
+	}
+	if len(res) != 1 || res[0].ID != ids[0] || res[0].EventType != EventType_DELETE || res[0].FilePath != `d\a.docx` {
+		t.Fatalf("expected single DELETE of the real file, got %+v", res)
+	}
+	if p := processedOf(t, st, ids[1]); p != 2 {
+		t.Errorf("expected temp delete skipped, got processed=%d", p)
+	}
+}
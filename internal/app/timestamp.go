@@ -0,0 +1,97 @@
+package app
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultTimestampLayouts are tried when no layouts are configured. time.Parse
+// accepts a fractional second after the seconds field even when the layout
+// does not mention it, so "2025/11/3 16:43:40.123" also matches.
+var defaultTimestampLayouts = []string{
+	timestampLayout,
+	"2006-1-2 15:04:05",
+}
+
+// TimestampParser parses the %date% %time% value sent by Directory Monitor.
+type TimestampParser struct {
+	layouts []string
+	loc     *time.Location
+}
+
+// Layout keywords for Unix epoch values in seconds and milliseconds.
+const (
+	layoutUnix   = "unix"
+	layoutUnixMs = "unixms"
+)
+
+// NewTimestampParser builds a parser for the given layouts in the given IANA
+// zone ("" or "Local" for the machine zone). Layouts default to
+// defaultTimestampLayouts; "unix" and "unixms" stand for Unix epoch values.
+// RFC3339 is always accepted, and all-digit values that match no layout are
+// taken as Unix epoch.
+func NewTimestampParser(layouts []string, zone string) (*TimestampParser, error) {
+	loc := time.Local
+	if zone != "" && zone != "Local" {
+		l, err := time.LoadLocation(zone)
+		if err != nil {
+			return nil, fmt.Errorf("load timezone %q: %w", zone, err)
+		}
+		loc = l
+	}
+	if len(layouts) == 0 {
+		layouts = defaultTimestampLayouts
+	}
+	return &TimestampParser{layouts: layouts, loc: loc}, nil
+}
+
+// Parse converts s into a time. Accepted inputs, in order: RFC3339 (with
+// optional fraction), each configured layout interpreted in the parser's
+// zone, then Unix epoch in seconds or milliseconds (13 digits or more).
+func (p *TimestampParser) Parse(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return time.Time{}, fmt.Errorf("empty timestamp")
+	}
+
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+
+	var lastErr error
+	for _, layout := range p.layouts {
+		t, err := p.parseLayout(layout, s)
+		if err == nil {
+			return t, nil
+		}
+		lastErr = err
+	}
+
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		// 13 位及以上视为毫秒
+		if len(s) >= 13 {
+			return time.UnixMilli(n), nil
+		}
+		return time.Unix(n, 0), nil
+	}
+	return time.Time{}, lastErr
+}
+
+func (p *TimestampParser) parseLayout(layout, s string) (time.Time, error) {
+	switch layout {
+	case layoutUnix, layoutUnixMs:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("parse %s timestamp %q: %w", layout, s, err)
+		}
+		if layout == layoutUnixMs {
+			return time.UnixMilli(n), nil
+		}
+		return time.Unix(n, 0), nil
+	}
+	return time.ParseInLocation(layout, s, p.loc)
+}
+
+var defaultTimestampParser, _ = NewTimestampParser(nil, "")
@@ -0,0 +1,57 @@
+package app
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimestampParserFormats(t *testing.T) {
+	p, err := NewTimestampParser([]string{"02.01.2006 15:04:05"}, "Asia/Shanghai")
+	if err != nil {
+		t.Fatalf("NewTimestampParser: %v", err)
+	}
+	loc, _ := time.LoadLocation("Asia/Shanghai")
+
+	cases := map[string]time.Time{
+		"03.11.2025 16:43:40":           time.Date(2025, 11, 3, 16, 43, 40, 0, loc),
+		"03.11.2025 16:43:40.250":       time.Date(2025, 11, 3, 16, 43, 40, 250*int(time.Millisecond), loc),
+		"2025-11-03T08:43:40.5Z":        time.Date(2025, 11, 3, 8, 43, 40, 500*int(time.Millisecond), time.UTC),
+		"1762159420":                    time.Unix(1762159420, 0),
+		"1762159420123":                 time.UnixMilli(1762159420123),
+		"2025-11-03T16:43:40.001+08:00": time.Date(2025, 11, 3, 16, 43, 40, int(time.Millisecond), loc),
+	}
+	for in, want := range cases {
+		got, err := p.Parse(in)
+		if err != nil {
+			t.Errorf("Parse(%q) error = %v", in, err)
+			continue
+		}
+		if !got.Equal(want) {
+			t.Errorf("Parse(%q) = %v, want %v", in, got, want)
+		}
+	}
+
+	if _, err := p.Parse("2025/11/3 16:43:40"); err == nil {
+		t.Errorf("expected error for layout that is not configured")
+	}
+
+	// configured layouts win over the epoch fallback
+	p, err = NewTimestampParser([]string{"20060102150405"}, "Asia/Shanghai")
+	if err != nil {
+		t.Fatalf("NewTimestampParser: %v", err)
+	}
+	if got, err := p.Parse("20251103164340"); err != nil || !got.Equal(time.Date(2025, 11, 3, 16, 43, 40, 0, loc)) {
+		t.Errorf("Parse(digit layout) = %v, %v", got, err)
+	}
+	p, err = NewTimestampParser([]string{"unixms"}, "")
+	if err != nil {
+		t.Fatalf("NewTimestampParser: %v", err)
+	}
+	if got, err := p.Parse("1762159420"); err != nil || !got.Equal(time.UnixMilli(1762159420)) {
+		t.Errorf("Parse(unixms) = %v, %v", got, err)
+	}
+
+	if _, err := NewTimestampParser(nil, "Nowhere/City"); err == nil {
+		t.Errorf("expected error for unknown timezone")
+	}
+}
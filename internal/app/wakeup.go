@@ -0,0 +1,153 @@
+package app
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pancake-lee/pgo/pkg/plogger"
+)
+
+// 生产者每个事件启动一次进程，写完即退出，没有长连接可用。
+// 因此消费者直接监听数据库目录：数据库文件或其 WAL 被写入即说明可能有新事件，
+// 消费者据此重新计算"下一个事件静置期满"的时刻并精确唤醒，轮询只作为兜底。
+// 消费者自己的写入也会触发通知，但只会引起一次重新计算，不会引起空转。
+
+// wakeupSlack is added to the computed due time so the event is safely past
+// the settle cutoff when the cycle runs, and waited after a write so its
+// commit is visible.
+const wakeupSlack = 50 * time.Millisecond
+
+// Wakeup signals on C when the sqlite database at dbPath is written.
+type Wakeup struct {
+	C <-chan struct{}
+
+	w     *fsnotify.Watcher
+	names map[string]bool
+	c     chan struct{}
+}
+
+// NewWakeup watches the directory of dbPath for writes to the database, its
+// WAL or its rollback journal.
+func NewWakeup(dbPath string) (*Wakeup, error) {
+	abs, err := filepath.Abs(dbPath)
+	if err != nil {
+		return nil, fmt.Errorf("abs %s: %w", dbPath, err)
+	}
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("new watcher: %w", err)
+	}
+	if err := w.Add(filepath.Dir(abs)); err != nil {
+		w.Close()
+		return nil, fmt.Errorf("watch %s: %w", filepath.Dir(abs), err)
+	}
+
+	base := filepath.Base(abs)
+	c := make(chan struct{}, 1)
+	wk := &Wakeup{
+		C:     c,
+		w:     w,
+		names: map[string]bool{base: true, base + "-wal": true, base + "-journal": true},
+		c:     c,
+	}
+	go wk.loop()
+	return wk, nil
+}
+
+func (wk *Wakeup) loop() {
+	for {
+		select {
+		case ev, ok := <-wk.w.Events:
+			if !ok {
+				return
+			}
+			if !ev.Has(fsnotify.Write) && !ev.Has(fsnotify.Create) {
+				continue
+			}
+			if !wk.names[filepath.Base(ev.Name)] {
+				continue
+			}
+			// coalesce bursts: one pending signal is enough
+			select {
+			case wk.c <- struct{}{}:
+			default:
+			}
+		case err, ok := <-wk.w.Errors:
+			if !ok {
+				return
+			}
+			plogger.Errorf("wakeup watcher: %v", err)
+		}
+	}
+}
+
+// Close stops watching.
+func (wk *Wakeup) Close() error {
+	return wk.w.Close()
+}
+
+// waitForWork blocks until the next cycle should run: a poll tick, the
+// moment the next young pending event settles, a scheduled retry or a
+// collected batch is due, or a write that left settled events to process
+// while the queue was idle. Without a wakeup it just waits for the tick.
+func (a *App) waitForWork(st *Storage, ticker *time.Ticker, wake *Wakeup) {
+	if wake == nil {
+		<-ticker.C
+		return
+	}
+	settle := a.options.windows().SettleDelay
+	// work the last cycle left on purpose (catch-up off, failures) waits for
+	// the tick as before; only an idle queue is woken by new settled events,
+	// so the consumer's own writes cannot make it spin
+	idle := false
+	if more, err := st.HasPendingEvents(settle); err != nil {
+		plogger.Errorf("check pending: %v", err)
+	} else {
+		idle = !more
+	}
+	for {
+		var timerC <-chan time.Time
+		var timer *time.Timer
+		due, ok, err := st.NextDueTime(settle)
+		if err != nil {
+			plogger.Errorf("next due time: %v", err)
+		}
+		// a collected batch may be due before any event settles
+		if bdue, bok := a.nextBatchDue(); bok && (!ok || bdue.Before(due)) {
+			due, ok = bdue, true
+		}
+		if ok {
+			timer = time.NewTimer(time.Until(due) + wakeupSlack)
+			timerC = timer.C
+		}
+
+		select {
+		case <-ticker.C:
+		case <-timerC:
+			plogger.Debugf("wakeup: work due at %s", due.Format(time.RFC3339Nano))
+		case <-wake.C:
+			if timer != nil {
+				timer.Stop()
+			}
+			// the write is seen before the commit is visible to readers
+			time.Sleep(wakeupSlack)
+			// e.g. a producer that was behind inserted already settled events
+			if idle {
+				if more, err := st.HasPendingEvents(settle); err != nil {
+					plogger.Errorf("check pending: %v", err)
+				} else if more {
+					plogger.Debugf("wakeup: settled events written")
+					return
+				}
+			}
+			// otherwise recompute the due time
+			continue
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		return
+	}
+}
@@ -0,0 +1,74 @@
+package app
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWakeupOnInsert(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "wake.db")
+	st := openTestStorage(t, dbPath)
+	wake, err := NewWakeup(dbPath)
+	if err != nil {
+		t.Fatalf("NewWakeup: %v", err)
+	}
+	defer wake.Close()
+
+	now := time.Now()
+	insertAt(t, st, now.Add(-time.Second), Event{EventType: EventType_CREATE, FilePath: `a\1.jpg`})
+	select {
+	case <-wake.C:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected a wakeup after insert")
+	}
+
+	due, ok, err := st.NextDueTime(4 * time.Second)
+	if err != nil || !ok {
+		t.Fatalf("expected a young event, got ok=%v err=%v", ok, err)
+	}
+	if want := now.Add(3 * time.Second); due.Sub(want).Abs() > time.Millisecond {
+		t.Errorf("expected due %v, got %v", want, due)
+	}
+	if _, ok, _ := st.NextDueTime(500 * time.Millisecond); ok {
+		t.Errorf("expected no young event with a short settle delay")
+	}
+
+	// a scheduled retry is due too
+	ids := insertAt(t, st, now.Add(-time.Minute), Event{EventType: EventType_CREATE, FilePath: `a\2.jpg`})
+	retryAt := now.Add(2 * time.Second)
+	if err := st.ScheduleRetry(ids[0], retryAt, "busy"); err != nil {
+		t.Fatal(err)
+	}
+	due, ok, err = st.NextDueTime(500 * time.Millisecond)
+	if err != nil || !ok || due.Sub(retryAt).Abs() > time.Millisecond {
+		t.Errorf("expected the retry due at %v, got %v ok=%v err=%v", retryAt, due, ok, err)
+	}
+}
+
+func TestWaitForWorkWakesForSettledInsert(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "wake.db")
+	st := openTestStorage(t, dbPath)
+	wake, err := NewWakeup(dbPath)
+	if err != nil {
+		t.Fatalf("NewWakeup: %v", err)
+	}
+	defer wake.Close()
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	a := New(Options{Mode: ModeConsumer})
+	done := make(chan struct{})
+	go func() {
+		a.waitForWork(st, ticker, wake)
+		close(done)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	// a producer that was behind: the event is already past the settle delay
+	insertAt(t, st, time.Now().Add(-time.Minute), Event{EventType: EventType_CREATE, FilePath: `a\late.jpg`})
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("expected the wait to end on a settled insert")
+	}
+}
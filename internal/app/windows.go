@@ -0,0 +1,71 @@
+package app
+
+import (
+	"fmt"
+	"time"
+)
+
+// Windows are the timing knobs of the consumer, see the diagram above
+// rangeInterval in 2_consumer.go. Zero fields take the defaults.
+type Windows struct {
+	// SettleDelay is how old the earliest pending event must be before a
+	// cycle picks it up, so late writes of the producer land first.
+	SettleDelay time.Duration
+	// FetchWindow is how far after the earliest pending event a cycle reads.
+	FetchWindow time.Duration
+	// MatchWindow is how far after the earliest pending event a cycle
+	// processes; it is also the default window of pair rules, MODIFY
+	// debouncing and directory absorption.
+	MatchWindow time.Duration
+	// PollInterval is the time between consumer cycles.
+	PollInterval time.Duration
+	// PriorityMaxWait is how long the oldest pending event may wait behind
+	// higher priority lanes before it is served first.
+	PriorityMaxWait time.Duration
+}
+
+// defaultWindows are the values the consumer always used.
+var defaultWindows = Windows{
+	SettleDelay:     2 * rangeInterval,
+	FetchWindow:     2 * rangeInterval,
+	MatchWindow:     rangeInterval,
+	PollInterval:    rangeInterval,
+	PriorityMaxWait: 5 * time.Minute,
+}
+
+func (w Windows) withDefaults() Windows {
+	if w.SettleDelay == 0 {
+		w.SettleDelay = defaultWindows.SettleDelay
+	}
+	if w.FetchWindow == 0 {
+		w.FetchWindow = defaultWindows.FetchWindow
+	}
+	if w.MatchWindow == 0 {
+		w.MatchWindow = defaultWindows.MatchWindow
+	}
+	if w.PollInterval == 0 {
+		w.PollInterval = defaultWindows.PollInterval
+	}
+	if w.PriorityMaxWait == 0 {
+		w.PriorityMaxWait = defaultWindows.PriorityMaxWait
+	}
+	return w
+}
+
+// Validate reports windows that cannot work together. It expects defaults
+// to be applied already.
+func (w Windows) Validate() error {
+	if w.SettleDelay < 0 || w.FetchWindow < 0 || w.MatchWindow < 0 || w.PollInterval < 0 || w.PriorityMaxWait < 0 {
+		return fmt.Errorf("negative window in %s", w)
+	}
+	// a follow-up event beyond the fetch window is never seen by the rules
+	if w.MatchWindow > w.FetchWindow {
+		return fmt.Errorf("match window %v exceeds fetch window %v", w.MatchWindow, w.FetchWindow)
+	}
+	return nil
+}
+
+func (w Windows) String() string {
+	return fmt.Sprintf("settle_delay=%v fetch_window=%v match_window=%v poll_interval=%v priority_max_wait=%v",
+		w.SettleDelay, w.FetchWindow, w.MatchWindow, w.PollInterval, w.PriorityMaxWait)
+}
@@ -0,0 +1,56 @@
+package app
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWindowsValidate(t *testing.T) {
+	if err := (Windows{}).withDefaults().Validate(); err != nil {
+		t.Fatalf("defaults must be valid: %v", err)
+	}
+	bad := []Windows{
+		{MatchWindow: 5 * time.Second, FetchWindow: 3 * time.Second},
+		{SettleDelay: -time.Second},
+		{PollInterval: -time.Second},
+	}
+	for _, w := range bad {
+		if err := w.withDefaults().Validate(); err == nil {
+			t.Errorf("expected error for %s", w)
+		}
+	}
+	if _, err := NewCoalescer(CoalesceConfig{Windows: bad[0]}); err == nil {
+		t.Errorf("expected NewCoalescer to reject %s", bad[0])
+	}
+}
+
+func TestCoalescerWindows(t *testing.T) {
+	st := openTestStorage(t, "./test_windows.db")
+	now := time.Now()
+	ids := insertAt(t, st, now.Add(-1500*time.Millisecond),
+		Event{EventType: EventType_CREATE, FilePath: `a\1.jpg`},
+		Event{EventType: EventType_CREATE, FilePath: `a\2.jpg`},
+	)
+
+	// too young for the default settle delay
+	if res, err := GetAndFixedPendingEvents(st); err != nil || len(res) != 0 {
+		t.Fatalf("expected nothing with default windows, got %+v err %v", res, err)
+	}
+
+	c, err := NewCoalescer(CoalesceConfig{Windows: Windows{
+		SettleDelay: time.Second,
+		FetchWindow: time.Second,
+		MatchWindow: 50 * time.Millisecond,
+	}})
+	if err != nil {
+		t.Fatalf("NewCoalescer: %v", err)
+	}
+	res, err := c.GetAndFixedPendingEvents(st)
+	if err != nil {
+		t.Fatalf("get fixed pending: %v", err)
+	}
+	// the second event is fetched but beyond the match window
+	if len(res) != 1 || res[0].ID != ids[0] {
+		t.Fatalf("expected only the first event, got %+v", res)
+	}
+}